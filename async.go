@@ -0,0 +1,157 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"cloud.google.com/go/firestore"
+)
+
+// asyncSaveBuffer is the number of sessions saved with WithAsyncSave that can
+// wait to be written before further saves are dropped.
+const asyncSaveBuffer = 1024
+
+// asyncSaveWorkers is the number of goroutines writing sessions saved with
+// WithAsyncSave.
+const asyncSaveWorkers = 4
+
+// asyncWrite is a session saved with WithAsyncSave, waiting to be written to
+// Firestore.
+type asyncWrite struct {
+	ref *firestore.DocumentRef
+	doc *sessionDoc
+	// done, if set, makes the write a barrier rather than a save: it is
+	// closed once the writes queued before it are done.
+	done chan struct{}
+}
+
+// asyncSaver writes the sessions saved with WithAsyncSave in the background.
+// Each session is always written by the same worker, in the order it was
+// saved. A nil *asyncSaver writes nothing.
+type asyncSaver struct {
+	// mu guards closing the queues against queuing writes.
+	mu     sync.RWMutex
+	closed bool
+	queues []chan asyncWrite
+	// workers counts the running workers.
+	workers sync.WaitGroup
+}
+
+// startAsyncSaver starts the workers writing sessions saved with
+// WithAsyncSave.
+func (s *Store) startAsyncSaver() {
+	q := &asyncSaver{queues: make([]chan asyncWrite, asyncSaveWorkers)}
+	for i := range q.queues {
+		q.queues[i] = make(chan asyncWrite, asyncSaveBuffer/asyncSaveWorkers)
+		q.workers.Add(1)
+		go s.asyncSaveWorker(q.queues[i], &q.workers)
+	}
+	s.async = q
+}
+
+// queue returns the queue of the worker writing the session.
+func (q *asyncSaver) queue(k cacheKey) chan asyncWrite {
+	h := fnv.New32a()
+	for _, part := range []string{k.tenant, k.name, k.id} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return q.queues[h.Sum32()%uint32(len(q.queues))]
+}
+
+// enqueueSave queues the write of the session, without waiting. If the queue
+// is full, the write is dropped, and is logged and recorded in the metrics. It
+// reports false, queuing nothing, once the Store is closed.
+func (s *Store) enqueueSave(k cacheKey, ref *firestore.DocumentRef, doc *sessionDoc) bool {
+	q := s.async
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false
+	}
+	select {
+	case q.queue(k) <- asyncWrite{ref: ref, doc: doc}:
+	default:
+		s.logger.Error("dropping asynchronous session save", "document", ref.Path)
+		s.metrics.observeAsyncSaveError(asyncSaveDropped)
+	}
+	return true
+}
+
+// waitAsyncSaves waits for the queued writes of the session to finish, so a
+// write can't overtake them.
+func (s *Store) waitAsyncSaves(ctx context.Context, k cacheKey) error {
+	q := s.async
+	if q == nil {
+		return nil
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return nil
+	}
+	done := make(chan struct{})
+	select {
+	case q.queue(k) <- asyncWrite{done: done}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// asyncSaveWorker writes the sessions in queue until it is closed. Writes
+// that fail are logged and recorded in the metrics, but not retried beyond
+// WithRetry.
+func (s *Store) asyncSaveWorker(queue chan asyncWrite, workers *sync.WaitGroup) {
+	defer workers.Done()
+	for w := range queue {
+		if w.done != nil {
+			close(w.done)
+			continue
+		}
+		if err := s.retry(context.Background(), func() error {
+			ctx, cancel := s.withTimeout(context.Background())
+			defer cancel()
+			return s.writeRef(ctx, w.ref, w.doc)
+		}); err != nil {
+			s.logger.Error("saving session asynchronously", "document", w.ref.Path, "error", err)
+			s.metrics.observeAsyncSaveError(asyncSaveFailed)
+		}
+	}
+}
+
+// close stops queuing writes and waits for the queued ones to finish.
+func (q *asyncSaver) close() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, queue := range q.queues {
+			close(queue)
+		}
+	}
+	q.mu.Unlock()
+	q.workers.Wait()
+}
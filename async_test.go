@@ -0,0 +1,199 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/sessions"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWithAsyncSave(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		desc string
+		opts []Option
+	}{
+		{desc: "no cache", opts: []Option{WithAsyncSave()}},
+		{desc: "write-back", opts: []Option{WithCacheTTL(time.Minute), WithCacheMode(WriteBack), WithAsyncSave()}},
+		{desc: "transactional", opts: []Option{WithCacheTTL(time.Minute), WithAsyncSave(), WithTransactionalSave()}},
+		{desc: "chunking", opts: []Option{WithCacheTTL(time.Minute), WithAsyncSave(), WithChunking()}},
+	}
+	for _, test := range tests {
+		if _, err := New(ctx, nil, test.opts...); err == nil {
+			t.Errorf("New with %s got nil error, want error", test.desc)
+		}
+	}
+}
+
+func TestAsyncSaveOrder(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newOfflineClient(t), WithCacheTTL(time.Minute), WithAsyncSave())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Now()
+	var nowMu sync.Mutex
+	s.now = func() time.Time {
+		nowMu.Lock()
+		defer nowMu.Unlock()
+		return now
+	}
+	var mu sync.Mutex
+	written := map[string][]time.Time{}
+	s.writeRef = func(ctx context.Context, ref *firestore.DocumentRef, encoded *sessionDoc) error {
+		// Slow writes let saves queue up.
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		written[ref.ID] = append(written[ref.ID], encoded.UpdatedAt)
+		return nil
+	}
+	// New sessions are written straight away.
+	s.createRef = s.writeRef
+
+	const name = "TestAsyncSaveOrder"
+	r := httptest.NewRequest("GET", "/", nil)
+	want := map[string][]time.Time{}
+	for i := 0; i < 3; i++ {
+		session, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		for j := 0; j < 10; j++ {
+			nowMu.Lock()
+			now = now.Add(time.Second)
+			saved := now
+			nowMu.Unlock()
+			session.Values["testk"] = j
+			if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			want[session.ID] = append(want[session.ID], saved)
+		}
+		// The latest save is cached at once.
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(name, session.ID)
+		got, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if got.IsNew || got.Values["testk"] != 9.0 {
+			t.Errorf("New after Save got IsNew=%v, values %v, want the saved session", got.IsNew, got.Values)
+		}
+	}
+
+	// Close waits for every save to be written.
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for id, want := range want {
+		got := written[id]
+		if len(got) != len(want) {
+			t.Errorf("session %q got %d writes, want %d", id, len(got), len(want))
+			continue
+		}
+		for i := range want {
+			if !got[i].Equal(want[i]) {
+				t.Errorf("session %q write %d got save at %v, want save at %v", id, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestAsyncSaveDropped(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+	s, err := New(ctx, newOfflineClient(t), WithCacheTTL(time.Minute), WithAsyncSave(), WithMetricsRegisterer(reg))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	release := make(chan struct{})
+	s.writeRef = func(ctx context.Context, ref *firestore.DocumentRef, encoded *sessionDoc) error {
+		<-release
+		return nil
+	}
+	s.createRef = func(ctx context.Context, ref *firestore.DocumentRef, encoded *sessionDoc) error {
+		return nil
+	}
+
+	const name = "TestAsyncSaveDropped"
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// New sessions are written straight away, not queued.
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	// One save of the session is being written, and the others fill its
+	// worker's queue, so the last is dropped.
+	saves := asyncSaveBuffer/asyncSaveWorkers + 2
+	for i := 0; i < saves; i++ {
+		if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if i == 0 {
+			// Wait for the worker to take the first save.
+			for len(s.async.queue(s.cacheKey(ctx, name, session.ID))) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	close(release)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := testutil.ToFloat64(s.metrics.asyncErrors.WithLabelValues(asyncSaveDropped)); got != 1 {
+		t.Errorf("dropped saves got %v, want 1", got)
+	}
+}
+
+func TestAsyncSaveAfterClose(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+	s, err := New(ctx, newOfflineClient(t), WithCacheTTL(time.Minute), WithAsyncSave(), WithMetricsRegisterer(reg))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The workers have stopped after Close, so Save writes to the offline
+	// client, which fails, rather than dropping the session.
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	const name = "TestAsyncSaveAfterClose"
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	r.Header.Set(name, "id")
+	session := sessions.NewSession(s, name)
+	if err := s.Save(r, httptest.NewRecorder(), session); err == nil {
+		t.Errorf("Save after Close with an unreachable Firestore got nil, want an error")
+	}
+	if got := testutil.ToFloat64(s.metrics.asyncErrors.WithLabelValues(asyncSaveDropped)); got != 0 {
+		t.Errorf("dropped saves got %v, want 0", got)
+	}
+}
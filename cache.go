@@ -0,0 +1,195 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheStats are statistics about the session cache of a Store. See
+// WithCacheTTL.
+type CacheStats struct {
+	// Hits is the number of sessions loaded from the cache.
+	Hits int64
+	// Misses is the number of sessions looked up in the cache but not found,
+	// including ones whose entries had expired.
+	Misses int64
+	// Evictions is the number of sessions evicted because the cache was full.
+	Evictions int64
+	// Size is the number of sessions currently cached.
+	Size int
+}
+
+// Stats returns statistics about the session cache. They are all zero if the
+// Store doesn't cache sessions.
+func (s *Store) Stats() CacheStats {
+	return s.cache.stats()
+}
+
+// ResetStats resets the Hits, Misses, and Evictions counted by Stats to zero.
+func (s *Store) ResetStats() {
+	s.cache.resetStats()
+}
+
+// cacheKey identifies a cached session.
+type cacheKey struct {
+	tenant, name, id string
+}
+
+// cacheKey returns the cache key of the session with the given name and ID,
+// of the tenant in ctx.
+func (s *Store) cacheKey(ctx context.Context, name, id string) cacheKey {
+	return cacheKey{tenantFromContext(ctx), name, id}
+}
+
+// cacheEntry is a cached session document.
+type cacheEntry struct {
+	key cacheKey
+	doc *sessionDoc
+	// added is when the entry was cached.
+	added time.Time
+}
+
+// sessionCache caches the documents of recently loaded and saved sessions, so
+// they can be loaded again without reading Firestore. If it is full, the least
+// recently used entry is evicted. A nil *sessionCache caches nothing.
+//
+// Documents are cached encoded, so every load decodes its own copy of the
+// session values.
+type sessionCache struct {
+	ttl time.Duration
+	// size is the maximum number of entries. Zero means unbounded.
+	size int
+	now  func() time.Time
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	// lru holds the entries, most recently used first.
+	lru *list.List
+
+	hits, misses, evictions atomic.Int64
+}
+
+// newSessionCache returns a cache of at most size entries, or unbounded if
+// size is zero, whose entries last for ttl, according to now.
+func newSessionCache(ttl time.Duration, size int, now func() time.Time) *sessionCache {
+	return &sessionCache{
+		ttl:     ttl,
+		size:    size,
+		now:     now,
+		entries: map[cacheKey]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached document of the session, if it was cached less than
+// ttl ago.
+func (c *sessionCache) get(k cacheKey) (*sessionDoc, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[k]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if c.now().Sub(e.added) >= c.ttl {
+		c.removeElement(el)
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.hits.Add(1)
+	return e.doc, true
+}
+
+// put caches the document of the session.
+func (c *sessionCache) put(k cacheKey, doc *sessionDoc) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[k]; ok {
+		c.removeElement(el)
+	}
+	c.entries[k] = c.lru.PushFront(&cacheEntry{key: k, doc: doc, added: c.now()})
+	if c.size > 0 && c.lru.Len() > c.size {
+		c.removeElement(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// remove removes the session from the cache.
+func (c *sessionCache) remove(k cacheKey) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[k]; ok {
+		c.removeElement(el)
+	}
+}
+
+// removeElement removes the entry in el. c.mu must be held.
+func (c *sessionCache) removeElement(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// stats returns statistics about the cache.
+func (c *sessionCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	size := c.lru.Len()
+	c.mu.Unlock()
+	return CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Size:      size,
+	}
+}
+
+// resetStats resets the counters returned by stats.
+func (c *sessionCache) resetStats() {
+	if c == nil {
+		return
+	}
+	c.hits.Store(0)
+	c.misses.Store(0)
+	c.evictions.Store(0)
+}
+
+// clear removes every entry from the cache.
+func (c *sessionCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[cacheKey]*list.Element{}
+	c.lru.Init()
+}
@@ -0,0 +1,234 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionCache(t *testing.T) {
+	now := time.Date(2021, 1, 19, 12, 0, 0, 0, time.UTC)
+	c := newSessionCache(time.Minute, 0, func() time.Time { return now })
+
+	doc := &sessionDoc{EncodedSession: "encoded"}
+	c.put(cacheKey{name: "checkout", id: "id"}, doc)
+	if got, ok := c.get(cacheKey{name: "checkout", id: "id"}); !ok || got != doc {
+		t.Errorf("get got (%v, %v), want (%v, true)", got, ok, doc)
+	}
+	if _, ok := c.get(cacheKey{name: "basket", id: "id"}); ok {
+		t.Errorf("get with another name got a cached doc, want none")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get(cacheKey{name: "checkout", id: "id"}); ok {
+		t.Errorf("get after the TTL got a cached doc, want none")
+	}
+
+	c.put(cacheKey{name: "checkout", id: "id"}, doc)
+	c.remove(cacheKey{name: "checkout", id: "id"})
+	if _, ok := c.get(cacheKey{name: "checkout", id: "id"}); ok {
+		t.Errorf("get after remove got a cached doc, want none")
+	}
+
+	var nilCache *sessionCache
+	nilCache.put(cacheKey{name: "checkout", id: "id"}, doc)
+	if _, ok := nilCache.get(cacheKey{name: "checkout", id: "id"}); ok {
+		t.Errorf("get on a nil cache got a cached doc, want none")
+	}
+}
+
+func TestSessionCacheSize(t *testing.T) {
+	const n = 3
+	c := newSessionCache(time.Minute, n, time.Now)
+
+	ids := []string{"a", "b", "c", "d"}
+	for _, id := range ids[:n] {
+		c.put(cacheKey{name: "checkout", id: id}, &sessionDoc{EncodedSession: id})
+	}
+	// Use "a", so "b" is the least recently used.
+	if _, ok := c.get(cacheKey{name: "checkout", id: "a"}); !ok {
+		t.Fatalf("get(a) got no cached doc, want one")
+	}
+	c.put(cacheKey{name: "checkout", id: ids[n]}, &sessionDoc{EncodedSession: ids[n]})
+
+	if _, ok := c.get(cacheKey{name: "checkout", id: "b"}); ok {
+		t.Errorf("get(b) got a cached doc, want it evicted")
+	}
+	for _, id := range []string{"a", "c", "d"} {
+		if _, ok := c.get(cacheKey{name: "checkout", id: id}); !ok {
+			t.Errorf("get(%s) got no cached doc, want one", id)
+		}
+	}
+	if got := len(c.entries); got != n {
+		t.Errorf("cache has %d entries, want %d", got, n)
+	}
+}
+
+func TestStats(t *testing.T) {
+	s, err := New(context.Background(), nil, WithCacheTTL(time.Minute), WithCacheSize(2))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	doc := &sessionDoc{EncodedSession: "encoded"}
+	s.cache.get(cacheKey{name: "checkout", id: "a"}) // Miss.
+	s.cache.put(cacheKey{name: "checkout", id: "a"}, doc)
+	s.cache.get(cacheKey{name: "checkout", id: "a"}) // Hit.
+	s.cache.put(cacheKey{name: "checkout", id: "b"}, doc)
+	s.cache.put(cacheKey{name: "checkout", id: "c"}, doc) // Evicts a.
+	s.cache.get(cacheKey{name: "checkout", id: "a"})      // Miss.
+	s.cache.get(cacheKey{name: "checkout", id: "c"})      // Hit.
+
+	want := CacheStats{Hits: 2, Misses: 2, Evictions: 1, Size: 2}
+	if got := s.Stats(); got != want {
+		t.Errorf("Stats got %+v, want %+v", got, want)
+	}
+
+	s.ResetStats()
+	want = CacheStats{Size: 2}
+	if got := s.Stats(); got != want {
+		t.Errorf("after ResetStats, Stats got %+v, want %+v", got, want)
+	}
+
+	s, err = New(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got := s.Stats(); got != (CacheStats{}) {
+		t.Errorf("Stats without a cache got %+v, want zero", got)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithCacheTTL(time.Minute))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	r := httptest.NewRequest("GET", "/", nil)
+	const name = "TestCacheTTL"
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.cleanup(name)
+	session.Values["testkey"] = "cached"
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// Change the session behind the Store's back.
+	other, err := New(ctx, client)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session.Values["testkey"] = "updated"
+	if err := other.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	r.Header.Set(name, session.ID)
+	got, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got, want := got.Values["testkey"], "cached"; got != want {
+		t.Errorf("New within the TTL got testkey=%v, want %v", got, want)
+	}
+
+	now = now.Add(time.Minute)
+	got, err = s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got, want := got.Values["testkey"], "updated"; got != want {
+		t.Errorf("New after the TTL got testkey=%v, want %v", got, want)
+	}
+	if got.IsNew {
+		t.Errorf("New after the TTL got IsNew=true, want false")
+	}
+}
+
+// TestSessionCacheConcurrent is meant to be run with -race.
+func TestSessionCacheConcurrent(t *testing.T) {
+	c := newSessionCache(time.Minute, 8, time.Now)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := fmt.Sprint((i + j) % 10)
+				c.put(cacheKey{name: "checkout", id: id}, &sessionDoc{EncodedSession: id})
+				c.get(cacheKey{name: "checkout", id: id})
+				if j%10 == 0 {
+					c.remove(cacheKey{name: "checkout", id: id})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got := len(c.entries); got > 8 {
+		t.Errorf("cache has %d entries, want at most 8", got)
+	}
+}
+
+// TestStoreConcurrent is meant to be run with -race.
+func TestStoreConcurrent(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithCacheTTL(time.Minute), WithCacheSize(4))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	const name = "TestStoreConcurrent"
+	defer s.cleanup(name)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/", nil)
+			for j := 0; j < 5; j++ {
+				session, err := s.Get(r, name)
+				if err != nil {
+					t.Errorf("Get: %v", err)
+					return
+				}
+				session.Values["count"] = fmt.Sprint(j)
+				if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+					t.Errorf("Save: %v", err)
+					return
+				}
+				r = httptest.NewRequest("GET", "/", nil)
+				r.Header.Set(name, session.ID)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
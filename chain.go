@@ -0,0 +1,90 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"net/http"
+
+	"github.com/gorilla/sessions"
+)
+
+// ChainStore is a sessions store that keeps sessions in a primary store and a
+// secondary one, so sessions can still be served from the secondary while the
+// primary, such as Firestore, is unavailable. A ChainStore is safe for
+// concurrent use by multiple goroutines if both stores are.
+type ChainStore struct {
+	primary   SessionStore
+	secondary SessionStore
+}
+
+var _ SessionStore = (*ChainStore)(nil)
+
+// NewChainStore creates a new ChainStore. Sessions are read from primary, then
+// from secondary if primary fails or doesn't have them, and are written to
+// both. For example, secondary may be a MemoryStore in front of a Store.
+func NewChainStore(primary, secondary SessionStore) *ChainStore {
+	return &ChainStore{primary: primary, secondary: secondary}
+}
+
+// Get returns a cached session, if it exists. Otherwise, Get returns a new
+// session. See Store.Get.
+func (c *ChainStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(c, name)
+}
+
+// New returns the session from the primary store. If the primary store fails,
+// or has no such session, New returns the session from the secondary store
+// instead, if it has it. If both stores fail, New returns a new session with
+// the error of the primary store.
+func (c *ChainStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session, err := c.primary.New(r, name)
+	if err == nil && !session.IsNew {
+		return c.adopt(session), nil
+	}
+	fallback, ferr := c.secondary.New(r, name)
+	if ferr == nil && (err != nil || !fallback.IsNew) {
+		return c.adopt(fallback), nil
+	}
+	return c.adopt(session), err
+}
+
+// adopt returns a copy of session owned by c, so session.Save saves it in
+// both stores.
+func (c *ChainStore) adopt(session *sessions.Session) *sessions.Session {
+	s := sessions.NewSession(c, session.Name())
+	s.ID = session.ID
+	s.Values = session.Values
+	s.Options = session.Options
+	s.IsNew = session.IsNew
+	return s
+}
+
+// Save saves the session in the primary store, then in the secondary store,
+// under the same ID. Only an error from the primary store is returned; the
+// secondary store is written on a best-effort basis, even if the primary
+// store fails.
+func (c *ChainStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	err := c.primary.Save(r, w, session)
+	c.secondary.Save(r, w, session)
+	return err
+}
+
+// Delete deletes the session from both stores and sets its MaxAge to -1. As
+// with Save, only an error from the primary store is returned.
+func (c *ChainStore) Delete(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	err := c.primary.Delete(r, w, session)
+	c.secondary.Delete(r, w, session)
+	return err
+}
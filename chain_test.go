@@ -0,0 +1,137 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/sessions"
+)
+
+// unavailableStore is a SessionStore that always fails, like a Store while
+// Firestore is unavailable.
+type unavailableStore struct{}
+
+func (unavailableStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return nil, errSentinel
+}
+
+func (u unavailableStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(u, name)
+	session.IsNew = true
+	return session, errSentinel
+}
+
+func (unavailableStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	return errSentinel
+}
+
+func (unavailableStore) Delete(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	return errSentinel
+}
+
+func TestChainStore(t *testing.T) {
+	primary, err := NewMemoryStore()
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	secondary, err := NewMemoryStore()
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	c := NewChainStore(primary, secondary)
+
+	const name = "checkout"
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := c.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session.Values["key"] = "value"
+	if err := session.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(name, session.ID)
+	for _, s := range []SessionStore{primary, secondary} {
+		got, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if diff := cmp.Diff(session.Values, got.Values); diff != "" {
+			t.Errorf("New got diff Values (-want, +got):\n%s", diff)
+		}
+	}
+
+	// The session is only in the secondary store after the primary lost it.
+	if err := primary.Delete(r, httptest.NewRecorder(), sessions.NewSession(primary, name)); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	got, err := c.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got.IsNew {
+		t.Errorf("New got a new session, want the one in the secondary store")
+	}
+
+	if err := c.Delete(r, httptest.NewRecorder(), got); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if got, err = c.New(r, name); err != nil || !got.IsNew {
+		t.Errorf("New of a deleted session got IsNew=%v, err %v, want a new session", got.IsNew, err)
+	}
+}
+
+func TestChainStorePrimaryUnavailable(t *testing.T) {
+	secondary, err := NewMemoryStore()
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	c := NewChainStore(unavailableStore{}, secondary)
+
+	const name = "checkout"
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := c.New(r, name)
+	if err != nil {
+		t.Fatalf("New got err %v, want the secondary store to mask the outage", err)
+	}
+	session.Values["key"] = "value"
+	if err := c.Save(r, httptest.NewRecorder(), session); !errors.Is(err, errSentinel) {
+		t.Errorf("Save got err %v, want the primary store's error", err)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(name, session.ID)
+	got, err := c.New(r, name)
+	if err != nil {
+		t.Fatalf("New got err %v, want the secondary store to mask the outage", err)
+	}
+	if diff := cmp.Diff(session.Values, got.Values); diff != "" {
+		t.Errorf("New got diff Values (-want, +got):\n%s", diff)
+	}
+	if got.Store() != c {
+		t.Errorf("New got a session of store %v, want the ChainStore", got.Store())
+	}
+
+	if _, err := NewChainStore(unavailableStore{}, unavailableStore{}).New(r, name); !errors.Is(err, errSentinel) {
+		t.Errorf("New with both stores unavailable got err %v, want the primary store's error", err)
+	}
+}
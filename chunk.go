@@ -0,0 +1,167 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// chunkID returns the document ID of chunk i of the session with the given ID.
+// Chunk 0 is stored in the session's own document.
+func chunkID(id string, i int) string {
+	if i == 0 {
+		return id
+	}
+	return fmt.Sprintf("%s_%d", id, i)
+}
+
+// splitChunks splits the encoded session in doc into documents holding at most
+// size bytes each. The first document is doc itself, which records the number
+// of chunks.
+func splitChunks(doc *sessionDoc, size int) []*sessionDoc {
+	b := doc.payload()
+	if len(b) <= size {
+		return []*sessionDoc{doc}
+	}
+	n := (len(b) + size - 1) / size
+	docs := make([]*sessionDoc, n)
+	for i := range docs {
+		end := (i + 1) * size
+		if end > len(b) {
+			end = len(b)
+		}
+		chunk := &sessionDoc{Name: doc.Name, ExpireAt: doc.ExpireAt}
+		if i == 0 {
+			// Keep the metadata of the session, but not its full payload.
+			d := *doc
+			d.EncodedSession, d.EncodedBytes = "", nil
+			d.Chunks = n
+			chunk = &d
+		}
+		chunk.setPayload(b[i*size : end])
+		docs[i] = chunk
+	}
+	return docs
+}
+
+// saveChunks saves the documents returned by splitChunks in a transaction,
+// deleting any chunks left over from a previous, longer version of the
+// session. If create is set, the session's own document is created rather
+// than overwritten, as in saveDoc.
+func (s *Store) saveChunks(ctx context.Context, name, id string, docs []*sessionDoc, create bool) error {
+	coll := s.collectionRef(ctx, name)
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		old := 1
+		// A new session has no previous chunks to delete.
+		if !create {
+			ds, err := tx.Get(coll.Doc(id))
+			if err != nil && status.Code(err) != codes.NotFound {
+				return fmt.Errorf("Get: %w", err)
+			}
+			if err == nil {
+				prev := sessionDoc{}
+				if err := ds.DataTo(&prev); err != nil {
+					return fmt.Errorf("DataTo: %w", err)
+				}
+				if prev.Chunks > old {
+					old = prev.Chunks
+				}
+			}
+		}
+		for i, doc := range docs {
+			var err error
+			if i == 0 && create {
+				err = tx.Create(coll.Doc(id), doc)
+			} else if i == 0 {
+				data, merge := setMerge(doc)
+				err = tx.Set(coll.Doc(id), data, merge)
+			} else {
+				// Mark the chunk, so it isn't mistaken for a session.
+				doc.ChunkOf = id
+				err = tx.Set(coll.Doc(chunkID(id, i)), doc)
+			}
+			if err != nil {
+				return fmt.Errorf("Set: %w", err)
+			}
+		}
+		for i := len(docs); i < old; i++ {
+			if err := tx.Delete(coll.Doc(chunkID(id, i))); err != nil {
+				return fmt.Errorf("Delete: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// loadChunks reads the remaining chunks of the session stored in doc and
+// replaces its payload with the full encoded session.
+func (s *Store) loadChunks(ctx context.Context, name, id string, doc *sessionDoc) error {
+	if doc.Chunks <= 1 {
+		return nil
+	}
+	coll := s.collectionRef(ctx, name)
+	refs := make([]*firestore.DocumentRef, 0, doc.Chunks-1)
+	for i := 1; i < doc.Chunks; i++ {
+		refs = append(refs, coll.Doc(chunkID(id, i)))
+	}
+	snaps, err := s.client.GetAll(ctx, refs)
+	if err != nil {
+		return fmt.Errorf("GetAll: %w", err)
+	}
+	b := doc.payload()
+	for i, snap := range snaps {
+		if !snap.Exists() {
+			return fmt.Errorf("chunk %d of %d is missing", i+1, doc.Chunks)
+		}
+		chunk := sessionDoc{}
+		if err := snap.DataTo(&chunk); err != nil {
+			return fmt.Errorf("DataTo: %w", err)
+		}
+		b = append(b, chunk.payload()...)
+	}
+	doc.EncodedSession, doc.EncodedBytes = "", nil
+	doc.setPayload(b)
+	return nil
+}
+
+// deleteChunks deletes chunks 1 to n-1 of the session with the given ID.
+func (s *Store) deleteChunks(ctx context.Context, name, id string, n int) error {
+	coll := s.collectionRef(ctx, name)
+	for i := 1; i < n; i++ {
+		if _, err := coll.Doc(chunkID(id, i)).Delete(ctx); err != nil {
+			return fmt.Errorf("Delete: %w", err)
+		}
+	}
+	return nil
+}
+
+// extendChunks sets the expiry of chunks 1 to n-1 of the session with the given
+// ID, so they aren't garbage collected before the session.
+func (s *Store) extendChunks(ctx context.Context, name, id string, n int, expireAt time.Time) error {
+	coll := s.collectionRef(ctx, name)
+	update := firestore.Update{Path: expireAtField, Value: expireAt}
+	for i := 1; i < n; i++ {
+		if _, err := coll.Doc(chunkID(id, i)).Update(ctx, []firestore.Update{update}); err != nil {
+			return fmt.Errorf("Update: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSplitChunks(t *testing.T) {
+	doc := &sessionDoc{Name: "checkout", Codec: codecJSON}
+	payload := []byte(strings.Repeat("a", 10) + strings.Repeat("b", 10) + strings.Repeat("c", 5))
+	doc.setPayload(payload)
+
+	docs := splitChunks(doc, 10)
+	if len(docs) != 3 {
+		t.Fatalf("splitChunks got %d chunks, want 3", len(docs))
+	}
+	if docs[0].Chunks != 3 || docs[0].Codec != codecJSON {
+		t.Errorf("splitChunks got first chunk with Chunks=%d, Codec=%q, want 3 and %q", docs[0].Chunks, docs[0].Codec, codecJSON)
+	}
+	var joined []byte
+	for i, d := range docs {
+		if len(d.payload()) > 10 {
+			t.Errorf("chunk %d got %d bytes, want at most 10", i, len(d.payload()))
+		}
+		if d.Name != "checkout" {
+			t.Errorf("chunk %d got Name=%q, want %q", i, d.Name, "checkout")
+		}
+		joined = append(joined, d.payload()...)
+	}
+	if !bytes.Equal(joined, payload) {
+		t.Errorf("joined chunks got %q, want %q", joined, payload)
+	}
+
+	if got := splitChunks(doc, 100); len(got) != 1 || got[0] != doc {
+		t.Errorf("splitChunks of a short session got %d chunks, want the session itself", len(got))
+	}
+}
+
+func TestChunking(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	const chunkSize = 1 << 10
+	s, err := New(ctx, client, WithChunking(), WithMaxLength(chunkSize))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	const name = "TestChunking"
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.cleanup(name)
+	// Three chunks long once encoded.
+	session.Values["store"] = strings.Repeat("x", 5*chunkSize/2)
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := s.collectionRef(ctx, name).Doc(chunkID(session.ID, i)).Get(ctx); err != nil {
+			t.Errorf("Get(chunk %d): %v", i, err)
+		}
+	}
+
+	r.Header.Set(name, session.ID)
+	got, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if diff := cmp.Diff(session.Values, got.Values); diff != "" {
+		t.Errorf("New got diff Values (-want, +got):\n%s", diff)
+	}
+
+	// The other chunks aren't sessions.
+	chunk := chunkID(session.ID, 1)
+	if ok, err := s.Exists(ctx, name, chunk); err != nil || ok {
+		t.Errorf("Exists(chunk) got %v, %v, want false, nil", ok, err)
+	}
+	if _, err := s.GetByID(ctx, name, chunk); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("GetByID(chunk) got err %v, want ErrSessionNotFound", err)
+	}
+	r.Header.Set(name, chunk)
+	if got, err := s.New(r, name); err != nil {
+		t.Errorf("New(chunk): %v", err)
+	} else if !got.IsNew {
+		t.Errorf("New(chunk) got IsNew false, want a new session")
+	}
+	r.Header.Set(name, session.ID)
+
+	if err := s.Delete(r, httptest.NewRecorder(), got); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err := s.collectionRef(ctx, name).Doc(chunkID(session.ID, i)).Get(ctx)
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("Get(chunk %d) after Delete got err %v, want NotFound", i, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// clientKey is the context key of the client a session is saved for.
+type clientKey struct{}
+
+// client is the client a session is saved for, with WithClientMetadata.
+type client struct {
+	// ip is the IP address of the client, if it is recorded.
+	ip        string
+	userAgent string
+}
+
+// clientContext returns ctx, with the client that sent r if
+// WithClientMetadata is used.
+func (s *Store) clientContext(ctx context.Context, r *http.Request) context.Context {
+	if !s.recordClient {
+		return ctx
+	}
+	c := client{userAgent: r.UserAgent()}
+	if s.recordIP {
+		c.ip = remoteIP(r)
+	}
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+// clientFromContext returns the client in ctx, which is empty if there is
+// none.
+func clientFromContext(ctx context.Context) client {
+	c, _ := ctx.Value(clientKey{}).(client)
+	return c
+}
+
+// remoteIP returns the IP address r was sent from, without the port. Proxies
+// in front of the server aren't taken into account.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestClientMetadata(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		desc          string
+		opts          []Option
+		isNew         bool
+		wantIP        string
+		wantUserAgent string
+		wantCreated   bool
+	}{
+		{desc: "disabled", isNew: true},
+		{desc: "no IP", opts: []Option{WithClientMetadata(false)}, isNew: true, wantUserAgent: "test-agent", wantCreated: true},
+		{desc: "IP", opts: []Option{WithClientMetadata(true)}, isNew: true, wantIP: "192.0.2.1", wantUserAgent: "test-agent", wantCreated: true},
+		{desc: "existing session", opts: []Option{WithClientMetadata(true)}, wantIP: "192.0.2.1", wantUserAgent: "test-agent"},
+	}
+	for _, test := range tests {
+		s, err := New(ctx, nil, test.opts...)
+		if err != nil {
+			t.Fatalf("%s: New: %v", test.desc, err)
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("User-Agent", "test-agent")
+		session := sessions.NewSession(s, "checkout")
+		session.IsNew = test.isNew
+
+		encoded, err := s.encode(s.clientContext(ctx, r), session)
+		if err != nil {
+			t.Fatalf("%s: encode: %v", test.desc, err)
+		}
+		if encoded.ClientIP != test.wantIP || encoded.UserAgent != test.wantUserAgent {
+			t.Errorf("%s: encode got client %q, %q, want %q, %q", test.desc, encoded.ClientIP, encoded.UserAgent, test.wantIP, test.wantUserAgent)
+		}
+		created := encoded.CreatedIP == test.wantIP && encoded.CreatedUserAgent == test.wantUserAgent && encoded.CreatedUserAgent != ""
+		if created != test.wantCreated {
+			t.Errorf("%s: encode got creating client %q, %q, want it recorded %v", test.desc, encoded.CreatedIP, encoded.CreatedUserAgent, test.wantCreated)
+		}
+	}
+}
+
+func TestSessionMetaClient(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithClientMetadata(true))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const name = "TestSessionMetaClient"
+	defer s.cleanup(name)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("User-Agent", "first-agent")
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.2:1234"
+	r.Header.Set("User-Agent", "second-agent")
+	r.Header.Set(name, session.ID)
+	session, err = s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// Values can't collide with the client metadata.
+	session.Values["userAgent"] = "value"
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	got, err := s.SessionMeta(ctx, name, session.ID)
+	if err != nil {
+		t.Fatalf("SessionMeta: %v", err)
+	}
+	if got.CreatedIP != "192.0.2.1" || got.CreatedUserAgent != "first-agent" {
+		t.Errorf("SessionMeta got creating client %q, %q, want 192.0.2.1, first-agent", got.CreatedIP, got.CreatedUserAgent)
+	}
+	if got.ClientIP != "192.0.2.2" || got.UserAgent != "second-agent" {
+		t.Errorf("SessionMeta got client %q, %q, want 192.0.2.2, second-agent", got.ClientIP, got.UserAgent)
+	}
+}
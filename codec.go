@@ -0,0 +1,206 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes and decodes session values. See WithCodec.
+type Codec interface {
+	// Encode encodes the values of a session.
+	Encode(values map[interface{}]interface{}) ([]byte, error)
+	// Decode decodes values encoded by Encode into values.
+	Decode(b []byte, values *map[interface{}]interface{}) error
+}
+
+const (
+	// codecJSON is the name of JSONCodec.
+	codecJSON = "json"
+	// codecMsgpack is the name of MsgpackCodec.
+	codecMsgpack = "msgpack"
+	// codecGob is the name of GobCodec.
+	codecGob = "gob"
+)
+
+// JSONCodec is a Codec that uses encoding/json. It is the default Codec.
+//
+// Only string keys are supported. Values are decoded into the types
+// encoding/json uses for interface{} values, so, for example, numbers are
+// decoded as float64s. GobCodec supports non-string keys, but it is slower and
+// leads to larger sessions.
+type JSONCodec struct{}
+
+var _ Codec = JSONCodec{}
+
+// jsonSession is an encoding/json compatible version of sessions.Session.
+type jsonSession struct {
+	Values map[string]interface{}
+	// ID is only set by older versions of this package. The ID of the
+	// Firestore document is used instead.
+	ID string `json:",omitempty"`
+}
+
+// Encode implements Codec.
+func (JSONCodec) Encode(values map[interface{}]interface{}) ([]byte, error) {
+	jValues := map[string]interface{}{}
+	for k, v := range values {
+		ks, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("only string keys supported: %v", k)
+		}
+		jValues[ks] = v
+	}
+	b, err := json.Marshal(jsonSession{Values: jValues})
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	return b, nil
+}
+
+// Decode implements Codec.
+func (JSONCodec) Decode(b []byte, values *map[interface{}]interface{}) error {
+	jSession := jsonSession{}
+	if err := json.Unmarshal(b, &jSession); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	for k, v := range jSession.Values {
+		(*values)[k] = v
+	}
+	return nil
+}
+
+// MsgpackCodec is a Codec that uses MessagePack, which is more compact than
+// JSON and can be read from most languages.
+//
+// Integers are decoded as int64s or uint64s, floats as float64s, and slices,
+// such as []string, as []interface{}.
+type MsgpackCodec struct{}
+
+var _ Codec = MsgpackCodec{}
+
+// Encode implements Codec.
+func (MsgpackCodec) Encode(values map[interface{}]interface{}) ([]byte, error) {
+	b, err := msgpack.Marshal(values)
+	if err != nil {
+		return nil, fmt.Errorf("msgpack.Marshal: %w", err)
+	}
+	return b, nil
+}
+
+// Decode implements Codec.
+func (MsgpackCodec) Decode(b []byte, values *map[interface{}]interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(b))
+	dec.UseLooseInterfaceDecoding(true)
+	m, err := dec.DecodeUntypedMap()
+	if err != nil {
+		return fmt.Errorf("DecodeUntypedMap: %w", err)
+	}
+	for k, v := range m {
+		(*values)[k] = v
+	}
+	return nil
+}
+
+// GobCodec is a Codec that uses encoding/gob, like the stores in
+// gorilla/sessions. Values keep their Go types, and keys don't have to be
+// strings.
+//
+// Every type stored in a session, other than basic types, must be registered
+// with gob.Register or Store.RegisterType before the session is saved or
+// loaded.
+type GobCodec struct{}
+
+var _ Codec = GobCodec{}
+
+// Encode implements Codec.
+func (GobCodec) Encode(values map[interface{}]interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(values); err != nil {
+		return nil, fmt.Errorf("gob.Encode: %w (is the type registered with RegisterType?)", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode implements Codec.
+func (GobCodec) Decode(b []byte, values *map[interface{}]interface{}) error {
+	m := map[interface{}]interface{}{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&m); err != nil {
+		return fmt.Errorf("gob.Decode: %w", err)
+	}
+	for k, v := range m {
+		(*values)[k] = v
+	}
+	return nil
+}
+
+// RegisterType registers the type of value with encoding/gob, so sessions
+// holding values of that type can be saved and loaded with GobCodec. It does
+// nothing unless the Store encodes sessions with GobCodec.
+//
+// Like gob.Register, it panics if a different type was already registered
+// under the same name.
+func (s *Store) RegisterType(value interface{}) {
+	if s.codec != codecGob {
+		return
+	}
+	gob.Register(value)
+}
+
+// Encode encodes session values with the codec of the Store, as Save does
+// before compressing and encrypting them. Values that are only kept in
+// memory, such as the version recorded by WithOptimisticLocking, are left out.
+// Encode fails with WithNativeFields, which doesn't encode values.
+func (s *Store) Encode(values map[interface{}]interface{}) ([]byte, error) {
+	c, ok := s.codecs[s.codec]
+	if !ok {
+		return nil, fmt.Errorf("Encode: codec %q doesn't encode values", s.codec)
+	}
+	b, err := c.Encode(storedValues(values))
+	if err != nil {
+		return nil, fmt.Errorf("Encode: %w", err)
+	}
+	return b, nil
+}
+
+// Decode decodes session values encoded by Encode. Corrupt input results in
+// an error rather than a panic.
+func (s *Store) Decode(b []byte) (map[interface{}]interface{}, error) {
+	return s.decodeValues(s.codec, b)
+}
+
+// decodeValues decodes session values encoded with the named codec. A codec
+// that panics on corrupt input results in an error.
+func (s *Store) decodeValues(codec string, b []byte) (_ map[interface{}]interface{}, err error) {
+	c, ok := s.codecs[codec]
+	if !ok {
+		return nil, fmt.Errorf("unsupported codec %q", codec)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Decode: corrupt session: %v", r)
+		}
+	}()
+	values := map[interface{}]interface{}{}
+	if err := c.Decode(b, &values); err != nil {
+		return nil, fmt.Errorf("Decode: %w", err)
+	}
+	return values, nil
+}
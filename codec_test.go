@@ -0,0 +1,256 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/sessions"
+)
+
+// upperCodec is a Codec for tests that stores a single string value under the
+// "key" key, upper-cased.
+type upperCodec struct{}
+
+func (upperCodec) Encode(values map[interface{}]interface{}) ([]byte, error) {
+	v, ok := values["key"].(string)
+	if !ok {
+		return nil, fmt.Errorf("key is not a string")
+	}
+	return []byte(strings.ToUpper(v)), nil
+}
+
+func (upperCodec) Decode(b []byte, values *map[interface{}]interface{}) error {
+	(*values)["key"] = string(b)
+	return nil
+}
+
+func TestWithCodec(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, nil, WithCodec("upper", upperCodec{}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	session := sessions.NewSession(s, "checkout")
+	session.Values["key"] = "value"
+	doc, err := s.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	if got, want := string(doc.payload()[1:]), "VALUE"; got != want {
+		t.Errorf("serialize got %q, want %q", got, want)
+	}
+	if got, want := doc.Codec, "upper"; got != want {
+		t.Errorf("serialize got codec %q, want %q", got, want)
+	}
+	got, err := s.deserialize(ctx, doc)
+	if err != nil {
+		t.Fatalf("deserialize: %v", err)
+	}
+	if diff := cmp.Diff(map[interface{}]interface{}{"key": "VALUE"}, got); diff != "" {
+		t.Errorf("deserialize got diff (-want, +got):\n%s", diff)
+	}
+
+	// JSON sessions saved before switching codecs still decode.
+	got, err = s.deserialize(ctx, &sessionDoc{EncodedSession: `{"Values":{"key":"value"},"ID":"id"}`})
+	if err != nil {
+		t.Fatalf("deserialize legacy JSON: %v", err)
+	}
+	if diff := cmp.Diff(map[interface{}]interface{}{"key": "value"}, got); diff != "" {
+		t.Errorf("deserialize legacy JSON got diff (-want, +got):\n%s", diff)
+	}
+}
+
+func TestJSONCodecNonStringKey(t *testing.T) {
+	if _, err := (JSONCodec{}).Encode(map[interface{}]interface{}{1: "one"}); err == nil {
+		t.Errorf("Encode with an int key got nil error, want error")
+	}
+}
+
+func TestSessionDocPayload(t *testing.T) {
+	for _, b := range [][]byte{[]byte("text"), {0xff, 0x00, 0xfe}} {
+		d := sessionDoc{}
+		d.setPayload(b)
+		if got := d.payload(); string(got) != string(b) {
+			t.Errorf("payload after setPayload(%q) got %q", b, got)
+		}
+	}
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, nil, WithMsgpackCodec())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	session := sessions.NewSession(s, "checkout")
+	session.Values["string"] = "value"
+	session.Values["int"] = 42
+	session.Values["strings"] = []string{"a", "b"}
+	doc, err := s.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	got, err := s.deserialize(ctx, doc)
+	if err != nil {
+		t.Fatalf("deserialize: %v", err)
+	}
+	want := map[interface{}]interface{}{
+		"string":  "value",
+		"int":     int64(42),
+		"strings": []interface{}{"a", "b"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("deserialize got diff (-want, +got):\n%s", diff)
+	}
+}
+
+// gobBooking is registered by TestGobCodec.
+type gobBooking struct {
+	ID string
+}
+
+// unregisteredBooking is never registered. Gob registrations are global to the
+// process, so no other type would stay unregistered across test runs.
+type unregisteredBooking struct {
+	ID string
+}
+
+func TestGobCodec(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, nil, WithGobCodec())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	session := sessions.NewSession(s, "checkout")
+	session.Values["booking"] = unregisteredBooking{ID: "LH1234567"}
+	if _, err := s.serialize(ctx, session); err == nil {
+		t.Errorf("serialize with an unregistered type got nil error, want error")
+	}
+
+	session.Values["booking"] = gobBooking{ID: "LH1234567"}
+	session.Values[42] = "int key"
+	s.RegisterType(gobBooking{})
+	doc, err := s.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	got, err := s.deserialize(ctx, doc)
+	if err != nil {
+		t.Fatalf("deserialize: %v", err)
+	}
+	if diff := cmp.Diff(session.Values, got); diff != "" {
+		t.Errorf("deserialize got diff (-want, +got):\n%s", diff)
+	}
+}
+
+// encodedBooking is registered by TestEncodeDecode.
+type encodedBooking struct {
+	ID string
+}
+
+// panicCodec panics when decoding, like a codec with a bug.
+type panicCodec struct{ upperCodec }
+
+func (panicCodec) Decode([]byte, *map[interface{}]interface{}) error {
+	panic("index out of range")
+}
+
+func TestEncodeDecode(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, nil, WithGobCodec())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	s.RegisterType(encodedBooking{})
+
+	values := map[interface{}]interface{}{
+		"booking":  encodedBooking{ID: "LH1234567"},
+		42:         "int key",
+		versionKey: int64(3),
+	}
+	b, err := s.Encode(values)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	got, err := s.Decode(b)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if diff := cmp.Diff(storedValues(values), got); diff != "" {
+		t.Errorf("Decode got diff (-want, +got):\n%s", diff)
+	}
+	if _, err := s.Decode(b[:len(b)/2]); err == nil {
+		t.Errorf("Decode of truncated input got nil error, want error")
+	}
+
+	for _, opt := range []Option{WithJSONCodec(), WithMsgpackCodec(), WithCodec("panic", panicCodec{})} {
+		s, err := New(ctx, nil, opt)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if _, err := s.Decode([]byte("\xff\x00corrupt")); err == nil {
+			t.Errorf("Decode of corrupt input with codec %q got nil error, want error", s.codec)
+		}
+	}
+
+	native, err := New(ctx, nil, WithNativeFields())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := native.Encode(values); err == nil {
+		t.Errorf("Encode with WithNativeFields got nil error, want error")
+	}
+}
+
+// BenchmarkCodecSize reports the encoded size of a representative session
+// with each built-in codec.
+func BenchmarkCodecSize(b *testing.B) {
+	values := map[interface{}]interface{}{
+		"userId":     "6f1c2a9e-54b1-4d0e-9a55-3f0c5e7d8b21",
+		"bookingIds": []string{"LH1234567", "LH7654321", "LH1111111"},
+		"visits":     17,
+		"currency":   "GBP",
+		"loggedIn":   true,
+	}
+	codecs := []struct {
+		name  string
+		codec Codec
+	}{
+		{codecJSON, JSONCodec{}},
+		{codecMsgpack, MsgpackCodec{}},
+		{codecGob, GobCodec{}},
+	}
+	for _, c := range codecs {
+		b.Run(c.name, func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				encoded, err := c.codec.Encode(values)
+				if err != nil {
+					b.Fatalf("Encode: %v", err)
+				}
+				size = len(encoded)
+			}
+			b.ReportMetric(float64(size), "bytes/session")
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/sessions"
+)
+
+// CorruptSessionPolicy is what New and Get do with a stored session that can't
+// be decoded. See WithCorruptSessionPolicy.
+type CorruptSessionPolicy int
+
+const (
+	// CorruptSessionError returns the decoding error, which wraps
+	// ErrCorruptSession. It is the default.
+	CorruptSessionError CorruptSessionPolicy = iota
+	// CorruptSessionNew returns a new session instead, which replaces the
+	// corrupt one when saved.
+	CorruptSessionNew
+	// CorruptSessionDelete deletes the corrupt session and returns a new
+	// session instead. Decryption failures count as corruption too, so
+	// sessions encrypted with a key the Store doesn't have are deleted.
+	CorruptSessionDelete
+)
+
+func (p CorruptSessionPolicy) String() string {
+	switch p {
+	case CorruptSessionError:
+		return "error"
+	case CorruptSessionNew:
+		return "new"
+	case CorruptSessionDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("CorruptSessionPolicy(%d)", int(p))
+}
+
+// loadCorrupt handles the session stored in encoded, in the document ref,
+// which failed to decode with err, according to the corrupt session policy.
+func (s *Store) loadCorrupt(ctx context.Context, session *sessions.Session, ref *firestore.DocumentRef, encoded *sessionDoc, err error) (*sessions.Session, error) {
+	err = fmt.Errorf("%w: %w", ErrCorruptSession, err)
+	s.metrics.observeCorrupt(s.corruptPolicy)
+	s.logger.Warn("corrupt session", "document", ref.Path, "policy", s.corruptPolicy.String(), "error", err)
+	s.cache.remove(s.cacheKey(ctx, session.Name(), ref.ID))
+	if s.corruptPolicy == CorruptSessionError {
+		return session, err
+	}
+	if s.corruptPolicy == CorruptSessionDelete {
+		ctx, cancel := s.withTimeout(ctx)
+		defer cancel()
+		// Only log errors, the session is replaced when saved anyway.
+		if _, err := ref.Delete(ctx); err != nil {
+			s.logger.Warn("deleting corrupt session", "document", ref.Path, "error", err)
+		} else if err := s.deleteChunks(ctx, session.Name(), ref.ID, encoded.Chunks); err != nil {
+			s.logger.Warn("deleting corrupt session", "document", ref.Path, "error", err)
+		}
+	}
+	session.IsNew = true
+	return session, nil
+}
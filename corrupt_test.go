@@ -0,0 +1,85 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCorruptSessionPolicy(t *testing.T) {
+	ctx := context.Background()
+	if _, err := New(ctx, nil, WithCorruptSessionPolicy(CorruptSessionPolicy(42))); err == nil {
+		t.Errorf("New(WithCorruptSessionPolicy(42)) got nil error, want error")
+	}
+
+	tests := []struct {
+		policy  CorruptSessionPolicy
+		wantErr bool
+	}{
+		{policy: CorruptSessionError, wantErr: true},
+		{policy: CorruptSessionNew},
+		{policy: CorruptSessionDelete},
+	}
+	for _, test := range tests {
+		t.Run(test.policy.String(), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			reg := prometheus.NewRegistry()
+			s, err := New(ctx, newOfflineClient(t),
+				WithCorruptSessionPolicy(test.policy),
+				WithLogger(slog.New(slog.NewTextHandler(buf, nil))),
+				WithMetricsRegisterer(reg),
+				WithOperationTimeout(10*time.Millisecond))
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			// A truncated JSON session.
+			s.fetch = func(ctx context.Context, name, id string) (*sessionDoc, error) {
+				return &sessionDoc{Name: name, Codec: codecJSON, EncodedSession: `{"Values":{"testk`}, nil
+			}
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("checkout", "id")
+			session, err := s.New(r, "checkout")
+			if gotErr := errors.Is(err, ErrCorruptSession); gotErr != test.wantErr || (err != nil && !gotErr) {
+				t.Errorf("New got err %v, want ErrCorruptSession %v", err, test.wantErr)
+			}
+			if !test.wantErr && !session.IsNew {
+				t.Errorf("New got IsNew=false, want a new session")
+			}
+			if got := testutil.ToFloat64(s.metrics.corrupt.WithLabelValues(test.policy.String())); got != 1 {
+				t.Errorf("corrupt_total got %v, want 1", got)
+			}
+			if want := "policy=" + test.policy.String(); !strings.Contains(buf.String(), want) {
+				t.Errorf("New logged %q, want it to contain %q", buf.String(), want)
+			}
+			// The offline client can't delete the session, which is
+			// only logged.
+			deleting := strings.Contains(buf.String(), "deleting corrupt session")
+			if want := test.policy == CorruptSessionDelete; deleting != want {
+				t.Errorf("New logged %q, want a delete attempt %v", buf.String(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+)
+
+// dataKeyLength is the length of the AES-256 data keys generated for envelope
+// encryption.
+const dataKeyLength = 32
+
+// Encrypter encrypts data keys for envelope encryption, for example with a
+// Cloud KMS key. See WithEnvelopeEncryption.
+type Encrypter interface {
+	Encrypt(ctx context.Context, plaintext []byte) ([]byte, error)
+}
+
+// Decrypter decrypts data keys encrypted by an Encrypter.
+type Decrypter interface {
+	Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// newAEAD returns an AES-GCM cipher for the key, which must be 16, 24, or 32
+// bytes long to select AES-128, AES-192, or AES-256.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("invalid AES key length %d, want 16, 24, or 32 bytes", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("aes.NewCipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cipher.NewGCM: %w", err)
+	}
+	return aead, nil
+}
+
+// encrypt encrypts b with a random nonce, which is prepended to the result.
+func encrypt(aead cipher.AEAD, b []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("rand.Read: %w", err)
+	}
+	return aead.Seal(nonce, nonce, b, nil), nil
+}
+
+// decrypt decrypts b, which was encrypted by encrypt.
+func decrypt(aead cipher.AEAD, b []byte) ([]byte, error) {
+	if len(b) < aead.NonceSize() {
+		return nil, fmt.Errorf("decrypt: ciphertext too short")
+	}
+	nonce, ciphertext := b[:aead.NonceSize()], b[aead.NonceSize():]
+	out, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	return out, nil
+}
+
+// decryptAny decrypts b with the first of the ciphers that can, so sessions
+// encrypted with older keys can still be decrypted.
+func decryptAny(aeads []cipher.AEAD, b []byte) ([]byte, error) {
+	if len(aeads) == 0 {
+		return nil, fmt.Errorf("session is encrypted, but no encryption key is set")
+	}
+	var err error
+	for _, aead := range aeads {
+		var out []byte
+		if out, err = decrypt(aead, b); err == nil {
+			return out, nil
+		}
+	}
+	return nil, err
+}
+
+// envelopeEncrypt encrypts b with a new data key and returns the ciphertext
+// and the data key encrypted by e.
+func envelopeEncrypt(ctx context.Context, e Encrypter, b []byte) (ciphertext, wrappedKey []byte, err error) {
+	key := make([]byte, dataKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, fmt.Errorf("rand.Read: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ciphertext, err = encrypt(aead, b); err != nil {
+		return nil, nil, err
+	}
+	if wrappedKey, err = e.Encrypt(ctx, key); err != nil {
+		return nil, nil, fmt.Errorf("Encrypt data key: %w", err)
+	}
+	return ciphertext, wrappedKey, nil
+}
+
+// envelopeDecrypt decrypts b, which was encrypted by envelopeEncrypt.
+func envelopeDecrypt(ctx context.Context, d Decrypter, wrappedKey, b []byte) ([]byte, error) {
+	key, err := d.Decrypt(ctx, wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("Decrypt data key: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(aead, b)
+}
+
+// encryptedValue reports whether the session value with the given key is
+// stored encrypted, with WithEncryptionKey, WithEnvelopeEncryption, or
+// WithEncryptedKeys.
+func (s *Store) encryptedValue(key string) bool {
+	if s.codec == codecNative {
+		return s.encryptedKeys[key]
+	}
+	return len(s.aeads) > 0 || s.encrypter != nil
+}
+
+// indexed reports whether the session value with the given key may be copied
+// to a plaintext index field: unless WithPlaintextIndexes is used, values that
+// are stored encrypted aren't.
+func (s *Store) indexed(key string) bool {
+	return s.plaintextIndexes || !s.encryptedValue(key)
+}
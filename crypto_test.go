@@ -0,0 +1,215 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/sessions"
+)
+
+func TestEncryptedIndexes(t *testing.T) {
+	ctx := context.Background()
+	key := bytes.Repeat([]byte{0x42}, 32)
+	if _, err := New(ctx, nil, WithEncryptionKey(key), WithMaxSessionsPerUser(2)); err == nil {
+		t.Errorf("New(WithEncryptionKey(), WithMaxSessionsPerUser(2)) got nil error, want error")
+	}
+
+	tests := []struct {
+		desc    string
+		opts    []Option
+		indexed bool
+	}{
+		{desc: "unencrypted", indexed: true},
+		{desc: "encrypted", opts: []Option{WithEncryptionKey(key)}},
+		{desc: "envelope", opts: []Option{WithEnvelopeEncryption(newFakeKMS(t), newFakeKMS(t))}},
+		{desc: "plaintext indexes", opts: []Option{WithEncryptionKey(key), WithPlaintextIndexes()}, indexed: true},
+	}
+	for _, test := range tests {
+		s, err := New(ctx, nil, test.opts...)
+		if err != nil {
+			t.Fatalf("%s: New: %v", test.desc, err)
+		}
+		session := sessions.NewSession(s, "checkout")
+		session.Values[defaultUserIDKey] = "alice@example.com"
+		session.Values[bookingIDsKey] = []string{"LH123"}
+		encoded, err := s.encode(ctx, session)
+		if err != nil {
+			t.Fatalf("%s: encode: %v", test.desc, err)
+		}
+		// The fields written to Firestore.
+		data, _ := setMerge(encoded)
+		for _, field := range []string{userIDField, bookingIDsField} {
+			if written := data[field] != firestore.Delete; written != test.indexed {
+				t.Errorf("%s: setMerge got %s=%v, want written %v", test.desc, field, data[field], test.indexed)
+			}
+		}
+	}
+}
+
+func TestWithEncryptionKey(t *testing.T) {
+	ctx := context.Background()
+
+	for _, n := range []int{0, 8, 31} {
+		if _, err := New(ctx, nil, WithEncryptionKey(make([]byte, n))); err == nil {
+			t.Errorf("New(WithEncryptionKey(%d bytes)) got nil error, want error", n)
+		}
+	}
+
+	key := bytes.Repeat([]byte{0x42}, 32)
+	s, err := New(ctx, nil, WithEncryptionKey(key))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	session := sessions.NewSession(s, "checkout")
+	session.Values["email"] = "someone@example.com"
+	doc, err := s.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	if !doc.Encrypted {
+		t.Errorf("serialize got Encrypted=false, want true")
+	}
+	if bytes.Contains(doc.payload(), []byte("someone@example.com")) {
+		t.Errorf("serialize got a payload containing the plaintext value")
+	}
+	got, err := s.deserialize(ctx, doc)
+	if err != nil {
+		t.Fatalf("deserialize: %v", err)
+	}
+	if diff := cmp.Diff(session.Values, got); diff != "" {
+		t.Errorf("deserialize got diff Values (-want, +got):\n%s", diff)
+	}
+
+	// Flip a bit of the ciphertext.
+	tampered := append([]byte(nil), doc.payload()...)
+	tampered[len(tampered)-1] ^= 1
+	doc = &sessionDoc{Codec: doc.Codec, Encrypted: true}
+	doc.setPayload(tampered)
+	if _, err := s.deserialize(ctx, doc); err == nil {
+		t.Errorf("deserialize of tampered ciphertext got nil error, want error")
+	}
+}
+
+func TestWithEncryptionKeysRotation(t *testing.T) {
+	ctx := context.Background()
+	keyA := bytes.Repeat([]byte{0xaa}, 32)
+	keyB := bytes.Repeat([]byte{0xbb}, 32)
+
+	storeA, err := New(ctx, nil, WithEncryptionKeys(keyA))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session := sessions.NewSession(storeA, "checkout")
+	session.Values["key"] = "value"
+	doc, err := storeA.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+
+	rotated, err := New(ctx, nil, WithEncryptionKeys(keyB, keyA))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	got, err := rotated.deserialize(ctx, doc)
+	if err != nil {
+		t.Fatalf("deserialize with rotated keys: %v", err)
+	}
+	if diff := cmp.Diff(session.Values, got); diff != "" {
+		t.Errorf("deserialize with rotated keys got diff Values (-want, +got):\n%s", diff)
+	}
+
+	// Saving again encrypts with B only.
+	doc, err = rotated.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize with rotated keys: %v", err)
+	}
+	if _, err := storeA.deserialize(ctx, doc); err == nil {
+		t.Errorf("deserialize with key A after rotation got nil error, want error")
+	}
+	storeB, err := New(ctx, nil, WithEncryptionKeys(keyB))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := storeB.deserialize(ctx, doc); err != nil {
+		t.Errorf("deserialize with key B after rotation: %v", err)
+	}
+}
+
+// fakeKMS is an Encrypter and Decrypter for tests that encrypts with a fixed
+// key and counts its calls.
+type fakeKMS struct {
+	aead     cipher.AEAD
+	encrypts int
+	decrypts int
+}
+
+func newFakeKMS(t *testing.T) *fakeKMS {
+	t.Helper()
+	aead, err := newAEAD(bytes.Repeat([]byte{0x4b}, 32))
+	if err != nil {
+		t.Fatalf("newAEAD: %v", err)
+	}
+	return &fakeKMS{aead: aead}
+}
+
+func (k *fakeKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	k.encrypts++
+	return encrypt(k.aead, plaintext)
+}
+
+func (k *fakeKMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	k.decrypts++
+	return decrypt(k.aead, ciphertext)
+}
+
+func TestWithEnvelopeEncryption(t *testing.T) {
+	ctx := context.Background()
+	kms := newFakeKMS(t)
+	s, err := New(ctx, nil, WithEnvelopeEncryption(kms, kms))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	session := sessions.NewSession(s, "checkout")
+	session.Values["email"] = "someone@example.com"
+	doc, err := s.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	if !doc.Encrypted || len(doc.WrappedKey) == 0 {
+		t.Errorf("serialize got Encrypted=%v and a %d byte wrapped key, want an encrypted session with a wrapped key", doc.Encrypted, len(doc.WrappedKey))
+	}
+	if bytes.Contains(doc.payload(), []byte("someone@example.com")) {
+		t.Errorf("serialize got a payload containing the plaintext value")
+	}
+
+	got, err := s.deserialize(ctx, doc)
+	if err != nil {
+		t.Fatalf("deserialize: %v", err)
+	}
+	if diff := cmp.Diff(session.Values, got); diff != "" {
+		t.Errorf("deserialize got diff Values (-want, +got):\n%s", diff)
+	}
+	if kms.encrypts != 1 || kms.decrypts != 1 {
+		t.Errorf("got %d Encrypt and %d Decrypt calls, want 1 each", kms.encrypts, kms.decrypts)
+	}
+}
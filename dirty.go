@@ -0,0 +1,53 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"github.com/gorilla/sessions"
+)
+
+// fingerprint returns a hash of the session values encoded with the codec of
+// the Store, or nil if they can't be encoded or the Store uses
+// WithNativeFields. Values are hashed before compression and encryption, which
+// aren't deterministic.
+func (s *Store) fingerprint(values map[interface{}]interface{}) []byte {
+	if s.codec == codecNative {
+		return nil
+	}
+	b, err := s.Encode(values)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+// setFingerprint records the fingerprint of the values of the session, with
+// WithSkipUnchangedSaves.
+func (s *Store) setFingerprint(session *sessions.Session) {
+	session.Values[fingerprintKey] = s.fingerprint(session.Values)
+}
+
+// unchanged reports whether the values of the session have the fingerprint
+// recorded when it was loaded or last saved. Codecs that don't encode maps
+// deterministically can make unchanged values look changed, which only costs
+// a write.
+func (s *Store) unchanged(session *sessions.Session) bool {
+	recorded, _ := session.Values[fingerprintKey].([]byte)
+	return recorded != nil && bytes.Equal(recorded, s.fingerprint(session.Values))
+}
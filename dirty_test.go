@@ -0,0 +1,61 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSkipUnchangedSaves(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newOfflineClient(t), WithSkipUnchangedSaves())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	s.fetch = func(ctx context.Context, name, id string) (*sessionDoc, error) {
+		return &sessionDoc{Name: name, Codec: codecJSON, EncodedSession: `{"Values":{"testkey":"testvalue"}}`}, nil
+	}
+
+	// Every write with the offline client fails, so a nil error means
+	// nothing was written.
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	r.Header.Set("checkout", "id")
+	session, err := s.New(r, "checkout")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Errorf("Save of an unchanged session got err %v, want no write", err)
+	}
+
+	session.Values["testkey"] = "changed"
+	if err := s.Save(r, httptest.NewRecorder(), session); err == nil {
+		t.Errorf("Save of a changed session got nil error, want a write")
+	}
+
+	r = httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	session, err = s.New(r, "checkout")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Save(r, httptest.NewRecorder(), session); err == nil {
+		t.Errorf("Save of a new session got nil error, want a write")
+	}
+}
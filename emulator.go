@@ -0,0 +1,68 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/firestore"
+)
+
+// emulatorHostEnv is the environment variable with the address of the
+// Firestore emulator, as set by `gcloud beta emulators firestore env-init`.
+const emulatorHostEnv = "FIRESTORE_EMULATOR_HOST"
+
+// NewForEmulator creates a new Store backed by the Firestore emulator at
+// FIRESTORE_EMULATOR_HOST, for tests and local development. It returns
+// ErrNoEmulator if FIRESTORE_EMULATOR_HOST is not set, rather than falling back
+// to production Firestore.
+//
+// The returned close function closes the Firestore client.
+func NewForEmulator(
+	ctx context.Context, projectID string, opts ...Option,
+) (_ *Store, close func() error, err error) {
+	return NewForEmulatorWithDatabase(ctx, projectID, firestore.DefaultDatabaseID, opts...)
+}
+
+// NewForEmulatorWithDatabase is like NewForEmulator, but stores sessions in the
+// named databaseID of the emulator rather than the (default) one.
+func NewForEmulatorWithDatabase(
+	ctx context.Context, projectID, databaseID string, opts ...Option,
+) (_ *Store, close func() error, err error) {
+	if os.Getenv(emulatorHostEnv) == "" {
+		return nil, nil, ErrNoEmulator
+	}
+	// firestore.NewClient connects to FIRESTORE_EMULATOR_HOST without
+	// credentials when it is set, and uses the (default) database.
+	// firestore.NewClientWithDatabase rejects an empty database ID, which
+	// also means the (default) database here.
+	var client *firestore.Client
+	if databaseID == "" || databaseID == firestore.DefaultDatabaseID {
+		client, err = firestore.NewClient(ctx, projectID)
+	} else {
+		client, err = firestore.NewClientWithDatabase(ctx, projectID, databaseID)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating Firestore client: %w", err)
+	}
+	s, err := New(ctx, client, opts...)
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return s, client.Close, nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNewForEmulatorNotSet(t *testing.T) {
+	t.Setenv(emulatorHostEnv, "")
+	if _, _, err := NewForEmulator(context.Background(), "test-project"); !errors.Is(err, ErrNoEmulator) {
+		t.Errorf("NewForEmulator got err %v, want ErrNoEmulator", err)
+	}
+}
+
+func TestNewForEmulator(t *testing.T) {
+	if os.Getenv(emulatorHostEnv) == "" {
+		t.Skip(emulatorHostEnv + " not set")
+	}
+	s, close, err := NewForEmulator(context.Background(), "test-project")
+	if err != nil {
+		t.Fatalf("NewForEmulator: %v", err)
+	}
+	defer close()
+
+	const name = "emulator"
+	defer s.cleanup(name)
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session.Values["key"] = "value"
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	r.Header.Set(name, session.ID)
+	got, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got.Values["key"] != "value" {
+		t.Errorf("New got Values[key]=%v, want value", got.Values["key"])
+	}
+}
+
+func TestNewForEmulatorWithDatabase(t *testing.T) {
+	if os.Getenv(emulatorHostEnv) == "" {
+		t.Skip(emulatorHostEnv + " not set")
+	}
+	ctx := context.Background()
+	s, close, err := NewForEmulatorWithDatabase(ctx, "test-project", "sessions-db")
+	if err != nil {
+		t.Fatalf("NewForEmulatorWithDatabase: %v", err)
+	}
+	defer close()
+
+	const name = "emulatorDatabase"
+	defer s.cleanup(name)
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// The session is in the named database, not the default one.
+	named, err := firestore.NewClientWithDatabase(ctx, "test-project", "sessions-db")
+	if err != nil {
+		t.Fatalf("firestore.NewClientWithDatabase: %v", err)
+	}
+	defer named.Close()
+	if _, err := named.Collection(name).Doc(session.ID).Get(ctx); err != nil {
+		t.Errorf("Get from named database: %v", err)
+	}
+	def, err := firestore.NewClient(ctx, "test-project")
+	if err != nil {
+		t.Fatalf("firestore.NewClient: %v", err)
+	}
+	defer def.Close()
+	if _, err := def.Collection(name).Doc(session.ID).Get(ctx); status.Code(err) != codes.NotFound {
+		t.Errorf("Get from default database got err %v, want NotFound", err)
+	}
+}
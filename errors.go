@@ -0,0 +1,106 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrSessionNotFound is wrapped by errors for sessions that don't exist, or
+// have expired. New and Get don't return it, they return a new session
+// instead.
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrMaxLength is matched by errors.Is for every MaxLengthError.
+var ErrMaxLength = errors.New("max length of session exceeded")
+
+// ErrNoEmulator is returned by NewForEmulator when FIRESTORE_EMULATOR_HOST is
+// not set.
+var ErrNoEmulator = errors.New("FIRESTORE_EMULATOR_HOST not set")
+
+// ErrCorruptSession is wrapped by errors for sessions that exist but can't be
+// decoded, such as truncated sessions or sessions encoded with a codec or key
+// the Store doesn't have. See WithCorruptSessionPolicy.
+var ErrCorruptSession = errors.New("corrupt session")
+
+// ErrNoTenant is wrapped by errors for requests and contexts without a tenant
+// ID, when WithTenantResolver is used.
+var ErrNoTenant = errors.New("no tenant")
+
+// ErrReservedKey is wrapped by errors for sessions with a value of the wrong
+// type under a reserved key, such as bookingIds. See WithReservedKey.
+var ErrReservedKey = errors.New("reserved session value has the wrong type")
+
+// MaxLengthError is returned when saving a session that is longer than the
+// maximum length once encoded.
+type MaxLengthError struct {
+	// Size is the length of the encoded session, in bytes.
+	Size int
+	// Limit is the maximum length, in bytes.
+	Limit int
+}
+
+func (e *MaxLengthError) Error() string {
+	return fmt.Sprintf("%v: %d > %d", ErrMaxLength, e.Size, e.Limit)
+}
+
+// Is reports whether target is ErrMaxLength.
+func (e *MaxLengthError) Is(target error) bool {
+	return target == ErrMaxLength
+}
+
+// ErrMaxValueKeys is matched by errors.Is for every MaxValueKeysError.
+var ErrMaxValueKeys = errors.New("max number of session values exceeded")
+
+// MaxValueKeysError is returned when saving a session with more values than
+// allowed by WithMaxValueKeys.
+type MaxValueKeysError struct {
+	// Keys is the number of keys in the session values.
+	Keys int
+	// Limit is the maximum number of keys.
+	Limit int
+}
+
+func (e *MaxValueKeysError) Error() string {
+	return fmt.Sprintf("%v: %d > %d", ErrMaxValueKeys, e.Keys, e.Limit)
+}
+
+// Is reports whether target is ErrMaxValueKeys.
+func (e *MaxValueKeysError) Is(target error) bool {
+	return target == ErrMaxValueKeys
+}
+
+// ErrConflict is matched by errors.Is for every ConflictError.
+var ErrConflict = errors.New("session was saved concurrently")
+
+// ConflictError is returned when saving a session with WithOptimisticLocking
+// if it was saved by someone else since it was loaded. The session should be
+// loaded again, and the change retried.
+type ConflictError struct {
+	// Loaded is the version of the session when it was loaded.
+	Loaded int64
+	// Stored is the version of the session in Firestore.
+	Stored int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v: loaded version %d, stored version %d", ErrConflict, e.Loaded, e.Stored)
+}
+
+// Is reports whether target is ErrConflict.
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
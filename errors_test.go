@@ -0,0 +1,226 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMaxLengthError(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, nil, WithMaxLength(16))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session := sessions.NewSession(s, "checkout")
+	session.Values["key"] = strings.Repeat("x", 32)
+
+	_, err = s.serialize(ctx, session)
+	if !errors.Is(err, ErrMaxLength) {
+		t.Errorf("serialize got err %v, want ErrMaxLength", err)
+	}
+	var mlErr *MaxLengthError
+	if !errors.As(err, &mlErr) {
+		t.Fatalf("serialize got err %v, want a *MaxLengthError", err)
+	}
+	if mlErr.Limit != 16 || mlErr.Size <= 16 {
+		t.Errorf("serialize got MaxLengthError{Size: %d, Limit: %d}, want Limit 16 and a larger Size", mlErr.Size, mlErr.Limit)
+	}
+	if want := "max length"; !strings.Contains(err.Error(), want) {
+		t.Errorf("serialize got err %q, want to contain %q", err.Error(), want)
+	}
+}
+
+func TestMaxValueKeysError(t *testing.T) {
+	ctx := context.Background()
+	if _, err := New(ctx, nil, WithMaxValueKeys(-1)); err == nil {
+		t.Errorf("New(WithMaxValueKeys(-1)) got nil error, want error")
+	}
+	s, err := New(ctx, newOfflineClient(t), WithMaxValueKeys(2))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	session := sessions.NewSession(s, "checkout")
+	session.Values["a"] = "1"
+	session.Values["b"] = "2"
+	// Values only kept in memory don't count.
+	session.Values[versionKey] = int64(1)
+	if _, err := s.serialize(ctx, session); err != nil {
+		t.Errorf("serialize with 2 keys got err %v, want nil", err)
+	}
+
+	session.Values["c"] = "3"
+	err = s.Save(r, httptest.NewRecorder(), session)
+	if !errors.Is(err, ErrMaxValueKeys) {
+		t.Errorf("Save with 3 keys got err %v, want ErrMaxValueKeys", err)
+	}
+	var mvkErr *MaxValueKeysError
+	if !errors.As(err, &mvkErr) {
+		t.Fatalf("Save got err %v, want a *MaxValueKeysError", err)
+	}
+	if mvkErr.Keys != 3 || mvkErr.Limit != 2 {
+		t.Errorf("Save got MaxValueKeysError{Keys: %d, Limit: %d}, want {3, 2}", mvkErr.Keys, mvkErr.Limit)
+	}
+}
+
+func TestConflictError(t *testing.T) {
+	var err error = &ConflictError{Loaded: 1, Stored: 2}
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("errors.Is(%v, ErrConflict) got false, want true", err)
+	}
+	if want := "loaded version 1, stored version 2"; !strings.Contains(err.Error(), want) {
+		t.Errorf("Error got %q, want to contain %q", err.Error(), want)
+	}
+}
+
+// errSentinel is returned by failingCodec and failingKMS.
+var errSentinel = errors.New("sentinel")
+
+// failingCodec is a Codec that always fails with errSentinel.
+type failingCodec struct{}
+
+func (failingCodec) Encode(map[interface{}]interface{}) ([]byte, error) {
+	return nil, errSentinel
+}
+
+func (failingCodec) Decode([]byte, *map[interface{}]interface{}) error {
+	return errSentinel
+}
+
+// failingKMS is an Encrypter and Decrypter that always fails with errSentinel.
+type failingKMS struct{}
+
+func (failingKMS) Encrypt(context.Context, []byte) ([]byte, error) { return nil, errSentinel }
+func (failingKMS) Decrypt(context.Context, []byte) ([]byte, error) { return nil, errSentinel }
+
+func TestErrorsWrapped(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		desc string
+		opt  Option
+	}{
+		{desc: "codec", opt: WithCodec("failing", failingCodec{})},
+		{desc: "envelope encryption", opt: WithEnvelopeEncryption(failingKMS{}, failingKMS{})},
+	}
+	for _, test := range tests {
+		s, err := New(ctx, nil, test.opt)
+		if err != nil {
+			t.Fatalf("%s: New: %v", test.desc, err)
+		}
+		session := sessions.NewSession(s, "checkout")
+		session.Values["key"] = "value"
+		if _, err := s.serialize(ctx, session); !errors.Is(err, errSentinel) {
+			t.Errorf("%s: serialize got err %v, want it to wrap errSentinel", test.desc, err)
+		}
+	}
+}
+
+func TestFirestoreErrorsWrapped(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	s, err := New(ctx, newOfflineClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// The offline client never reaches Firestore, so calls fail when the
+	// context's deadline passes, with either the context's error or a gRPC
+	// status.
+	deadlineExceeded := func(err error) bool {
+		return errors.Is(err, context.DeadlineExceeded) || status.Code(err) == codes.DeadlineExceeded
+	}
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	r.Header.Set("checkout", "id")
+	if _, err := s.New(r, "checkout"); !deadlineExceeded(err) {
+		t.Errorf("New got err %v, want it to wrap a deadline exceeded error", err)
+	}
+	session := sessions.NewSession(s, "checkout")
+	if err := s.Save(r, httptest.NewRecorder(), session); !deadlineExceeded(err) {
+		t.Errorf("Save got err %v, want it to wrap a deadline exceeded error", err)
+	}
+}
+
+// TestSessionNotFound tests that missing, corrupt, and unreadable sessions are
+// told apart.
+func TestSessionNotFound(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newOfflineClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	tests := []struct {
+		desc      string
+		fetchDoc  *sessionDoc
+		fetchErr  error
+		wantIsNew bool
+		wantErr   error
+	}{
+		{desc: "not found", fetchErr: fmt.Errorf("Get: %w", ErrSessionNotFound), wantIsNew: true},
+		{desc: "corrupt", fetchDoc: &sessionDoc{Name: "checkout", EncodedSession: "{"}, wantErr: ErrCorruptSession},
+		{desc: "other error", fetchErr: fmt.Errorf("Get: %w", errSentinel), wantErr: errSentinel},
+	}
+	for _, test := range tests {
+		s.fetch = func(ctx context.Context, name, id string) (*sessionDoc, error) {
+			return test.fetchDoc, test.fetchErr
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("checkout", "id")
+		session, err := s.New(r, "checkout")
+		if !errors.Is(err, test.wantErr) || (test.wantErr == nil && err != nil) {
+			t.Errorf("%s: New got err %v, want %v", test.desc, err, test.wantErr)
+		}
+		if errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("%s: New got err %v, want it not to wrap ErrSessionNotFound", test.desc, err)
+		}
+		if errors.Is(err, ErrCorruptSession) != (test.wantErr == ErrCorruptSession) {
+			t.Errorf("%s: New got err %v, want it to wrap ErrCorruptSession only for corrupt sessions", test.desc, err)
+		}
+		if session.IsNew != test.wantIsNew {
+			t.Errorf("%s: New got IsNew=%v, want %v", test.desc, session.IsNew, test.wantIsNew)
+		}
+	}
+}
+
+func TestNewFirestoreError(t *testing.T) {
+	ctx := context.Background()
+	// The offline client can't reach Firestore, like during an outage.
+	s, err := New(ctx, newOfflineClient(t), WithOperationTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("checkout", "id")
+	session, err := s.New(r, "checkout")
+	if err == nil || errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("New got err %v, want a Firestore error", err)
+	}
+	if session == nil || session.ID != "" {
+		t.Errorf("New got session %+v, want an empty session alongside the error", session)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/sessions"
+)
+
+// evictUserSessions deletes the oldest sessions of the user the saved session
+// belongs to, so the user has at most maxSessionsPerUser sessions with its
+// name, including the saved one. Sessions are ordered by expiry, sessions
+// without one being the oldest.
+func (s *Store) evictUserSessions(ctx context.Context, session *sessions.Session) error {
+	userID, _ := session.Values[s.userIDKey].(string)
+	if userID == "" {
+		return nil
+	}
+	docs, err := s.query(ctx, session.Name()).
+		Where(userIDField, "==", userID).
+		Select(expireAtField, "chunks").
+		Documents(ctx).
+		GetAll()
+	if err != nil {
+		return fmt.Errorf("GetAll: %w", err)
+	}
+	type userSession struct {
+		ref     *firestore.DocumentRef
+		encoded sessionDoc
+	}
+	var others []userSession
+	for _, doc := range docs {
+		if doc.Ref.ID == session.ID {
+			continue
+		}
+		u := userSession{ref: doc.Ref}
+		if err := doc.DataTo(&u.encoded); err != nil {
+			return fmt.Errorf("DataTo: %w", err)
+		}
+		// Expired sessions no longer count, and are left to garbage
+		// collection.
+		if !s.expired(&u.encoded) {
+			others = append(others, u)
+		}
+	}
+	excess := len(others) + 1 - s.maxSessionsPerUser
+	if excess <= 0 {
+		return nil
+	}
+	sort.Slice(others, func(i, j int) bool {
+		return others[i].encoded.ExpireAt.Before(others[j].encoded.ExpireAt)
+	})
+	coll := s.collectionRef(ctx, session.Name())
+	var refs []*firestore.DocumentRef
+	for _, u := range others[:excess] {
+		refs = append(refs, u.ref)
+		for i := 1; i < u.encoded.Chunks; i++ {
+			refs = append(refs, coll.Doc(chunkID(u.ref.ID, i)))
+		}
+		s.cache.remove(s.cacheKey(ctx, session.Name(), u.ref.ID))
+	}
+	_, err = s.deleteDocs(ctx, refs)
+	return err
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWithMaxSessionsPerUser(t *testing.T) {
+	ctx := context.Background()
+	for _, n := range []int{0, -1} {
+		if _, err := New(ctx, nil, WithMaxSessionsPerUser(n)); err == nil {
+			t.Errorf("New(WithMaxSessionsPerUser(%d)) got nil error, want error", n)
+		}
+	}
+	if _, err := New(ctx, nil, WithMaxSessionsPerUser(2), WithUserIDKey("")); err == nil {
+		t.Errorf("New(WithMaxSessionsPerUser(2), WithUserIDKey(\"\")) got nil error, want error")
+	}
+}
+
+func TestMaxSessionsPerUserEvictsOldest(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithMaxSessionsPerUser(2), WithSessionLifetime(time.Hour))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	const name = "TestMaxSessionsPerUserEvictsOldest"
+	defer s.cleanup(name)
+	save := func(user string) string {
+		t.Helper()
+		// Later sessions expire later.
+		now = now.Add(time.Minute)
+		r := httptest.NewRequest("GET", "/", nil)
+		session, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		session.Values["userId"] = user
+		if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		return session.ID
+	}
+	oldest := save("alice")
+	bob := save("bob")
+	second := save("alice")
+	if got, err := s.ListByUser(ctx, name, "alice"); err != nil || len(got) != 2 {
+		t.Fatalf("ListByUser after 2 sessions got %v, %v, want 2 sessions", got, err)
+	}
+
+	third := save("alice")
+	got, err := s.ListByUser(ctx, name, "alice")
+	if err != nil {
+		t.Fatalf("ListByUser: %v", err)
+	}
+	want := []string{second, third}
+	sort.Strings(got)
+	sort.Strings(want)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ListByUser after the 3rd session got diff (-want, +got):\n%s", diff)
+	}
+	if exists, err := s.Exists(ctx, name, oldest); err != nil || exists {
+		t.Errorf("Exists(oldest session) got %v, %v, want false, nil", exists, err)
+	}
+	if exists, err := s.Exists(ctx, name, bob); err != nil || !exists {
+		t.Errorf("Exists(other user's session) got %v, %v, want true, nil", exists, err)
+	}
+}
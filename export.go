@@ -0,0 +1,157 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"google.golang.org/api/iterator"
+)
+
+// exportedSession is a line of the output of Export. The session stays
+// encoded, so it is only decoded again when loaded by a Store with the same
+// codecs and encryption keys.
+type exportedSession struct {
+	ID         string     `json:"id"`
+	ExpireAt   *time.Time `json:"expireAt,omitempty"`
+	Codec      string     `json:"codec,omitempty"`
+	Format     int        `json:"format,omitempty"`
+	Compressed bool       `json:"compressed,omitempty"`
+	Encrypted  bool       `json:"encrypted,omitempty"`
+	WrappedKey []byte     `json:"wrappedKey,omitempty"`
+	Payload    []byte     `json:"payload"`
+	Checksum   []byte     `json:"checksum,omitempty"`
+	UserID     string     `json:"userId,omitempty"`
+	BookingIDs []string   `json:"bookingIds,omitempty"`
+	Version    int64      `json:"version,omitempty"`
+}
+
+// Export writes every session with the given name to w as JSON lines, one
+// session per line, for backups and migrations. Each line has the session ID,
+// its expiry, and its encoded payload. Use Import to recreate the sessions.
+//
+// Sessions stored with WithNativeFields can't be exported.
+func (s *Store) Export(ctx context.Context, name string, w io.Writer) error {
+	if s.codec == codecNative {
+		return fmt.Errorf("Export doesn't support WithNativeFields")
+	}
+	if err := s.checkTenant(ctx); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	iter := s.query(ctx, name).Documents(ctx)
+	defer iter.Stop()
+	for {
+		ds, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Next: %w", err)
+		}
+		encoded := &sessionDoc{}
+		if err := ds.DataTo(encoded); err != nil {
+			return fmt.Errorf("DataTo: %w", err)
+		}
+		// Chunks after the first are exported with their session.
+		if encoded.ChunkOf != "" {
+			continue
+		}
+		if err := s.loadChunks(ctx, name, ds.Ref.ID, encoded); err != nil {
+			return err
+		}
+		e := exportedSession{
+			ID:         ds.Ref.ID,
+			Codec:      encoded.Codec,
+			Format:     encoded.Format,
+			Compressed: encoded.Compressed,
+			Encrypted:  encoded.Encrypted,
+			WrappedKey: encoded.WrappedKey,
+			Payload:    encoded.payload(),
+			Checksum:   encoded.Checksum,
+			UserID:     encoded.UserID,
+			BookingIDs: encoded.BookingIDs,
+			Version:    encoded.Version,
+		}
+		if !encoded.ExpireAt.IsZero() {
+			e.ExpireAt = &encoded.ExpireAt
+		}
+		if err := enc.Encode(e); err != nil {
+			return fmt.Errorf("Encode: %w", err)
+		}
+	}
+}
+
+// Import recreates the sessions written by Export to r as sessions with the
+// given name. Sessions that already exist are overwritten, so importing the
+// same sessions again is harmless. Sessions that have expired are skipped.
+func (s *Store) Import(ctx context.Context, name string, r io.Reader) error {
+	if err := s.checkTenant(ctx); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(r)
+	for {
+		var e exportedSession
+		err := dec.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Decode: %w", err)
+		}
+		if e.ID == "" {
+			return fmt.Errorf("Import: session without an ID")
+		}
+		encoded := &sessionDoc{
+			Name:       name,
+			Codec:      e.Codec,
+			Format:     e.Format,
+			Checksum:   e.Checksum,
+			Compressed: e.Compressed,
+			Encrypted:  e.Encrypted,
+			WrappedKey: e.WrappedKey,
+			UserID:     e.UserID,
+			BookingIDs: e.BookingIDs,
+			Version:    e.Version,
+		}
+		encoded.setPayload(e.Payload)
+		if e.ExpireAt != nil {
+			encoded.ExpireAt = *e.ExpireAt
+		}
+		if s.expired(encoded) {
+			continue
+		}
+		if err := s.importDoc(ctx, name, e.ID, encoded); err != nil {
+			return err
+		}
+	}
+}
+
+// importDoc saves the imported session with the given name and ID.
+func (s *Store) importDoc(ctx context.Context, name, id string, encoded *sessionDoc) error {
+	s.cache.remove(s.cacheKey(ctx, name, id))
+	if s.chunking {
+		return s.saveChunks(ctx, name, id, splitChunks(encoded, s.maxLength), false)
+	}
+	if _, err := s.collectionRef(ctx, name).Doc(id).Set(ctx, encoded); err != nil {
+		return fmt.Errorf("Set: %w", err)
+	}
+	return nil
+}
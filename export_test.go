@@ -0,0 +1,114 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newTestClient(t), WithSessionLifetime(time.Hour))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	const name = "TestExportImport"
+	defer s.cleanup(name)
+
+	want := map[string]map[interface{}]interface{}{}
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		session, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		session.Values["i"] = fmt.Sprint(i)
+		if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		want[session.ID] = session.Values
+	}
+
+	var buf bytes.Buffer
+	if err := s.Export(ctx, name, &buf); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if got := strings.Count(buf.String(), "\n"); got != len(want) {
+		t.Errorf("Export got %d lines, want %d", got, len(want))
+	}
+	exported := buf.String()
+	s.cleanup(name)
+
+	// Importing twice is the same as importing once.
+	for i := 0; i < 2; i++ {
+		if err := s.Import(ctx, name, strings.NewReader(exported)); err != nil {
+			t.Fatalf("Import: %v", err)
+		}
+	}
+	if n, err := s.Count(ctx, name); err != nil || n != len(want) {
+		t.Errorf("Count after Import got %d, %v, want %d, nil", n, err, len(want))
+	}
+	for id, values := range want {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(name, id)
+		session, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if diff := cmp.Diff(values, session.Values); diff != "" {
+			t.Errorf("New(%q) after Import got diff Values (-want, +got):\n%s", id, diff)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newOfflineClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// Expired sessions are skipped, so nothing is written.
+	expired := `{"id":"a","expireAt":"2000-01-01T00:00:00Z","payload":"e30="}` + "\n"
+	if err := s.Import(ctx, "checkout", strings.NewReader(expired)); err != nil {
+		t.Errorf("Import of expired sessions got err %v, want nil", err)
+	}
+
+	for _, in := range []string{
+		`{"id":`,
+		`{"payload":"e30="}`,
+	} {
+		if err := s.Import(ctx, "checkout", strings.NewReader(in)); err == nil {
+			t.Errorf("Import(%q) got nil error, want error", in)
+		}
+	}
+
+	native, err := New(ctx, newOfflineClient(t), WithNativeFields())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := native.Export(ctx, "checkout", io.Discard); err == nil {
+		t.Errorf("Export with WithNativeFields got nil error, want error")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import "fmt"
+
+// Payload formats, recorded in the format field of session documents.
+const (
+	// formatV0 payloads have no header. How they are encoded is only
+	// recorded in the codec, compressed, and encrypted fields.
+	formatV0 = 0
+	// formatV1 payloads start with a header byte describing how the rest
+	// of the payload is encoded. The header is never compressed or
+	// encrypted.
+	formatV1 = 1
+)
+
+// Header bits of formatV1 payloads. The top two bits are the format version,
+// so a header is never mistaken for one of a later format.
+const (
+	headerCodecMask  = 0x0f
+	headerCompressed = 1 << 4
+	headerEncrypted  = 1 << 5
+	headerVersionV1  = formatV1 << 6
+	headerVersion    = 0xc0
+)
+
+// headerCodecs are the codec IDs of formatV1 headers. Other codecs, such as
+// those added with WithCodec, have ID 0 and are only named in the codec field.
+var headerCodecs = map[string]byte{
+	codecJSON:    1,
+	codecMsgpack: 2,
+	codecGob:     3,
+}
+
+// payloadFormat is how the payload of a session is encoded.
+type payloadFormat struct {
+	codec      string
+	compressed bool
+	encrypted  bool
+}
+
+// header returns the formatV1 header of payloads encoded in format f.
+func (f payloadFormat) header() byte {
+	h := byte(headerVersionV1) | headerCodecs[f.codec]
+	if f.compressed {
+		h |= headerCompressed
+	}
+	if f.encrypted {
+		h |= headerEncrypted
+	}
+	return h
+}
+
+// readFormat returns the format of the payload stored in doc, and the payload
+// without its header.
+func readFormat(doc *sessionDoc) (payloadFormat, []byte, error) {
+	b := doc.payload()
+	f := payloadFormat{codec: doc.Codec, compressed: doc.Compressed, encrypted: doc.Encrypted}
+	switch doc.Format {
+	case formatV0:
+		// Sessions saved before the codec was recorded are JSON.
+		if f.codec == "" {
+			f.codec = codecJSON
+		}
+		return f, b, nil
+	case formatV1:
+		if len(b) == 0 || b[0]&headerVersion != headerVersionV1 {
+			return f, nil, fmt.Errorf("invalid format %d header", doc.Format)
+		}
+		h := b[0]
+		if id := h & headerCodecMask; id != 0 {
+			f.codec = ""
+			for name, codecID := range headerCodecs {
+				if codecID == id {
+					f.codec = name
+				}
+			}
+			if f.codec == "" {
+				return f, nil, fmt.Errorf("unknown codec ID %d", id)
+			}
+		}
+		f.compressed = h&headerCompressed != 0
+		f.encrypted = h&headerEncrypted != 0
+		return f, b[1:], nil
+	}
+	return f, nil, fmt.Errorf("unsupported format %d, the session was saved by a later version", doc.Format)
+}
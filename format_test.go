@@ -0,0 +1,151 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/sessions"
+)
+
+func TestPayloadFormats(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, nil, WithMsgpackCodec(), WithCompressionThreshold(0), WithEncryptionKey(make([]byte, 32)))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	want := map[interface{}]interface{}{"key": "value"}
+	gzipped, err := gzipBytes([]byte(`{"Values":{"key":"value"}}`))
+	if err != nil {
+		t.Fatalf("gzipBytes: %v", err)
+	}
+
+	tests := []struct {
+		desc    string
+		doc     *sessionDoc
+		wantErr bool
+	}{
+		{
+			desc: "v0 without a codec",
+			doc:  &sessionDoc{EncodedSession: `{"Values":{"key":"value"}}`},
+		},
+		{
+			desc: "v0 compressed",
+			doc:  &sessionDoc{Codec: codecJSON, Compressed: true, EncodedBytes: gzipped},
+		},
+		{
+			// The header says JSON and compressed, whatever the fields say.
+			desc: "v1",
+			doc:  &sessionDoc{Codec: "ignored", Format: formatV1, EncodedBytes: append([]byte{headerVersionV1 | 1 | headerCompressed}, gzipped...)},
+		},
+		{
+			desc:    "v1 without a header",
+			doc:     &sessionDoc{Format: formatV1},
+			wantErr: true,
+		},
+		{
+			desc:    "v1 with a header of another version",
+			doc:     &sessionDoc{Format: formatV1, EncodedSession: "\x81{}"},
+			wantErr: true,
+		},
+		{
+			desc:    "v1 with an unknown codec ID",
+			doc:     &sessionDoc{Format: formatV1, EncodedSession: "\x4f{}"},
+			wantErr: true,
+		},
+		{
+			desc:    "later format",
+			doc:     &sessionDoc{Format: 2, EncodedSession: `{"Values":{}}`},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		got, err := s.deserialize(ctx, test.doc)
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("%s: deserialize got err %v, want error %v", test.desc, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("%s: deserialize got diff (-want, +got):\n%s", test.desc, diff)
+		}
+	}
+
+	// New sessions are saved in format v1.
+	session := sessions.NewSession(s, "checkout")
+	session.Values["key"] = "value"
+	doc, err := s.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	if got, want := doc.payload()[0], byte(headerVersionV1|2|headerCompressed|headerEncrypted); doc.Format != formatV1 || got != want {
+		t.Errorf("serialize got format %d with header %#x, want format %d with header %#x", doc.Format, got, formatV1, want)
+	}
+	got, err := s.deserialize(ctx, doc)
+	if err != nil {
+		t.Fatalf("deserialize: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("deserialize got diff (-want, +got):\n%s", diff)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newOfflineClient(t), WithChecksum())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session := sessions.NewSession(s, "checkout")
+	session.Values["key"] = "value"
+	doc, err := s.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	if doc.Checksum == nil {
+		t.Fatalf("serialize got no checksum, want one with WithChecksum")
+	}
+	if _, err := s.deserialize(ctx, doc); err != nil {
+		t.Errorf("deserialize: %v", err)
+	}
+
+	// Flip a byte of the value, which still decodes.
+	corrupt := *doc
+	corrupt.EncodedSession = strings.Replace(doc.EncodedSession, "value", "valuf", 1)
+	if _, err := s.deserialize(ctx, &corrupt); err == nil {
+		t.Errorf("deserialize of a corrupted session got nil error, want a checksum error")
+	}
+	s.fetch = func(ctx context.Context, name, id string) (*sessionDoc, error) {
+		return &corrupt, nil
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("checkout", "id")
+	if _, err := s.New(r, "checkout"); !errors.Is(err, ErrCorruptSession) {
+		t.Errorf("New of a corrupted session got err %v, want ErrCorruptSession", err)
+	}
+
+	// Sessions without a checksum still load.
+	corrupt.Checksum = nil
+	if _, err := s.deserialize(ctx, &corrupt); err != nil {
+		t.Errorf("deserialize of a session without a checksum: %v", err)
+	}
+}
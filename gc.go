@@ -0,0 +1,235 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// gcBatchSize is the number of expired sessions queried and deleted at a
+	// time. It matches the maximum number of writes in a Firestore batch.
+	gcBatchSize = 500
+	// gcMaxBatches is the maximum number of batches deleted by a single
+	// sweep, so a large backlog is worked through over several sweeps.
+	gcMaxBatches = 10
+)
+
+// StartGC starts a goroutine that deletes expired sessions with the given name
+// every interval, until ctx is done, the returned stop function is called, or
+// the Store is closed. stop waits for the goroutine to exit.
+//
+// StartGC is an alternative to a Firestore TTL policy (see EnsureTTLPolicy).
+// When WithCollection is used, the query needs a composite index on the name
+// and expireAt fields.
+func (s *Store) StartGC(ctx context.Context, name string, interval time.Duration) (stop func()) {
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+	if s.closed.Err() != nil {
+		return func() {}
+	}
+	s.gcs.Add(1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	// Closing the Store cancels any sweep in progress.
+	stopClose := context.AfterFunc(s.closed, cancel)
+	done := make(chan struct{})
+	go func() {
+		defer s.gcs.Done()
+		defer close(done)
+		defer stopClose()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// Only log errors, the next sweep tries again.
+				if n, err := s.sweep(ctx, name); err != nil && ctx.Err() == nil {
+					s.logger.Error("sweeping expired sessions", "collection", s.collectionRef(ctx, name).Path, "deleted", n, "error", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// DeleteExpired deletes every expired session with the given name and returns
+// the number deleted. It is the on-demand counterpart to StartGC, deleting in
+// the same batches but not stopping after gcMaxBatches. When WithCollection is
+// used, the query needs a composite index on the name and expireAt fields.
+func (s *Store) DeleteExpired(ctx context.Context, name string) (int, error) {
+	if err := s.checkTenant(ctx); err != nil {
+		return 0, err
+	}
+	return s.deleteExpired(ctx, name, 0)
+}
+
+// sweep deletes up to gcMaxBatches batches of expired sessions with the given
+// name and returns the number deleted.
+func (s *Store) sweep(ctx context.Context, name string) (int, error) {
+	if err := s.checkTenant(ctx); err != nil {
+		return 0, err
+	}
+	return s.deleteExpired(ctx, name, gcMaxBatches)
+}
+
+// deleteExpired deletes up to maxBatches batches of expired sessions with the
+// given name, or all of them if maxBatches is 0, and returns the number
+// deleted.
+func (s *Store) deleteExpired(ctx context.Context, name string, maxBatches int) (int, error) {
+	deleted := 0
+	for i := 0; maxBatches == 0 || i < maxBatches; i++ {
+		docs, err := s.query(ctx, name).
+			Where(expireAtField, "<", s.now()).
+			Limit(gcBatchSize).
+			Documents(ctx).
+			GetAll()
+		if err != nil {
+			return deleted, fmt.Errorf("GetAll: %w", err)
+		}
+		refs := make([]*firestore.DocumentRef, len(docs))
+		for i, doc := range docs {
+			refs[i] = doc.Ref
+		}
+		n, err := s.deleteDocs(ctx, refs)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+		if len(docs) < gcBatchSize {
+			break
+		}
+	}
+	return deleted, nil
+}
+
+// DeleteAll deletes every session with the given name, expired or not, and
+// returns the number of documents deleted, such as to sign out every user or
+// to retire a session name. The sessions are deleted in batches of 500, the
+// deletes in each batch made in parallel with a BulkWriter, so memory use is
+// bounded however many sessions there are. The errors of any deletes that fail
+// are joined.
+func (s *Store) DeleteAll(ctx context.Context, name string) (int, error) {
+	if err := s.checkTenant(ctx); err != nil {
+		return 0, err
+	}
+	return s.cleanupBatches(ctx, name, gcBatchSize)
+}
+
+// Cleanup deletes every session with the given name and returns the number of
+// documents deleted.
+//
+// Deprecated: Use DeleteAll.
+func (s *Store) Cleanup(ctx context.Context, name string) (int, error) {
+	return s.DeleteAll(ctx, name)
+}
+
+// cleanupBatches deletes every session with the given name, reading and
+// deleting batchSize documents at a time, and returns the number deleted.
+func (s *Store) cleanupBatches(ctx context.Context, name string, batchSize int) (int, error) {
+	deleted := 0
+	for {
+		// Deleted documents no longer match, so every batch starts from
+		// the beginning.
+		docs, err := s.query(ctx, name).Select().Limit(batchSize).Documents(ctx).GetAll()
+		if err != nil {
+			return deleted, fmt.Errorf("GetAll: %w", err)
+		}
+		refs := make([]*firestore.DocumentRef, len(docs))
+		for i, doc := range docs {
+			refs[i] = doc.Ref
+			s.cache.remove(s.cacheKey(ctx, name, doc.Ref.ID))
+		}
+		n, err := s.deleteDocs(ctx, refs)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+		if len(docs) < batchSize {
+			return deleted, nil
+		}
+	}
+}
+
+// deleteDocs deletes the documents with a BulkWriter and returns the number
+// deleted. The errors of any deletes that fail are joined. With
+// WithCleanupConcurrency, it uses deleteDocsConcurrently instead.
+func (s *Store) deleteDocs(ctx context.Context, refs []*firestore.DocumentRef) (int, error) {
+	if len(refs) == 0 {
+		return 0, nil
+	}
+	if s.cleanupConcurrency > 0 {
+		return s.deleteDocsConcurrently(ctx, refs)
+	}
+	bw := s.client.BulkWriter(ctx)
+	jobs := make([]*firestore.BulkWriterJob, 0, len(refs))
+	for _, ref := range refs {
+		job, err := bw.Delete(ref)
+		if err != nil {
+			bw.End()
+			return 0, fmt.Errorf("BulkWriter.Delete: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	// End flushes the pending deletes and waits for them to finish.
+	bw.End()
+
+	deleted := 0
+	var errs []error
+	for _, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			errs = append(errs, fmt.Errorf("Delete: %w", err))
+			continue
+		}
+		deleted++
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// deleteDocsConcurrently deletes the documents, cleanupConcurrency at a time,
+// and returns the number deleted. The first delete to fail cancels the rest,
+// and its error is returned.
+func (s *Store) deleteDocsConcurrently(ctx context.Context, refs []*firestore.DocumentRef) (int, error) {
+	var deleted atomic.Int64
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(s.cleanupConcurrency)
+	for _, ref := range refs {
+		if ctx.Err() != nil {
+			break
+		}
+		ref := ref
+		g.Go(func() error {
+			if err := s.deleteRef(ctx, ref); err != nil {
+				return fmt.Errorf("Delete: %w", err)
+			}
+			deleted.Add(1)
+			return nil
+		})
+	}
+	err := g.Wait()
+	return int(deleted.Load()), err
+}
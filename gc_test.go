@@ -0,0 +1,336 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSweep(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	const name = "TestSweep"
+	defer s.cleanup(name)
+	docs := map[string]sessionDoc{
+		"expired1": {Name: name, ExpireAt: now.Add(-time.Hour)},
+		"expired2": {Name: name, ExpireAt: now.Add(-time.Second)},
+		"live":     {Name: name, ExpireAt: now.Add(time.Hour)},
+		"forever":  {Name: name},
+	}
+	for id, doc := range docs {
+		if _, err := s.collectionRef(ctx, name).Doc(id).Set(ctx, doc); err != nil {
+			t.Fatalf("Set(%q): %v", id, err)
+		}
+	}
+
+	deleted, err := s.sweep(ctx, name)
+	if err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("sweep got %d deleted, want 2", deleted)
+	}
+	for id, doc := range docs {
+		_, err := s.collectionRef(ctx, name).Doc(id).Get(ctx)
+		if gone := status.Code(err) == codes.NotFound; gone != s.expired(&doc) {
+			t.Errorf("after sweep, Get(%q) got err %v, want deleted=%v", id, err, s.expired(&doc))
+		}
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithCollection("TestDeleteExpired"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	const name = "checkout"
+	defer s.cleanup(name)
+	docs := map[string]sessionDoc{
+		"expired1": {Name: name, ExpireAt: now.Add(-time.Hour)},
+		"expired2": {Name: name, ExpireAt: now.Add(-time.Second)},
+		"expired3": {Name: name, ExpireAt: now.Add(-time.Minute)},
+		"live":     {Name: name, ExpireAt: now.Add(time.Hour)},
+		"forever":  {Name: name},
+	}
+	for id, doc := range docs {
+		if _, err := s.collectionRef(ctx, name).Doc(id).Set(ctx, doc); err != nil {
+			t.Fatalf("Set(%q): %v", id, err)
+		}
+	}
+
+	deleted, err := s.DeleteExpired(ctx, name)
+	if err != nil {
+		t.Fatalf("DeleteExpired: %v", err)
+	}
+	if deleted != 3 {
+		t.Errorf("DeleteExpired got %d deleted, want 3", deleted)
+	}
+	for id, doc := range docs {
+		_, err := s.collectionRef(ctx, name).Doc(id).Get(ctx)
+		if gone := status.Code(err) == codes.NotFound; gone != s.expired(&doc) {
+			t.Errorf("after DeleteExpired, Get(%q) got err %v, want deleted=%v", id, err, s.expired(&doc))
+		}
+	}
+}
+
+func TestStartGCStop(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := New(ctx, newOfflineClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// Sweeps with the offline client either fail or block until the context
+	// is canceled. Either way, stop must return.
+	stop := s.StartGC(ctx, "TestStartGCStop", time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stop did not return")
+	}
+}
+
+func TestDeleteAll(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newTestClient(t), WithCollection("TestDeleteAll"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const name = "checkout"
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := s.collectionRef(ctx, name).Doc(id).Set(ctx, sessionDoc{Name: name}); err != nil {
+			t.Fatalf("Set(%q): %v", id, err)
+		}
+	}
+	other := s.collectionRef(ctx, "other").Doc("other")
+	if _, err := other.Set(ctx, sessionDoc{Name: "other"}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	defer other.Delete(ctx)
+
+	deleted, err := s.DeleteAll(ctx, name)
+	if err != nil {
+		t.Fatalf("DeleteAll: %v", err)
+	}
+	if deleted != 3 {
+		t.Errorf("DeleteAll got %d deleted, want 3", deleted)
+	}
+	if n, err := s.Count(ctx, name); err != nil || n != 0 {
+		t.Errorf("Count after DeleteAll got %d, %v, want 0, nil", n, err)
+	}
+	if _, err := other.Get(ctx); err != nil {
+		t.Errorf("DeleteAll deleted a session with another name: %v", err)
+	}
+}
+
+// BenchmarkDeleteAll compares DeleteAll with deleting the same documents one at
+// a time.
+func BenchmarkDeleteAll(b *testing.B) {
+	const n = 300
+	ctx := context.Background()
+	s, err := New(ctx, newTestClient(b))
+	if err != nil {
+		b.Fatalf("New: %v", err)
+	}
+	const name = "BenchmarkDeleteAll"
+	create := func(b *testing.B) {
+		b.Helper()
+		bw := s.client.BulkWriter(ctx)
+		for i := 0; i < n; i++ {
+			if _, err := bw.Set(s.collectionRef(ctx, name).NewDoc(), sessionDoc{Name: name}); err != nil {
+				b.Fatalf("BulkWriter.Set: %v", err)
+			}
+		}
+		bw.End()
+	}
+
+	b.Run("BulkWriter", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			create(b)
+			b.StartTimer()
+			if _, err := s.DeleteAll(ctx, name); err != nil {
+				b.Fatalf("DeleteAll: %v", err)
+			}
+		}
+	})
+	b.Run("OneByOne", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			create(b)
+			b.StartTimer()
+			docs, err := s.query(ctx, name).Select().Documents(ctx).GetAll()
+			if err != nil {
+				b.Fatalf("GetAll: %v", err)
+			}
+			for _, doc := range docs {
+				if _, err := doc.Ref.Delete(ctx); err != nil {
+					b.Fatalf("Delete: %v", err)
+				}
+			}
+		}
+	})
+}
+
+func TestCleanupBatches(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newTestClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const name = "TestCleanupBatches"
+	const n, batchSize = 7, 3
+	for i := 0; i < n; i++ {
+		if _, err := s.collectionRef(ctx, name).NewDoc().Set(ctx, sessionDoc{Name: name}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	deleted, err := s.cleanupBatches(ctx, name, batchSize)
+	if err != nil {
+		t.Fatalf("cleanupBatches: %v", err)
+	}
+	if deleted != n {
+		t.Errorf("cleanupBatches got %d deleted, want %d", deleted, n)
+	}
+	if n, err := s.Count(ctx, name); err != nil || n != 0 {
+		t.Errorf("Count after cleanupBatches got %d, %v, want 0, nil", n, err)
+	}
+}
+
+func TestCleanupConcurrency(t *testing.T) {
+	ctx := context.Background()
+	if _, err := New(ctx, nil, WithCleanupConcurrency(0)); err == nil {
+		t.Errorf("New(WithCleanupConcurrency(0)) got nil error, want error")
+	}
+	const n = 3
+	s, err := New(ctx, newOfflineClient(t), WithCleanupConcurrency(n))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	var refs []*firestore.DocumentRef
+	for i := 0; i < 20; i++ {
+		refs = append(refs, s.collectionRef(ctx, "checkout").NewDoc())
+	}
+
+	var inFlight, maxInFlight atomic.Int64
+	s.deleteRef = func(ctx context.Context, ref *firestore.DocumentRef) error {
+		cur := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			max := maxInFlight.Load()
+			if cur <= max || maxInFlight.CompareAndSwap(max, cur) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+	deleted, err := s.deleteDocs(ctx, refs)
+	if err != nil {
+		t.Fatalf("deleteDocs: %v", err)
+	}
+	if deleted != len(refs) {
+		t.Errorf("deleteDocs got %d deleted, want %d", deleted, len(refs))
+	}
+	if got := maxInFlight.Load(); got > n {
+		t.Errorf("deleteDocs had %d deletes in flight, want at most %d", got, n)
+	}
+
+	// The first error cancels the remaining deletes.
+	var calls atomic.Int64
+	s.deleteRef = func(ctx context.Context, ref *firestore.DocumentRef) error {
+		calls.Add(1)
+		return errSentinel
+	}
+	if _, err := s.deleteDocs(ctx, refs); !errors.Is(err, errSentinel) {
+		t.Errorf("deleteDocs got err %v, want errSentinel", err)
+	}
+	if got := calls.Load(); got == int64(len(refs)) {
+		t.Errorf("deleteDocs made all %d deletes after an error, want the rest canceled", got)
+	}
+}
+
+func TestCloseStopsGC(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newOfflineClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// Sweeps with the offline client block until they are canceled.
+	stop := s.StartGC(ctx, "TestCloseStopsGC", time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan error)
+	go func() { closed <- s.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close did not return")
+	}
+	// The goroutine has exited, so stop returns at once.
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("stop after Close did not return, want the GC goroutine to have exited")
+	}
+
+	// GC can't be started again after Close.
+	s.StartGC(ctx, "TestCloseStopsGC", time.Millisecond)()
+	if err := s.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"fmt"
+
+	"github.com/gorilla/sessions"
+)
+
+// runBeforeSave calls the WithBeforeSave hooks with the session, stopping at
+// the first error.
+func (s *Store) runBeforeSave(session *sessions.Session) error {
+	for _, f := range s.beforeSave {
+		if err := f(session); err != nil {
+			return fmt.Errorf("BeforeSave: %w", err)
+		}
+	}
+	return nil
+}
+
+// runAfterSave calls the WithAfterSave hooks with the session.
+func (s *Store) runAfterSave(session *sessions.Session) {
+	for _, f := range s.afterSave {
+		f(session)
+	}
+}
+
+// notifyDelete calls the WithOnDelete callback, if any, for the deleted
+// session with the given name and ID.
+func (s *Store) notifyDelete(name, id string, bookingIDs []string) {
+	if s.onDelete != nil {
+		s.onDelete(name, id, bookingIDs)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/sessions"
+)
+
+func TestSaveHooks(t *testing.T) {
+	var calls []string
+	before := func(session *sessions.Session) error {
+		calls = append(calls, "before")
+		delete(session.Values, "password")
+		session.Values["savedBy"] = "hook"
+		return nil
+	}
+	after := func(session *sessions.Session) {
+		calls = append(calls, "after")
+	}
+	m, err := NewMemoryStore(WithBeforeSave(before), WithAfterSave(after))
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	const name = "checkout"
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := m.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session.Values["password"] = "hunter2"
+	if err := m.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if got, want := len(calls), 2; got != want || calls[0] != "before" || calls[1] != "after" {
+		t.Errorf("Save called hooks %v, want [before after]", calls)
+	}
+
+	r.Header.Set(name, session.ID)
+	got, err := m.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, ok := got.Values["password"]; ok {
+		t.Errorf("New got a password value removed by the BeforeSave hook")
+	}
+	if got.Values["savedBy"] != "hook" {
+		t.Errorf("New got savedBy=%v, want the value added by the BeforeSave hook", got.Values["savedBy"])
+	}
+}
+
+func TestBeforeSaveError(t *testing.T) {
+	ctx := context.Background()
+	if _, err := New(ctx, nil, WithBeforeSave(nil)); err == nil {
+		t.Errorf("New(WithBeforeSave(nil)) got nil error, want error")
+	}
+	if _, err := New(ctx, nil, WithAfterSave(nil)); err == nil {
+		t.Errorf("New(WithAfterSave(nil)) got nil error, want error")
+	}
+
+	afterCalled := false
+	s, err := New(ctx, newOfflineClient(t),
+		WithBeforeSave(func(*sessions.Session) error { return errSentinel }),
+		WithAfterSave(func(*sessions.Session) { afterCalled = true }))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// A write with the offline client would fail with a deadline error
+	// instead.
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	session, err := s.New(r, "checkout")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Save(r, httptest.NewRecorder(), session); !errors.Is(err, errSentinel) {
+		t.Errorf("Save got err %v, want the BeforeSave error", err)
+	}
+	if session.ID != "" {
+		t.Errorf("Save got session ID %q, want the save aborted before an ID is assigned", session.ID)
+	}
+	if afterCalled {
+		t.Errorf("Save called the AfterSave hook after failing")
+	}
+}
+
+// deletion is a call of a WithOnDelete callback.
+type deletion struct {
+	Name, ID   string
+	BookingIDs []string
+}
+
+func TestOnDelete(t *testing.T) {
+	if _, err := New(context.Background(), nil, WithOnDelete(nil)); err == nil {
+		t.Errorf("New(WithOnDelete(nil)) got nil error, want error")
+	}
+	var got []deletion
+	onDelete := func(name, id string, bookingIDs []string) {
+		got = append(got, deletion{name, id, bookingIDs})
+	}
+	m, err := NewMemoryStore(WithSessionLifetime(time.Hour), WithOnDelete(onDelete))
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	now := time.Now()
+	m.s.now = func() time.Time { return now }
+
+	const name = "checkout"
+	save := func(bookingID string) *sessions.Session {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/", nil)
+		session, err := m.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if err := AddBookingID(session, bookingID); err != nil {
+			t.Fatalf("AddBookingID: %v", err)
+		}
+		if err := m.Save(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		return session
+	}
+
+	deleted := save("LH1")
+	for i := 0; i < 2; i++ {
+		if err := m.Delete(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder(), deleted); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+	expired := save("LH2")
+	now = now.Add(time.Hour)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(name, expired.ID)
+	for i := 0; i < 2; i++ {
+		if _, err := m.New(r, name); err != nil {
+			t.Fatalf("New: %v", err)
+		}
+	}
+
+	want := []deletion{
+		{Name: name, ID: deleted.ID, BookingIDs: []string{"LH1"}},
+		{Name: name, ID: expired.ID, BookingIDs: []string{"LH2"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("OnDelete got diff calls (-want, +got):\n%s", diff)
+	}
+}
+
+func TestStoreOnDelete(t *testing.T) {
+	ctx := context.Background()
+	var got []deletion
+	s, err := New(ctx, newTestClient(t), WithOnDelete(func(name, id string, bookingIDs []string) {
+		got = append(got, deletion{name, id, bookingIDs})
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	const name = "TestStoreOnDelete"
+	defer s.cleanup(name)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := AddBookingID(session, "LH1"); err != nil {
+		t.Fatalf("AddBookingID: %v", err)
+	}
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Delete(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+	want := []deletion{{Name: name, ID: session.ID, BookingIDs: []string{"LH1"}}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("OnDelete got diff calls (-want, +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/sessions"
+)
+
+// MemoryStore is an in-memory sessions store that behaves like Store, for
+// tests that can't use Firestore. Sessions are encoded, limited in length, and
+// expire exactly as they would with a Store created with the same Options, but
+// are only kept in memory. A MemoryStore is safe for concurrent use by
+// multiple goroutines.
+type MemoryStore struct {
+	s *Store
+
+	mu       sync.Mutex
+	sessions map[cacheKey]*sessionDoc
+}
+
+var _ SessionStore = (*MemoryStore)(nil)
+
+// NewMemoryStore creates a new MemoryStore. Options that need Firestore, such
+// as WithChunking, WithTransactionalSave, and WithOptimisticLocking, aren't
+// supported.
+func NewMemoryStore(opts ...Option) (*MemoryStore, error) {
+	s, err := New(context.Background(), nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if s.chunking || s.transactional || s.locking {
+		return nil, fmt.Errorf("NewMemoryStore doesn't support WithChunking, WithTransactionalSave, or WithOptimisticLocking")
+	}
+	if s.idGenerator == nil {
+		s.idGenerator = randomIDGenerator(minIDLength)
+	}
+	return &MemoryStore{s: s, sessions: map[cacheKey]*sessionDoc{}}, nil
+}
+
+// Get returns a cached session, if it exists. Otherwise, Get returns a new
+// session. See Store.Get.
+func (m *MemoryStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(m, name)
+}
+
+// New returns the session with the ID in the request header named name, or a
+// new session if it doesn't exist or has expired. See Store.New.
+func (m *MemoryStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := m.s.newSession(m, name)
+	ctx, err := m.s.tenantContext(r.Context(), r)
+	if err != nil {
+		return session, err
+	}
+	id, _ := m.s.readIDFromHeader(r, name)
+	if id == "" {
+		session.IsNew = true
+		return session, nil
+	}
+
+	k := m.s.cacheKey(ctx, name, id)
+	m.mu.Lock()
+	encoded, ok := m.sessions[k]
+	expired := ok && m.s.expired(encoded)
+	if expired {
+		delete(m.sessions, k)
+	}
+	m.mu.Unlock()
+	if !ok {
+		session.IsNew = true
+		return session, nil
+	}
+	if expired {
+		m.s.notifyDelete(name, id, encoded.BookingIDs)
+		session.IsNew = true
+		return session, nil
+	}
+	values, err := m.s.deserialize(ctx, encoded)
+	if err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.Values = values
+	if lifetime := m.s.lifetimeFor(name); m.s.sliding && lifetime > 0 {
+		d := *encoded
+		d.ExpireAt = m.s.now().Add(lifetime)
+		m.mu.Lock()
+		m.sessions[k] = &d
+		m.mu.Unlock()
+	}
+	return session, nil
+}
+
+// Save stores the session in memory, or deletes it if its MaxAge is negative.
+// See Store.Save.
+func (m *MemoryStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options != nil && session.Options.MaxAge < 0 {
+		return m.Delete(r, w, session)
+	}
+	ctx, err := m.s.tenantContext(r.Context(), r)
+	if err != nil {
+		return err
+	}
+	if err := m.s.runBeforeSave(session); err != nil {
+		return err
+	}
+	id := session.ID
+	if id == "" {
+		id, _ = m.s.readIDFromHeader(r, session.Name())
+	}
+	if id == "" {
+		if id, err = m.s.newID(ctx, session.Name()); err != nil {
+			return err
+		}
+	}
+	session.ID = id
+	encoded, err := m.s.encode(ctx, session)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.sessions[m.s.cacheKey(ctx, session.Name(), id)] = encoded
+	m.mu.Unlock()
+	m.s.runAfterSave(session)
+	if len(m.s.idCodecs) > 0 && w != nil {
+		return m.s.writeID(w, session.Name(), id)
+	}
+	return nil
+}
+
+// Delete deletes the session from memory and sets its MaxAge to -1. See
+// Store.Delete.
+func (m *MemoryStore) Delete(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	ctx, err := m.s.tenantContext(r.Context(), r)
+	if err != nil {
+		return err
+	}
+	id := session.ID
+	if id == "" {
+		id, _ = m.s.readIDFromHeader(r, session.Name())
+	}
+	if session.Options == nil {
+		session.Options = &sessions.Options{}
+	}
+	session.Options.MaxAge = -1
+
+	bookingIDs, _ := extractBookingIDs(session.Values)
+	m.mu.Lock()
+	k := m.s.cacheKey(ctx, session.Name(), id)
+	_, ok := m.sessions[k]
+	delete(m.sessions, k)
+	m.mu.Unlock()
+	if ok {
+		m.s.notifyDelete(session.Name(), id, bookingIDs)
+	}
+	return nil
+}
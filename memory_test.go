@@ -0,0 +1,172 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMemoryStore(t *testing.T) {
+	if _, err := NewMemoryStore(WithChunking()); err == nil {
+		t.Errorf("NewMemoryStore(WithChunking()) got nil error, want error")
+	}
+
+	m, err := NewMemoryStore(WithSessionLifetime(time.Hour))
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	now := time.Now()
+	m.s.now = func() time.Time { return now }
+
+	const name = "checkout"
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := m.Get(r, name)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !session.IsNew {
+		t.Errorf("Get got IsNew=false, want true")
+	}
+	session.Values["key"] = "value"
+	if err := m.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if session.ID == "" {
+		t.Fatalf("Save didn't set the session ID")
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(name, session.ID)
+	got, err := m.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got.IsNew {
+		t.Errorf("New got IsNew=true, want false")
+	}
+	if diff := cmp.Diff(session.Values, got.Values); diff != "" {
+		t.Errorf("New got diff Values (-want, +got):\n%s", diff)
+	}
+
+	now = now.Add(time.Hour)
+	if got, err = m.New(r, name); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if !got.IsNew {
+		t.Errorf("New of an expired session got IsNew=false, want true")
+	}
+}
+
+func TestMemoryStoreDelete(t *testing.T) {
+	m, err := NewMemoryStore()
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	const name = "checkout"
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := m.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := m.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	session.Options.MaxAge = -1
+	if err := m.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	r.Header.Set(name, session.ID)
+	got, err := m.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if !got.IsNew {
+		t.Errorf("New of a deleted session got IsNew=false, want true")
+	}
+}
+
+func TestMemoryStoreMaxLength(t *testing.T) {
+	m, err := NewMemoryStore(WithMaxLength(64))
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := m.New(r, "checkout")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session.Values["key"] = strings.Repeat("x", 64)
+	if err := m.Save(r, httptest.NewRecorder(), session); !errors.Is(err, ErrMaxLength) {
+		t.Errorf("Save got err %v, want ErrMaxLength", err)
+	}
+}
+
+func TestMemoryStoreSaveMaxAge(t *testing.T) {
+	m, err := NewMemoryStore()
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	now := time.Now()
+	m.s.now = func() time.Time { return now }
+
+	tests := []struct {
+		desc         string
+		maxAge       int
+		wantExpireAt time.Time
+		wantDeleted  bool
+	}{
+		{desc: "positive", maxAge: 3600, wantExpireAt: now.Add(time.Hour)},
+		{desc: "zero", maxAge: 0, wantExpireAt: time.Time{}},
+		{desc: "negative", maxAge: -1, wantDeleted: true},
+	}
+	for _, test := range tests {
+		const name = "checkout"
+		r := httptest.NewRequest("GET", "/", nil)
+		session, err := m.New(r, name)
+		if err != nil {
+			t.Fatalf("%s: New: %v", test.desc, err)
+		}
+		if err := m.Save(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("%s: Save: %v", test.desc, err)
+		}
+
+		session.Options.MaxAge = test.maxAge
+		w := httptest.NewRecorder()
+		if err := m.Save(r, w, session); err != nil {
+			t.Fatalf("%s: Save: %v", test.desc, err)
+		}
+		// The session ID travels in a header, so no cookie is set.
+		if got := w.Header().Get("Set-Cookie"); got != "" {
+			t.Errorf("%s: Save set cookie %q, want none", test.desc, got)
+		}
+		m.mu.Lock()
+		encoded, ok := m.sessions[m.s.cacheKey(r.Context(), name, session.ID)]
+		m.mu.Unlock()
+		if ok == test.wantDeleted {
+			t.Errorf("%s: Save got session stored %v, want %v", test.desc, ok, !test.wantDeleted)
+			continue
+		}
+		if ok && !encoded.ExpireAt.Equal(test.wantExpireAt) {
+			t.Errorf("%s: Save got expireAt %v, want %v", test.desc, encoded.ExpireAt, test.wantExpireAt)
+		}
+	}
+}
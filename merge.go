@@ -0,0 +1,111 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/sessions"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// saveMerge saves the session, stored in encoded, with WithMergeSave. It only
+// updates the payload fields of the document ref, or saves the whole document
+// if it no longer exists, so the session isn't saved without an expiry.
+func (s *Store) saveMerge(ctx context.Context, session *sessions.Session, ref *firestore.DocumentRef, encoded *sessionDoc) error {
+	// The stored expiry isn't known, so the session can't be cached.
+	s.cache.remove(s.cacheKey(ctx, session.Name(), ref.ID))
+	err := s.retry(ctx, func() error {
+		ctx, cancel := s.withTimeout(ctx)
+		defer cancel()
+		_, err := ref.Update(ctx, payloadUpdates(encoded))
+		if status.Code(err) == codes.NotFound {
+			_, err = ref.Set(ctx, encoded)
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Update: %w", err)
+	}
+	return nil
+}
+
+// payloadUpdates returns the updates that set every field of d except
+// expireAt. Fields that are empty in d are deleted, as Set would, except for
+// the timestamps and client metadata, which are only updated if set.
+func payloadUpdates(d *sessionDoc) []firestore.Update {
+	field := func(path string, v interface{}, empty bool) firestore.Update {
+		if empty {
+			v = firestore.Delete
+		}
+		return firestore.Update{Path: path, Value: v}
+	}
+	updates := []firestore.Update{
+		{Path: "EncodedSession", Value: d.EncodedSession},
+		field("encodedBytes", d.EncodedBytes, len(d.EncodedBytes) == 0),
+		{Path: "name", Value: d.Name},
+		field("codec", d.Codec, d.Codec == ""),
+		field("checksum", d.Checksum, len(d.Checksum) == 0),
+		field("format", d.Format, d.Format == 0),
+		field("compressed", d.Compressed, !d.Compressed),
+		field("encrypted", d.Encrypted, !d.Encrypted),
+		field("wrappedKey", d.WrappedKey, len(d.WrappedKey) == 0),
+		field("chunks", d.Chunks, d.Chunks == 0),
+		field(chunkOfField, d.ChunkOf, d.ChunkOf == ""),
+		field("values", d.Values, len(d.Values) == 0),
+		field("encryptedKeys", d.EncryptedKeys, len(d.EncryptedKeys) == 0),
+		field(userIDField, d.UserID, d.UserID == ""),
+		field(bookingIDsField, d.BookingIDs, len(d.BookingIDs) == 0),
+		field("version", d.Version, d.Version == 0),
+		field("updatedAt", d.UpdatedAt, d.UpdatedAt.IsZero()),
+	}
+	if !d.CreatedAt.IsZero() {
+		updates = append(updates, firestore.Update{Path: "createdAt", Value: d.CreatedAt})
+	}
+	if !d.LastAccessedAt.IsZero() {
+		updates = append(updates, firestore.Update{Path: lastAccessedAtField, Value: d.LastAccessedAt})
+	}
+	for _, u := range []firestore.Update{
+		{Path: "clientIp", Value: d.ClientIP},
+		{Path: "userAgent", Value: d.UserAgent},
+		{Path: "createdIp", Value: d.CreatedIP},
+		{Path: "createdUserAgent", Value: d.CreatedUserAgent},
+	} {
+		if u.Value != "" {
+			updates = append(updates, u)
+		}
+	}
+	return updates
+}
+
+// setMerge returns the data and option to Set d with, overwriting the whole
+// document except for the fields payloadUpdates leaves alone when they aren't
+// set, so saving an existing session keeps when it was created.
+func setMerge(d *sessionDoc) (map[string]interface{}, firestore.SetOption) {
+	updates := append(payloadUpdates(d), firestore.Update{Path: expireAtField, Value: d.ExpireAt})
+	if d.ExpireAt.IsZero() {
+		updates[len(updates)-1].Value = firestore.Delete
+	}
+	data := make(map[string]interface{}, len(updates))
+	paths := make([]firestore.FieldPath, len(updates))
+	for i, u := range updates {
+		data[u.Path] = u.Value
+		paths[i] = firestore.FieldPath{u.Path}
+	}
+	return data, firestore.Merge(paths...)
+}
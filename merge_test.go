@@ -0,0 +1,157 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPayloadUpdates(t *testing.T) {
+	// Every field but expireAt is updated, so new fields can't be missed.
+	var want []string
+	typ := reflect.TypeOf(sessionDoc{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Name
+		if tag := typ.Field(i).Tag.Get("firestore"); tag != "" {
+			name = strings.Split(tag, ",")[0]
+		}
+		if name != expireAtField {
+			want = append(want, name)
+		}
+	}
+	now := time.Now()
+	d := &sessionDoc{
+		Name:             "checkout",
+		Codec:            codecJSON,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+		LastAccessedAt:   now,
+		ClientIP:         "192.0.2.1",
+		UserAgent:        "test",
+		CreatedIP:        "192.0.2.1",
+		CreatedUserAgent: "test",
+	}
+	set := map[string]bool{"EncodedSession": true, "name": true, "codec": true, "updatedAt": true}
+	// Unless they are set, the timestamps and client metadata are left
+	// alone.
+	optional := []string{"createdAt", "lastAccessedAt", "clientIp", "userAgent", "createdIp", "createdUserAgent"}
+	for _, path := range optional {
+		set[path] = true
+	}
+	var got []string
+	for _, u := range payloadUpdates(d) {
+		got = append(got, u.Path)
+		if isDelete := u.Value == firestore.Delete; isDelete == set[u.Path] {
+			t.Errorf("payloadUpdates got %s=%v, want deleted %v", u.Path, u.Value, !set[u.Path])
+		}
+	}
+	sort.Strings(want)
+	sort.Strings(got)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("payloadUpdates got diff paths (-want, +got):\n%s", diff)
+	}
+
+	d = &sessionDoc{Name: "checkout", Codec: codecJSON, UpdatedAt: now}
+	for _, u := range payloadUpdates(d) {
+		for _, path := range optional {
+			if u.Path == path {
+				t.Errorf("payloadUpdates without %s got %v, want it left out", u.Path, u.Value)
+			}
+		}
+	}
+}
+
+func TestSetMerge(t *testing.T) {
+	now := time.Now()
+	data, _ := setMerge(&sessionDoc{Name: "checkout", UpdatedAt: now})
+	if _, ok := data["createdAt"]; ok {
+		t.Errorf("setMerge of an existing session got createdAt, want it left alone")
+	}
+	if got := data[expireAtField]; got != firestore.Delete {
+		t.Errorf("setMerge without an expiry got expireAt=%v, want it deleted", got)
+	}
+	data, _ = setMerge(&sessionDoc{Name: "checkout", ExpireAt: now, CreatedAt: now, UpdatedAt: now})
+	if got := data[expireAtField]; got != now {
+		t.Errorf("setMerge got expireAt=%v, want %v", got, now)
+	}
+	if got := data["createdAt"]; got != now {
+		t.Errorf("setMerge of a new session got createdAt=%v, want %v", got, now)
+	}
+}
+
+func TestMergeSaveKeepsTouch(t *testing.T) {
+	ctx := context.Background()
+	if _, err := New(ctx, nil, WithMergeSave(), WithChunking()); err == nil {
+		t.Errorf("New(WithMergeSave(), WithChunking()) got nil error, want error")
+	}
+	s, err := New(ctx, newTestClient(t), WithMergeSave(), WithSessionLifetime(time.Hour))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	const name = "TestMergeSaveKeepsTouch"
+	defer s.cleanup(name)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// Without merging, every Save would set the expiry to a minute from
+	// now.
+	session.Options.MaxAge = 60
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(name, session.ID)
+	loaded, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// A Touch between loading and saving the session.
+	if err := s.Touch(ctx, name, session.ID); err != nil {
+		t.Fatalf("Touch: %v", err)
+	}
+	loaded.Options.MaxAge = 60
+	loaded.Values["key"] = "value"
+	if err := s.Save(r, httptest.NewRecorder(), loaded); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	encoded, err := s.readDoc(ctx, name, session.ID)
+	if err != nil {
+		t.Fatalf("readDoc: %v", err)
+	}
+	if min := time.Now().Add(30 * time.Minute); encoded.ExpireAt.Before(min) {
+		t.Errorf("Save after Touch got ExpireAt %v, want the Touch expiry, after %v", encoded.ExpireAt, min)
+	}
+	values, err := s.deserialize(ctx, encoded)
+	if err != nil {
+		t.Fatalf("deserialize: %v", err)
+	}
+	if values["key"] != "value" {
+		t.Errorf("Save after Touch got Values %v, want the saved values", values)
+	}
+}
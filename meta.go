@@ -0,0 +1,89 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// lastAccessedAtField is the document field holding when a session was last
+// accessed.
+const lastAccessedAtField = "lastAccessedAt"
+
+// Meta holds the lifecycle timestamps and client metadata of a stored
+// session. See Store.SessionMeta.
+type Meta struct {
+	// CreatedAt is when the session was first saved. It is zero for sessions
+	// saved before creation times were recorded.
+	CreatedAt time.Time
+	// UpdatedAt is when the session was last saved.
+	UpdatedAt time.Time
+	// LastAccessedAt is when the session was last loaded or saved, with
+	// WithAccessTracking. Otherwise, it is zero.
+	LastAccessedAt time.Time
+	// ExpireAt is when the session expires. It is zero for sessions that
+	// never expire.
+	ExpireAt time.Time
+	// ClientIP and UserAgent are the IP address and User-Agent of the
+	// client the session was last saved for, and CreatedIP and
+	// CreatedUserAgent those of the client it was first saved for, with
+	// WithClientMetadata. Otherwise, they are empty.
+	ClientIP         string
+	UserAgent        string
+	CreatedIP        string
+	CreatedUserAgent string
+}
+
+// SessionMeta returns the lifecycle timestamps and client metadata of the
+// session with the given name and ID, without decoding the session. It returns
+// an error wrapping ErrSessionNotFound if the session doesn't exist or has
+// expired.
+func (s *Store) SessionMeta(ctx context.Context, name, id string) (Meta, error) {
+	if err := s.checkTenant(ctx); err != nil {
+		return Meta{}, err
+	}
+	encoded, err := s.fetch(ctx, name, id)
+	if err != nil {
+		return Meta{}, err
+	}
+	return Meta{
+		CreatedAt:      encoded.CreatedAt,
+		UpdatedAt:      encoded.UpdatedAt,
+		LastAccessedAt: encoded.LastAccessedAt,
+		ExpireAt:       encoded.ExpireAt,
+
+		ClientIP:         encoded.ClientIP,
+		UserAgent:        encoded.UserAgent,
+		CreatedIP:        encoded.CreatedIP,
+		CreatedUserAgent: encoded.CreatedUserAgent,
+	}, nil
+}
+
+// recordAccess sets the lastAccessedAt field of the session document ref to
+// now. Only lastAccessedAt is updated, so concurrent changes to the session
+// aren't overwritten.
+func (s *Store) recordAccess(ctx context.Context, ref *firestore.DocumentRef) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	update := firestore.Update{Path: lastAccessedAtField, Value: s.now()}
+	if _, err := ref.Update(ctx, []firestore.Update{update}); err != nil {
+		return fmt.Errorf("Update: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSessionMeta(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithAccessTracking())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// Firestore stores times with microsecond precision.
+	now := time.Now().Truncate(time.Microsecond)
+	s.now = func() time.Time { return now }
+
+	const name = "TestSessionMeta"
+	defer s.cleanup(name)
+	check := func(id string, want Meta) {
+		t.Helper()
+		got, err := s.SessionMeta(ctx, name, id)
+		if err != nil {
+			t.Fatalf("SessionMeta: %v", err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("SessionMeta got diff (-want, +got):\n%s", diff)
+		}
+	}
+
+	created := now
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	check(session.ID, Meta{CreatedAt: created, UpdatedAt: created, LastAccessedAt: created})
+
+	// Loading the session only records the access.
+	now = now.Add(time.Minute)
+	accessed := now
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(name, session.ID)
+	session, err = s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	check(session.ID, Meta{CreatedAt: created, UpdatedAt: created, LastAccessedAt: accessed})
+
+	// Saving it again keeps when it was created.
+	now = now.Add(time.Minute)
+	session.Values["testk"] = "testv"
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	check(session.ID, Meta{CreatedAt: created, UpdatedAt: now, LastAccessedAt: now})
+
+	if _, err := s.SessionMeta(ctx, name, "missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("SessionMeta(missing) got err %v, want ErrSessionNotFound", err)
+	}
+}
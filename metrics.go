@@ -0,0 +1,159 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Operation label values.
+const (
+	opGet  = "get"
+	opSave = "save"
+)
+
+// Reasons an asynchronous save is lost.
+const (
+	asyncSaveDropped = "dropped"
+	asyncSaveFailed  = "failed"
+)
+
+// metrics are the Prometheus metrics of a Store. A nil *metrics records
+// nothing.
+type metrics struct {
+	gets           prometheus.Counter
+	saves          prometheus.Counter
+	errors         *prometheus.CounterVec
+	duration       *prometheus.HistogramVec
+	serializeBytes prometheus.Histogram
+	corrupt        *prometheus.CounterVec
+	asyncErrors    *prometheus.CounterVec
+}
+
+// newMetrics registers the metrics of a Store with reg. Metrics that are
+// already registered, such as by another Store, are shared.
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+	m := &metrics{}
+	var err error
+	if m.gets, err = register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "firestore_sessions_gets_total",
+		Help: "Number of sessions loaded.",
+	})); err != nil {
+		return nil, err
+	}
+	if m.saves, err = register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "firestore_sessions_saves_total",
+		Help: "Number of sessions saved.",
+	})); err != nil {
+		return nil, err
+	}
+	if m.errors, err = register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "firestore_sessions_errors_total",
+		Help: "Number of failed session loads and saves, by operation.",
+	}, []string{"op"})); err != nil {
+		return nil, err
+	}
+	if m.duration, err = register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "firestore_sessions_duration_seconds",
+		Help:    "Latency of session loads and saves, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"op"})); err != nil {
+		return nil, err
+	}
+	if m.serializeBytes, err = register(reg, prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "firestore_sessions_serialize_bytes",
+		Help:    "Length of encoded sessions.",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 9),
+	})); err != nil {
+		return nil, err
+	}
+	if m.corrupt, err = register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "firestore_sessions_corrupt_total",
+		Help: "Number of sessions that couldn't be decoded, by corrupt session policy.",
+	}, []string{"policy"})); err != nil {
+		return nil, err
+	}
+	if m.asyncErrors, err = register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "firestore_sessions_async_save_errors_total",
+		Help: "Number of sessions saved with WithAsyncSave that weren't written, by reason.",
+	}, []string{"reason"})); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// register registers c with reg, or returns the equivalent collector that is
+// already registered.
+func register[C prometheus.Collector](reg prometheus.Registerer, c C) (C, error) {
+	err := reg.Register(c)
+	if err == nil {
+		return c, nil
+	}
+	are := prometheus.AlreadyRegisteredError{}
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(C); ok {
+			return existing, nil
+		}
+	}
+	return c, fmt.Errorf("Register: %w", err)
+}
+
+// observe records an operation that started at start and failed if err is
+// set.
+func (m *metrics) observe(op string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	switch op {
+	case opGet:
+		m.gets.Inc()
+	case opSave:
+		m.saves.Inc()
+	}
+	if err != nil {
+		m.errors.WithLabelValues(op).Inc()
+	}
+	m.duration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+// observeSerialize records the length of an encoded session.
+func (m *metrics) observeSerialize(n int) {
+	if m == nil {
+		return
+	}
+	m.serializeBytes.Observe(float64(n))
+}
+
+// observeCorrupt records a session that couldn't be decoded, handled with the
+// given policy.
+func (m *metrics) observeCorrupt(policy CorruptSessionPolicy) {
+	if m == nil {
+		return
+	}
+	m.corrupt.WithLabelValues(policy.String()).Inc()
+}
+
+// observeAsyncSaveError records a session saved with WithAsyncSave that
+// wasn't written, for the given reason.
+func (m *metrics) observeAsyncSaveError(reason string) {
+	if m == nil {
+		return
+	}
+	m.asyncErrors.WithLabelValues(reason).Inc()
+}
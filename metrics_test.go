@@ -0,0 +1,82 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWithMetricsRegisterer(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+
+	s, err := New(ctx, newOfflineClient(t), WithMetricsRegisterer(reg))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// A second Store shares the registered metrics.
+	other, err := New(ctx, newOfflineClient(t), WithMetricsRegisterer(reg))
+	if err != nil {
+		t.Fatalf("New with the same Registerer: %v", err)
+	}
+	s.fetch = func(ctx context.Context, name, id string) (*sessionDoc, error) {
+		return &sessionDoc{Name: name, EncodedSession: `{"Values":{"testkey":"testvalue"}}`}, nil
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("checkout", "id")
+	session, err := s.New(r, "checkout")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := other.New(httptest.NewRequest("GET", "/", nil), "checkout"); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// The offline client can't save the session.
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := s.Save(r.WithContext(ctx), httptest.NewRecorder(), session); err == nil {
+		t.Fatalf("Save got nil error, want error")
+	}
+
+	m := s.metrics
+	tests := []struct {
+		desc string
+		c    prometheus.Collector
+		want float64
+	}{
+		{desc: "gets", c: m.gets, want: 2},
+		{desc: "saves", c: m.saves, want: 1},
+		{desc: "get errors", c: m.errors.WithLabelValues(opGet), want: 0},
+		{desc: "save errors", c: m.errors.WithLabelValues(opSave), want: 1},
+	}
+	for _, test := range tests {
+		if got := testutil.ToFloat64(test.c); got != test.want {
+			t.Errorf("%s got %v, want %v", test.desc, got, test.want)
+		}
+	}
+	if got, want := testutil.CollectAndCount(reg, "firestore_sessions_serialize_bytes"), 1; got != want {
+		t.Errorf("serialize_bytes got %d series, want %d", got, want)
+	}
+	if got, want := testutil.CollectAndCount(reg, "firestore_sessions_duration_seconds"), 2; got != want {
+		t.Errorf("duration_seconds got %d series, want %d", got, want)
+	}
+}
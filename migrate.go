@@ -0,0 +1,63 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// MigrateSession saves a copy of a session loaded from another store, such as
+// a sessions.CookieStore, in Firestore under a new ID, and returns the ID. The
+// copy has the same name, values, and options as the session, so it expires
+// after the MaxAge of its options, or after the session lifetime of the Store
+// if MaxAge is zero. The session itself is left unchanged.
+//
+// Clients send the returned ID in the header named after the session from
+// then on, and the cookie can be deleted.
+func (s *Store) MigrateSession(r *http.Request, from *sessions.Session) (_ string, err error) {
+	start := time.Now()
+	ctx, span := s.startSpan(r.Context(), "MigrateSession", from.Name())
+	defer func() {
+		endSpan(span, err)
+		s.metrics.observe(opSave, start, err)
+	}()
+
+	if from.Options != nil && from.Options.MaxAge < 0 {
+		return "", fmt.Errorf("MigrateSession: session %q is deleted", from.Name())
+	}
+	session := s.newSession(s, from.Name())
+	for k, v := range from.Values {
+		session.Values[k] = v
+	}
+	if from.Options != nil {
+		opts := *from.Options
+		session.Options = &opts
+	}
+
+	if ctx, err = s.tenantContext(ctx, r); err != nil {
+		return "", err
+	}
+	ctx = s.clientContext(ctx, r)
+	// Always save with a new ID, ignoring the ID in the request, which may be
+	// that of another session, so the copy doesn't collide with one.
+	if err := s.save(ctx, session, ""); err != nil {
+		return "", err
+	}
+	return session.ID, nil
+}
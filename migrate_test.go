@@ -0,0 +1,171 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/sessions"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func ExampleStore_MigrateSession() {
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "my-project")
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := New(ctx, client)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cookies := sessions.NewCookieStore([]byte("cookie-hash-key"))
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("checkout") == "" {
+			// The client still has a cookie session. Move it to Firestore
+			// and delete the cookie.
+			old, err := cookies.Get(r, "checkout")
+			if err == nil && !old.IsNew {
+				id, err := store.MigrateSession(r, old)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				old.Options.MaxAge = -1
+				old.Save(r, w)
+				r.Header.Set("checkout", id)
+				w.Header().Set("checkout", id)
+			}
+		}
+		session, err := store.Get(r, "checkout")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = session // Use the session.
+	})
+}
+
+func TestMigrateSession(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newTestClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	const name = "TestMigrateSession"
+	defer s.cleanup(name)
+
+	// Save a session in a cookie, and decode it from the request.
+	cookies := sessions.NewCookieStore([]byte("cookie-hash-key"))
+	r := httptest.NewRequest("GET", "/", nil)
+	old, err := cookies.New(r, name)
+	if err != nil {
+		t.Fatalf("CookieStore.New: %v", err)
+	}
+	old.Options.MaxAge = 600
+	old.Values["key"] = "value"
+	w := httptest.NewRecorder()
+	if err := old.Save(r, w); err != nil {
+		t.Fatalf("CookieStore.Save: %v", err)
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	old, err = cookies.Get(r, name)
+	if err != nil || old.IsNew {
+		t.Fatalf("CookieStore.Get got IsNew=%v, err %v, want the saved session", old.IsNew, err)
+	}
+
+	id, err := s.MigrateSession(r, old)
+	if err != nil {
+		t.Fatalf("MigrateSession: %v", err)
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(name, id)
+	got, err := s.Get(r, name)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.IsNew {
+		t.Errorf("Get got IsNew=true, want the migrated session")
+	}
+	if diff := cmp.Diff(old.Values, got.Values); diff != "" {
+		t.Errorf("Get got diff Values (-want, +got):\n%s", diff)
+	}
+	encoded, err := s.readDoc(ctx, name, id)
+	if err != nil {
+		t.Fatalf("readDoc: %v", err)
+	}
+	// Firestore stores times with microsecond precision.
+	if want := now.Add(600 * time.Second); encoded.ExpireAt.Sub(want).Abs() > time.Millisecond {
+		t.Errorf("migrated session got ExpireAt %v, want %v", encoded.ExpireAt, want)
+	}
+}
+
+func TestMigrateDeletedSession(t *testing.T) {
+	s, err := New(context.Background(), newOfflineClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	old := sessions.NewSession(sessions.NewCookieStore([]byte("key")), "checkout")
+	old.Options = &sessions.Options{MaxAge: -1}
+	if _, err := s.MigrateSession(r, old); err == nil {
+		t.Errorf("MigrateSession of a deleted session got nil error, want error")
+	}
+}
+
+func TestMigrateSessionIDCollision(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newOfflineClient(t), WithIDGenerator(SequentialIDs("id")))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// The first ID is taken by another session.
+	var created []string
+	s.createRef = func(ctx context.Context, ref *firestore.DocumentRef, encoded *sessionDoc) error {
+		created = append(created, ref.ID)
+		if ref.ID == "id-1" {
+			return status.Error(codes.AlreadyExists, "document already exists")
+		}
+		return nil
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	old := sessions.NewSession(sessions.NewCookieStore([]byte("key")), "checkout")
+	old.Values["key"] = "value"
+	id, err := s.MigrateSession(r, old)
+	if err != nil {
+		t.Fatalf("MigrateSession: %v", err)
+	}
+	if id != "id-2" {
+		t.Errorf("MigrateSession got ID %q, want id-2", id)
+	}
+	if diff := cmp.Diff([]string{"id-1", "id-2"}, created); diff != "" {
+		t.Errorf("MigrateSession created diff documents (-want, +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// codecNative is the codec name recorded for sessions stored as native
+// Firestore fields. See WithNativeFields.
+const codecNative = "native"
+
+// toNativeValues converts session values to a map Firestore can store as a
+// map field.
+func toNativeValues(values map[interface{}]interface{}) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		ks, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("only string keys supported with native fields: %v", k)
+		}
+		m[ks] = v
+	}
+	return m, nil
+}
+
+// fromNativeValues converts a map field loaded from Firestore to session
+// values.
+func fromNativeValues(m map[string]interface{}) map[interface{}]interface{} {
+	values := make(map[interface{}]interface{}, len(m))
+	for k, v := range m {
+		values[k] = v
+	}
+	return values
+}
+
+// encryptNativeValues replaces the values of m with the keys set by
+// WithEncryptedKeys by their JSON encoding, encrypted with the first key of
+// WithEncryptionKeys. It returns the keys it replaced, sorted.
+func (s *Store) encryptNativeValues(m map[string]interface{}) ([]string, error) {
+	var keys []string
+	for k, v := range m {
+		if !s.encryptedKeys[k] {
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("encoding value %q: %w", k, err)
+		}
+		if m[k], err = encrypt(s.aeads[0], b); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// decryptNativeValues replaces the values with the given keys, encrypted by
+// encryptNativeValues, by their decrypted values. They are decoded as
+// encoding/json decodes interface{} values, so, for example, numbers are
+// loaded as float64s.
+func (s *Store) decryptNativeValues(values map[interface{}]interface{}, keys []string) error {
+	for _, k := range keys {
+		b, ok := values[k].([]byte)
+		if !ok {
+			return fmt.Errorf("encrypted value %q is a %T, want []byte", k, values[k])
+		}
+		b, err := decryptAny(s.aeads, b)
+		if err != nil {
+			return fmt.Errorf("value %q: %w", k, err)
+		}
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return fmt.Errorf("decoding value %q: %w", k, err)
+		}
+		values[k] = v
+	}
+	return nil
+}
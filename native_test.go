@@ -0,0 +1,199 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/sessions"
+)
+
+func TestWithNativeFieldsOptions(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := New(ctx, nil, WithNativeFields(), WithCompression()); err == nil {
+		t.Errorf("New(WithNativeFields(), WithCompression()) got nil error, want error")
+	}
+
+	s, err := New(ctx, nil, WithNativeFields())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session := sessions.NewSession(s, "checkout")
+	session.Values[1] = "int key"
+	if _, err := s.serialize(ctx, session); err == nil {
+		t.Errorf("serialize with an int key got nil error, want error")
+	}
+}
+
+func TestWithNativeFields(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithNativeFields())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	const name = "TestWithNativeFields"
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.cleanup(name)
+	session.Values["string"] = "value"
+	session.Values["int"] = 42
+	session.Values["strings"] = []string{"a", "b"}
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// The values can be queried.
+	docs, err := s.query(ctx, name).Where("values.string", "==", "value").Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	if len(docs) != 1 {
+		t.Errorf("query on values.string got %d documents, want 1", len(docs))
+	}
+
+	r.Header.Set(name, session.ID)
+	got, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	want := map[interface{}]interface{}{
+		"string":  "value",
+		"int":     int64(42),
+		"strings": []interface{}{"a", "b"},
+	}
+	if diff := cmp.Diff(want, got.Values); diff != "" {
+		t.Errorf("New got diff Values (-want, +got):\n%s", diff)
+	}
+}
+
+func TestWithEncryptedKeysOptions(t *testing.T) {
+	ctx := context.Background()
+	key := bytes.Repeat([]byte("k"), 32)
+	tests := []struct {
+		desc string
+		opts []Option
+	}{
+		{desc: "no keys", opts: []Option{WithNativeFields(), WithEncryptionKey(key), WithEncryptedKeys()}},
+		{desc: "no native fields", opts: []Option{WithEncryptionKey(key), WithEncryptedKeys("card")}},
+		{desc: "no encryption key", opts: []Option{WithNativeFields(), WithEncryptedKeys("card")}},
+		{desc: "compression", opts: []Option{WithNativeFields(), WithEncryptionKey(key), WithEncryptedKeys("card"), WithCompression()}},
+	}
+	for _, test := range tests {
+		if _, err := New(ctx, nil, test.opts...); err == nil {
+			t.Errorf("New with %s got nil error, want error", test.desc)
+		}
+	}
+}
+
+func TestEncryptedKeysRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	key := bytes.Repeat([]byte("k"), 32)
+	s, err := New(ctx, nil, WithNativeFields(), WithEncryptionKey(key), WithEncryptedKeys("card", "missing"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session := sessions.NewSession(s, "checkout")
+	session.Values["card"] = "4111 1111 1111 1111"
+	session.Values["country"] = "GB"
+
+	encoded, err := s.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	if diff := cmp.Diff([]string{"card"}, encoded.EncryptedKeys); diff != "" {
+		t.Errorf("serialize got diff EncryptedKeys (-want, +got):\n%s", diff)
+	}
+	if got := encoded.Values["country"]; got != "GB" {
+		t.Errorf("serialize got country %v, want it unencrypted", got)
+	}
+	if b, ok := encoded.Values["card"].([]byte); !ok || bytes.Contains(b, []byte("4111")) {
+		t.Errorf("serialize got card %v, want ciphertext", encoded.Values["card"])
+	}
+
+	got, err := s.deserialize(ctx, encoded)
+	if err != nil {
+		t.Fatalf("deserialize: %v", err)
+	}
+	if diff := cmp.Diff(session.Values, got); diff != "" {
+		t.Errorf("deserialize got diff Values (-want, +got):\n%s", diff)
+	}
+
+	other, err := New(ctx, nil, WithNativeFields(), WithEncryptionKey(bytes.Repeat([]byte("o"), 32)), WithEncryptedKeys("card"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := other.deserialize(ctx, encoded); err == nil {
+		t.Errorf("deserialize with another key got nil error, want error")
+	}
+}
+
+func TestWithEncryptedKeys(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithNativeFields(), WithEncryptionKey(bytes.Repeat([]byte("k"), 32)), WithEncryptedKeys("card"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	const name = "TestWithEncryptedKeys"
+	defer s.cleanup(name)
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session.Values["card"] = "4111 1111 1111 1111"
+	session.Values["country"] = "GB"
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// The unencrypted value can be queried, but not the encrypted one.
+	docs, err := s.query(ctx, name).Where("values.country", "==", "GB").Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	if len(docs) != 1 {
+		t.Fatalf("query on values.country got %d documents, want 1", len(docs))
+	}
+	stored, err := docs[0].DataAt("values.card")
+	if err != nil {
+		t.Fatalf("DataAt: %v", err)
+	}
+	if b, ok := stored.([]byte); !ok || bytes.Contains(b, []byte("4111")) {
+		t.Errorf("stored card got %v, want ciphertext", stored)
+	}
+
+	r.Header.Set(name, session.ID)
+	got, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if diff := cmp.Diff(session.Values, got.Values); diff != "" {
+		t.Errorf("New got diff Values (-want, +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,811 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option configures a Store. Options are applied in order by New, so a later
+// Option overrides an earlier one that sets the same field.
+type Option func(*Store) error
+
+// WithCollection stores every session in the named collection, regardless of
+// the session name. The session name is saved in the name field of each
+// document, and a document is only loaded for a session with a matching name.
+//
+// By default, every session name gets its own collection.
+func WithCollection(collection string) Option {
+	return func(s *Store) error {
+		s.collection = collection
+		return nil
+	}
+}
+
+// WithCollectionPrefix prepends prefix to the name of every collection the
+// Store uses, so several environments can share a Firestore project. For
+// example, with the prefix "staging_", sessions named "checkout" are stored in
+// the "staging_checkout" collection.
+func WithCollectionPrefix(prefix string) Option {
+	return func(s *Store) error {
+		s.collectionPrefix = prefix
+		return nil
+	}
+}
+
+// WithIDGenerator uses gen to generate the IDs of new sessions, which are also
+// the IDs of their Firestore documents. IDs must be valid Firestore document
+// IDs. By default, IDs are generated by Firestore. Tests can use
+// SequentialIDs for predictable IDs.
+func WithIDGenerator(gen func() (string, error)) Option {
+	return func(s *Store) error {
+		s.idGenerator = gen
+		return nil
+	}
+}
+
+// WithIDLength generates the IDs of new sessions from n random bytes, encoded
+// with unpadded base64url. n must be at least 16. WithIDLength replaces any
+// generator set by WithIDGenerator.
+func WithIDLength(n int) Option {
+	return func(s *Store) error {
+		if n < minIDLength {
+			return fmt.Errorf("WithIDLength: %d bytes is less than the minimum of %d", n, minIDLength)
+		}
+		s.idGenerator = randomIDGenerator(n)
+		return nil
+	}
+}
+
+// WithOptions sets the default Options of every session returned by the Store.
+// Each session gets its own copy, so changing the Options of one session
+// doesn't affect the defaults or any other session.
+func WithOptions(opts *sessions.Options) Option {
+	return func(s *Store) error {
+		if opts == nil {
+			s.options = nil
+			return nil
+		}
+		o := *opts
+		s.options = &o
+		return nil
+	}
+}
+
+// WithSessionLifetime makes sessions expire d after they are saved, unless
+// their MaxAge is set. New sessions get a MaxAge of d. The default of zero
+// means sessions never expire.
+func WithSessionLifetime(d time.Duration) Option {
+	return func(s *Store) error {
+		if d < 0 {
+			return fmt.Errorf("WithSessionLifetime: negative lifetime %v", d)
+		}
+		s.lifetime = d
+		return nil
+	}
+}
+
+// WithTTLByName sets the lifetime of the sessions with the names in lifetimes,
+// such as a short one for checkout sessions and a long one for preferences,
+// overriding WithSessionLifetime for them. Sessions with other names use the
+// session lifetime. As with WithSessionLifetime, a lifetime of zero means the
+// sessions never expire, and their MaxAge overrides it.
+func WithTTLByName(lifetimes map[string]time.Duration) Option {
+	return func(s *Store) error {
+		m := make(map[string]time.Duration, len(lifetimes))
+		for name, d := range lifetimes {
+			if d < 0 {
+				return fmt.Errorf("WithTTLByName: negative lifetime %v for %q", d, name)
+			}
+			m[name] = d
+		}
+		s.lifetimes = m
+		return nil
+	}
+}
+
+// WithSlidingExpiration makes sessions expire after they haven't been used for
+// the session lifetime, rather than after they were last saved: every time a
+// session is loaded, its expiry is moved to the lifetime from now. It requires
+// WithSessionLifetime or WithTTLByName. Sessions without a lifetime still never
+// expire.
+func WithSlidingExpiration() Option {
+	return func(s *Store) error {
+		s.sliding = true
+		return nil
+	}
+}
+
+// WithClock makes the Store use now to get the current time when computing
+// and checking session expiry, including in StartGC. It is intended for
+// tests. The default is time.Now. See NewWithClock.
+func WithClock(now func() time.Time) Option {
+	return func(s *Store) error {
+		if now == nil {
+			return fmt.Errorf("WithClock: nil clock")
+		}
+		s.now = now
+		return nil
+	}
+}
+
+// WithJSONCodec encodes sessions with JSONCodec, so they can be read in the
+// Firestore console. This is the default.
+func WithJSONCodec() Option {
+	return func(s *Store) error {
+		s.codec = codecJSON
+		return nil
+	}
+}
+
+// WithMsgpackCodec encodes sessions with MsgpackCodec.
+func WithMsgpackCodec() Option {
+	return func(s *Store) error {
+		s.codec = codecMsgpack
+		return nil
+	}
+}
+
+// WithGobCodec encodes sessions with GobCodec. Types stored in sessions must
+// be registered with Store.RegisterType.
+func WithGobCodec() Option {
+	return func(s *Store) error {
+		s.codec = codecGob
+		return nil
+	}
+}
+
+// WithCodec encodes sessions with c. The name is recorded with each session,
+// and must be unique. Sessions saved with an earlier codec can still be loaded
+// as long as that codec is built in, like JSONCodec, or is also passed to an
+// earlier WithCodec, since the last WithCodec is used for encoding.
+func WithCodec(name string, c Codec) Option {
+	return func(s *Store) error {
+		if name == "" || c == nil {
+			return fmt.Errorf("WithCodec: name and codec are required")
+		}
+		s.codecs[name] = c
+		s.codec = name
+		return nil
+	}
+}
+
+// WithCompression gzips encoded sessions. The maximum session length applies
+// to the compressed session, so larger sessions can be stored. Whether a
+// session is compressed is recorded with it, so uncompressed sessions can
+// still be loaded.
+func WithCompression() Option {
+	return func(s *Store) error {
+		s.compress = true
+		return nil
+	}
+}
+
+// WithCompressionThreshold is like WithCompression, but only gzips encoded
+// sessions longer than n bytes, since compression can make small sessions
+// larger.
+func WithCompressionThreshold(n int) Option {
+	return func(s *Store) error {
+		if n < 0 {
+			return fmt.Errorf("WithCompressionThreshold: negative threshold %d", n)
+		}
+		s.compress = true
+		s.compressThreshold = n
+		return nil
+	}
+}
+
+// WithEncryptionKey encrypts encoded sessions with AES-GCM, using the key to
+// select AES-128, AES-192, or AES-256, so it must be 16, 24, or 32 bytes long.
+// Whether a session is encrypted is recorded with it, so unencrypted sessions
+// can still be loaded.
+//
+// The user ID and booking ID index fields aren't written for encrypted
+// sessions, since they would store those IDs in plaintext. See
+// WithPlaintextIndexes.
+func WithEncryptionKey(key []byte) Option {
+	return WithEncryptionKeys(key)
+}
+
+// WithEncryptionKeys is like WithEncryptionKey, but supports key rotation.
+// Sessions are encrypted with the first key, and decrypted with whichever key
+// works, so sessions encrypted with an older key can still be loaded. Saving
+// such a session encrypts it with the first key.
+//
+// To rotate keys, put the new key first and keep the old keys until every
+// session encrypted with them has been saved again or has expired.
+func WithEncryptionKeys(keys ...[]byte) Option {
+	return func(s *Store) error {
+		if len(keys) == 0 {
+			return fmt.Errorf("WithEncryptionKeys: no keys")
+		}
+		aeads := make([]cipher.AEAD, 0, len(keys))
+		for i, key := range keys {
+			aead, err := newAEAD(key)
+			if err != nil {
+				return fmt.Errorf("WithEncryptionKeys: key %d: %w", i, err)
+			}
+			aeads = append(aeads, aead)
+		}
+		s.aeads = aeads
+		return nil
+	}
+}
+
+// WithEnvelopeEncryption encrypts encoded sessions with envelope encryption:
+// each session is encrypted with AES-GCM using a new data key, and the data
+// key is encrypted by e and stored with the session. Loading a session
+// decrypts its data key with d. e and d are usually backed by the same Cloud
+// KMS key, so raw keys never need to be held in memory, but every Save and
+// load makes a call to them.
+//
+// Sessions encrypted with WithEncryptionKey can still be loaded if it is also
+// used, but new sessions use envelope encryption. As with WithEncryptionKey,
+// the user ID and booking ID index fields aren't written. See
+// WithPlaintextIndexes.
+func WithEnvelopeEncryption(e Encrypter, d Decrypter) Option {
+	return func(s *Store) error {
+		if e == nil || d == nil {
+			return fmt.Errorf("WithEnvelopeEncryption: Encrypter and Decrypter are required")
+		}
+		s.encrypter = e
+		s.decrypter = d
+		return nil
+	}
+}
+
+// WithMaxLength sets the maximum length, in bytes, of an encoded session,
+// after any compression and encryption. Saving a longer session fails. The
+// default is close to the Firestore limit on the size of a document.
+func WithMaxLength(n int) Option {
+	return func(s *Store) error {
+		if n <= 0 {
+			return fmt.Errorf("WithMaxLength: %d is not positive", n)
+		}
+		s.maxLength = n
+		return nil
+	}
+}
+
+// WithMaxValueKeys sets the maximum number of keys in the values of a session.
+// Saving a session with more fails with a MaxValueKeysError, before it is
+// encoded. Zero, the default, means there is no limit.
+func WithMaxValueKeys(n int) Option {
+	return func(s *Store) error {
+		if n < 0 {
+			return fmt.Errorf("WithMaxValueKeys: %d is negative", n)
+		}
+		s.maxValueKeys = n
+		return nil
+	}
+}
+
+// WithChunking splits encoded sessions longer than the maximum length across
+// several documents, instead of failing to save them. The chunks of a session
+// with ID id are stored in the same collection, with IDs id_1, id_2, and so
+// on, and are deleted along with the session.
+//
+// Each chunk is at most the maximum length, so use WithMaxLength to keep it
+// under the Firestore document size limit. Chunked sessions are written in a
+// transaction, which limits the total size of a session.
+func WithChunking() Option {
+	return func(s *Store) error {
+		s.chunking = true
+		return nil
+	}
+}
+
+// WithNativeFields stores session values as a Firestore map in the values
+// field of each document, rather than encoding them, so they can be used in
+// queries and security rules. It can't be used with compression, encryption
+// of the whole session, or chunking. See WithEncryptedKeys to encrypt some of
+// the values.
+//
+// Only string keys are supported, and values must be types Firestore can
+// store, such as strings, numbers, booleans, time.Time, []byte, slices, and
+// maps with string keys. Values are loaded as the types Firestore uses, so,
+// for example, ints are loaded as int64s and []strings as []interface{}s.
+// Saving a session with any other value fails.
+func WithNativeFields() Option {
+	return func(s *Store) error {
+		s.codec = codecNative
+		return nil
+	}
+}
+
+// WithEncryptedKeys encrypts the session values with the given keys, each on
+// its own, with the key of WithEncryptionKey, while the other values are
+// stored as native Firestore fields that can be queried. It requires
+// WithNativeFields and WithEncryptionKey or WithEncryptionKeys, whose key
+// rotation applies to the encrypted values.
+//
+// Encrypted values are stored as bytes in the values field, and are encoded
+// with encoding/json, so they are loaded as the types encoding/json uses: for
+// example, numbers are loaded as float64s.
+func WithEncryptedKeys(keys ...string) Option {
+	return func(s *Store) error {
+		if len(keys) == 0 {
+			return fmt.Errorf("WithEncryptedKeys: no keys")
+		}
+		s.encryptedKeys = make(map[string]bool, len(keys))
+		for _, k := range keys {
+			s.encryptedKeys[k] = true
+		}
+		return nil
+	}
+}
+
+// WithTokenExtractor makes New, Get, Save, and Delete read the session ID sent
+// with a request with extract, such as from an Authorization header or a query
+// parameter, rather than from the header named after the session. If extract
+// reports false, or returns an empty ID, the header named after the session is
+// read as usual. With WithSecureCookie, the token is decoded like the header.
+//
+// The same ID is used for every session name, so use a separate Store for each
+// name that is sent this way.
+func WithTokenExtractor(extract func(*http.Request) (string, bool)) Option {
+	return func(s *Store) error {
+		if extract == nil {
+			return fmt.Errorf("WithTokenExtractor: nil extractor")
+		}
+		s.extractToken = extract
+		return nil
+	}
+}
+
+// WithCacheTTL caches loaded and saved sessions in memory for d, so loading
+// them again within d doesn't read Firestore. Cached sessions can be stale if
+// they are changed by another Store, such as one in another instance, so d
+// bounds how stale they can be. A d of zero, the default, means sessions
+// aren't cached.
+//
+// The cache is unbounded unless WithCacheSize is used.
+func WithCacheTTL(d time.Duration) Option {
+	return func(s *Store) error {
+		if d < 0 {
+			return fmt.Errorf("WithCacheTTL: negative TTL %v", d)
+		}
+		s.cacheTTL = d
+		return nil
+	}
+}
+
+// WithCacheSize caches at most n sessions, evicting the least recently used
+// session when the cache is full. Only sessions that have been loaded or
+// saved are cached, so evicting one never loses changes. It requires
+// WithCacheTTL.
+func WithCacheSize(n int) Option {
+	return func(s *Store) error {
+		if n <= 0 {
+			return fmt.Errorf("WithCacheSize: size must be positive, got %d", n)
+		}
+		s.cacheSize = n
+		return nil
+	}
+}
+
+// WithAccessTracking records when each session was last loaded or saved in the
+// lastAccessedAt field of its document, returned by Store.SessionMeta. Loading
+// a session then updates its document, unless WithSlidingExpiration already
+// does.
+func WithAccessTracking() Option {
+	return func(s *Store) error {
+		s.trackAccess = true
+		return nil
+	}
+}
+
+// WithClientMetadata records the User-Agent of the client each session is
+// saved for, and its IP address if recordIP is set, in fields of the session's
+// document separate from the session values. Both the client the session was
+// first saved for and the one it was last saved for are kept, and returned by
+// Store.SessionMeta. The IP address is the address the request came from,
+// which is that of a proxy if the server is behind one.
+//
+// Sessions saved without a request, such as with SaveByID, keep the recorded
+// clients.
+func WithClientMetadata(recordIP bool) Option {
+	return func(s *Store) error {
+		s.recordClient = true
+		s.recordIP = recordIP
+		return nil
+	}
+}
+
+// WithCacheMode sets how Save updates the cache and Firestore. It requires
+// WithCacheTTL. The default, WriteThrough, saves each session to Firestore
+// before Save returns. WriteBack only caches the session, and saves it to
+// Firestore in the background about once a second, batched with other
+// sessions. Only the latest save of a session is written, so saves of the
+// same session reach Firestore in order. Close and Flush write the pending
+// saves. The first save of a new session is still written before Save
+// returns, so a session ID that is already taken is replaced, as are saves
+// after Close.
+//
+// With WriteBack, saves are lost if the process exits without calling Close,
+// other Stores and processes don't see a session until it is flushed, and Save
+// doesn't report Firestore errors, which are logged instead. Sessions deleted
+// other than with Delete, such as by DeleteAll, can be saved again by a
+// pending save, so Flush before deleting them. WriteBack can't be used with
+// WithTransactionalSave, WithOptimisticLocking, WithChunking, or
+// WithMergeSave.
+func WithCacheMode(mode CacheMode) Option {
+	return func(s *Store) error {
+		if mode != WriteThrough && mode != WriteBack {
+			return fmt.Errorf("WithCacheMode: unknown mode %v", mode)
+		}
+		s.cacheMode = mode
+		return nil
+	}
+}
+
+// WithAsyncSave makes Save cache the session and return without waiting for it
+// to be written to Firestore, which is done in the background. It requires
+// WithCacheTTL. Unlike WithCacheMode(WriteBack), every save is written, as
+// soon as possible, and the saves of a session are written in order. Delete
+// waits for the pending saves of the session first. Close waits for every
+// pending save to be written. As with WithCacheMode(WriteBack), the first save
+// of a new session, and saves after Close, are written before Save returns.
+//
+// Save doesn't report Firestore errors, which are logged and counted in the
+// firestore_sessions_async_save_errors_total metric instead, as are saves
+// dropped because too many are waiting to be written. Other Stores and
+// processes don't see a session until it is written. WithAsyncSave can't be
+// used with WithCacheMode(WriteBack), WithTransactionalSave,
+// WithOptimisticLocking, WithChunking, or WithMergeSave.
+func WithAsyncSave() Option {
+	return func(s *Store) error {
+		s.asyncSave = true
+		return nil
+	}
+}
+
+// WithUserIDKey saves the session value with the given key, if it is a string,
+// in the userId field of each session's document, so the sessions of a user can
+// be found with Store.ListByUser and revoked with Store.DeleteByUser. The
+// default key is "userId". An empty key means user IDs aren't saved.
+//
+// The userId field is plaintext, so when sessions are encrypted it isn't
+// written, and user IDs can't be queried, unless WithPlaintextIndexes is
+// used. The same goes for the bookingIds field.
+func WithUserIDKey(key string) Option {
+	return func(s *Store) error {
+		s.userIDKey = key
+		return nil
+	}
+}
+
+// WithPlaintextIndexes writes the userId and bookingIds index fields even when
+// sessions are encrypted, so ListByUser, DeleteByUser,
+// WithMaxSessionsPerUser, SessionsWithBookingID, and SessionsWithAnyBookingID
+// work with encryption, and expired sessions are reported to WithOnDelete
+// with their booking IDs. The fields hold copies of session
+// values in plaintext, which undoes the encryption for those values, so only
+// use it if the user and booking IDs aren't sensitive.
+func WithPlaintextIndexes() Option {
+	return func(s *Store) error {
+		s.plaintextIndexes = true
+		return nil
+	}
+}
+
+// WithMaxSessionsPerUser limits each user to n sessions with the same name,
+// such as to limit concurrent logins. After a session with a user ID is saved
+// (see WithUserIDKey), the user's sessions that expire soonest are deleted,
+// leaving at most n including the saved one. Sessions without an expiry are
+// deleted first. Failing to delete sessions is only logged, and doesn't fail
+// the save.
+//
+// Each save of a session with a user ID queries the user's sessions. When
+// WithCollection is used, the query needs a composite index on the name and
+// userId fields.
+func WithMaxSessionsPerUser(n int) Option {
+	return func(s *Store) error {
+		if n <= 0 {
+			return fmt.Errorf("WithMaxSessionsPerUser: non-positive maximum %d", n)
+		}
+		s.maxSessionsPerUser = n
+		return nil
+	}
+}
+
+// WithBookingIDValidator makes Save validate every booking ID in the bookingIds
+// value of a session with validate. If validate returns an error for any of
+// them, or bookingIds has the wrong type, the session isn't saved.
+func WithBookingIDValidator(validate func(id string) error) Option {
+	return func(s *Store) error {
+		s.validateBookingID = validate
+		return nil
+	}
+}
+
+// WithReservedKey makes Save reject sessions whose value with the given key
+// isn't a T, with an error wrapping ErrReservedKey, before anything is
+// written. Unset and nil values are allowed. As with Values, if T is a slice
+// type, a []interface{} value of the right element type is allowed too. The
+// bookingIds value is always reserved for a []string; reserving it again
+// replaces its type.
+func WithReservedKey[T any](key string) Option {
+	return func(s *Store) error {
+		if key == "" {
+			return fmt.Errorf("WithReservedKey: empty key")
+		}
+		s.reservedKeys[key] = func(values map[interface{}]interface{}) error {
+			_, _, err := value[T](values, key)
+			return err
+		}
+		return nil
+	}
+}
+
+// WithTracerProvider traces loading and saving sessions, including encoding
+// and decoding them, with OpenTelemetry tracers from tp. Spans record the
+// session name, the path of its document, and the length of the encoded
+// session. By default, nothing is traced.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(s *Store) error {
+		if tp == nil {
+			return fmt.Errorf("WithTracerProvider: nil TracerProvider")
+		}
+		s.tracer = tp.Tracer(tracerName)
+		return nil
+	}
+}
+
+// WithMetricsRegisterer records Prometheus metrics about loading and saving
+// sessions, registered with reg: the number of loads, saves, and errors, their
+// latency, and the length of encoded sessions. Stores using the same
+// Registerer share their metrics.
+func WithMetricsRegisterer(reg prometheus.Registerer) Option {
+	return func(s *Store) error {
+		if reg == nil {
+			return fmt.Errorf("WithMetricsRegisterer: nil Registerer")
+		}
+		m, err := newMetrics(reg)
+		if err != nil {
+			return fmt.Errorf("WithMetricsRegisterer: %w", err)
+		}
+		s.metrics = m
+		return nil
+	}
+}
+
+// WithLogger logs errors that the Store otherwise ignores, such as failing to
+// delete an expired session or a failed garbage collection sweep, to logger.
+// By default, they aren't logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Store) error {
+		if logger == nil {
+			return fmt.Errorf("WithLogger: nil Logger")
+		}
+		s.logger = logger
+		return nil
+	}
+}
+
+// WithRetry retries loading and saving sessions when Firestore fails with a
+// transient error, such as Unavailable or Aborted, up to maxAttempts attempts
+// in total. The delay before the first retry is about base, and it doubles
+// before each later retry. Retries stop when the request's context is done.
+// By default, operations aren't retried.
+func WithRetry(maxAttempts int, base time.Duration) Option {
+	return func(s *Store) error {
+		if maxAttempts < 1 {
+			return fmt.Errorf("WithRetry: maxAttempts must be at least 1, got %d", maxAttempts)
+		}
+		if base < 0 {
+			return fmt.Errorf("WithRetry: negative base delay %v", base)
+		}
+		s.retryAttempts = maxAttempts
+		s.retryBase = base
+		return nil
+	}
+}
+
+// WithOperationTimeout limits each Firestore read or write made while loading
+// or saving a session to d, on top of any deadline of the request's context.
+// With WithRetry, each attempt gets its own timeout. A d of zero, the default,
+// adds no timeout.
+//
+// Concurrent loads of the same session share one read, which carries on until
+// every request waiting for it is canceled.
+func WithOperationTimeout(d time.Duration) Option {
+	return func(s *Store) error {
+		if d < 0 {
+			return fmt.Errorf("WithOperationTimeout: negative timeout %v", d)
+		}
+		s.timeout = d
+		return nil
+	}
+}
+
+// WithCleanupConcurrency deletes sessions n at a time in DeleteAll,
+// DeleteExpired, garbage collection sweeps, and DeleteByUser, so deleting many
+// sessions neither overwhelms Firestore nor takes too long. If a delete fails,
+// the remaining deletes are canceled and the error is returned. By default,
+// sessions are deleted with a Firestore BulkWriter, which ramps up its own
+// concurrency.
+func WithCleanupConcurrency(n int) Option {
+	return func(s *Store) error {
+		if n <= 0 {
+			return fmt.Errorf("WithCleanupConcurrency: non-positive concurrency %d", n)
+		}
+		s.cleanupConcurrency = n
+		return nil
+	}
+}
+
+// WithMergeSave makes Save update only the payload fields of sessions that
+// already exist, instead of replacing the whole document, so it doesn't undo
+// a concurrent Touch or other writes to the expireAt field. Saving an existing
+// session then doesn't change its expiry, which is only extended by Touch or
+// WithSlidingExpiration. New sessions are saved whole, with their expiry.
+//
+// It can't be used with WithTransactionalSave, WithOptimisticLocking, or
+// WithChunking.
+func WithMergeSave() Option {
+	return func(s *Store) error {
+		s.merge = true
+		return nil
+	}
+}
+
+// WithChecksum saves a SHA-256 checksum with every session, so sessions
+// corrupted in storage fail to load, with an error wrapping ErrCorruptSession,
+// rather than decoding to the wrong values. Checksums are verified whenever a
+// session has one, so sessions saved without WithChecksum still load.
+func WithChecksum() Option {
+	return func(s *Store) error {
+		s.checksum = true
+		return nil
+	}
+}
+
+// WithSkipUnchangedSaves skips writing a session to Firestore in Save if its
+// values are unchanged since it was loaded or last saved, such as on pages
+// that only read the session. Only the values are compared, not the options.
+//
+// A skipped save doesn't extend the expiry of the session, so sessions that
+// are only read expire a session lifetime after they were last changed,
+// unless WithSlidingExpiration is used too. Sessions stored with
+// WithNativeFields are always written.
+func WithSkipUnchangedSaves() Option {
+	return func(s *Store) error {
+		s.skipUnchanged = true
+		return nil
+	}
+}
+
+// WithBeforeSave calls f with every session before Save writes it, such as to
+// remove values that must not be stored or to add timestamps. Changes f makes
+// to the session are saved. If f returns an error, Save returns it without
+// writing the session. Hooks added with several WithBeforeSave options are
+// called in order.
+func WithBeforeSave(f func(*sessions.Session) error) Option {
+	return func(s *Store) error {
+		if f == nil {
+			return fmt.Errorf("WithBeforeSave: nil function")
+		}
+		s.beforeSave = append(s.beforeSave, f)
+		return nil
+	}
+}
+
+// WithAfterSave calls f with every session Save saves successfully. Hooks added
+// with several WithAfterSave options are called in order.
+func WithAfterSave(f func(*sessions.Session)) Option {
+	return func(s *Store) error {
+		if f == nil {
+			return fmt.Errorf("WithAfterSave: nil function")
+		}
+		s.afterSave = append(s.afterSave, f)
+		return nil
+	}
+}
+
+// WithOnDelete calls f when a session is deleted by Delete, or by Save with a
+// negative MaxAge, and when New or Get find that a session has expired and
+// delete it, such as to release the bookings it holds. f gets the booking IDs
+// of the session, as stored in its bookingIds value, and is called once per
+// session. Expired sessions are deleted without being decrypted, so when
+// sessions are encrypted f gets no booking IDs for them unless
+// WithPlaintextIndexes is used. Sessions deleted by garbage collection,
+// DeleteExpired, DeleteAll, DeleteByUser, or WithMaxSessionsPerUser don't call
+// f.
+func WithOnDelete(f func(name, id string, bookingIDs []string)) Option {
+	return func(s *Store) error {
+		if f == nil {
+			return fmt.Errorf("WithOnDelete: nil function")
+		}
+		s.onDelete = f
+		return nil
+	}
+}
+
+// WithCorruptSessionPolicy sets what New and Get do with a stored session that
+// can't be decoded, such as a truncated one or one encoded with a codec or key
+// the Store doesn't have. By default, they return an error. Every corrupt
+// session is logged with the Logger and counted in the
+// firestore_sessions_corrupt_total metric, whatever the policy.
+func WithCorruptSessionPolicy(policy CorruptSessionPolicy) Option {
+	return func(s *Store) error {
+		switch policy {
+		case CorruptSessionError, CorruptSessionNew, CorruptSessionDelete:
+		default:
+			return fmt.Errorf("WithCorruptSessionPolicy: unknown policy %d", policy)
+		}
+		s.corruptPolicy = policy
+		return nil
+	}
+}
+
+// WithTransactionalSave saves sessions in Firestore transactions, so changes
+// saved concurrently, such as by requests from several tabs, aren't lost. Save
+// merges the changes made to a session since it was loaded with the session
+// as it is stored: values only changed by the concurrent save are kept, and
+// the session's values win when both changed the same value. Booking IDs added
+// or removed by either are merged. After Save, the session holds the merged
+// values.
+//
+// The values of a session as they were loaded are kept in its Values, under a
+// key of an unexported type, and are never saved. It can't be used with
+// WithChunking.
+func WithTransactionalSave() Option {
+	return func(s *Store) error {
+		s.transactional = true
+		return nil
+	}
+}
+
+// WithOptimisticLocking records a version with each session, incremented every
+// time it is saved. Save fails with a *ConflictError, which matches
+// ErrConflict, if the session was saved by someone else since it was loaded,
+// so the caller can load it again and retry. The version a session was loaded
+// with is returned by Version.
+//
+// It can't be used with WithTransactionalSave or WithChunking.
+func WithOptimisticLocking() Option {
+	return func(s *Store) error {
+		s.locking = true
+		return nil
+	}
+}
+
+// WithTenantResolver stores the sessions of each tenant separately, using
+// resolve to get the tenant ID of a request. A session named "checkout" of the
+// tenant "acme" is stored in the tenants/acme/checkout collection, with any
+// WithCollection or WithCollectionPrefix applied to the last part of the path.
+//
+// Requests without a tenant ID, or with one that isn't a valid Firestore
+// document ID, fail with an error wrapping ErrNoTenant. Methods that take a
+// context instead of a request, such as Touch and Count, use the tenant ID set
+// with WithTenant.
+func WithTenantResolver(resolve func(*http.Request) string) Option {
+	return func(s *Store) error {
+		if resolve == nil {
+			return fmt.Errorf("WithTenantResolver: nil resolver")
+		}
+		s.tenantResolver = resolve
+		return nil
+	}
+}
@@ -0,0 +1,489 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/sessions"
+)
+
+func TestNewOptions(t *testing.T) {
+	ctx := context.Background()
+
+	var applied []int
+	record := func(i int) Option {
+		return func(*Store) error {
+			applied = append(applied, i)
+			return nil
+		}
+	}
+	if _, err := New(ctx, nil, record(1), record(2)); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if len(applied) != 2 || applied[0] != 1 || applied[1] != 2 {
+		t.Errorf("New applied options %v, want [1 2]", applied)
+	}
+
+	wantErr := errors.New("bad option")
+	failing := func(*Store) error { return wantErr }
+	if _, err := New(ctx, nil, failing); err != wantErr {
+		t.Errorf("New with failing option got err %v, want %v", err, wantErr)
+	}
+}
+
+func TestWithCollection(t *testing.T) {
+	ctx := context.Background()
+	client := newOfflineClient(t)
+
+	s, err := New(ctx, client)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got, want := s.collectionRef(context.Background(), "checkout").ID, "checkout"; got != want {
+		t.Errorf("collectionRef got %q, want %q", got, want)
+	}
+
+	s, err = New(ctx, client, WithCollection("sessions"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got, want := s.collectionRef(context.Background(), "checkout").ID, "sessions"; got != want {
+		t.Errorf("collectionRef with WithCollection got %q, want %q", got, want)
+	}
+}
+
+func TestWithCollectionPrefix(t *testing.T) {
+	ctx := context.Background()
+	client := newOfflineClient(t)
+
+	tests := []struct {
+		opts []Option
+		want string
+	}{
+		{opts: nil, want: "checkout"},
+		{opts: []Option{WithCollectionPrefix("")}, want: "checkout"},
+		{opts: []Option{WithCollectionPrefix("staging_")}, want: "staging_checkout"},
+		{opts: []Option{WithCollectionPrefix("staging_"), WithCollection("sessions")}, want: "staging_sessions"},
+	}
+	for _, test := range tests {
+		s, err := New(ctx, client, test.opts...)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if got := s.collectionRef(context.Background(), "checkout").ID; got != test.want {
+			t.Errorf("collectionRef got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestWithIDGenerator(t *testing.T) {
+	ctx := context.Background()
+	client := newOfflineClient(t)
+
+	s, err := New(ctx, client, WithIDGenerator(func() (string, error) {
+		return "fixed-id", nil
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	id, err := s.newID(context.Background(), "checkout")
+	if err != nil {
+		t.Fatalf("newID: %v", err)
+	}
+	want := "projects/test-project/databases/(default)/documents/checkout/fixed-id"
+	if got := s.collectionRef(context.Background(), "checkout").Doc(id).Path; got != want {
+		t.Errorf("document path got %q, want %q", got, want)
+	}
+
+	wantErr := errors.New("out of IDs")
+	s, err = New(ctx, client, WithIDGenerator(func() (string, error) {
+		return "", wantErr
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := s.newID(context.Background(), "checkout"); err == nil {
+		t.Errorf("newID with failing generator got nil error, want %v", wantErr)
+	}
+}
+
+func TestSequentialIDs(t *testing.T) {
+	ctx := context.Background()
+	m, err := NewMemoryStore(WithIDGenerator(SequentialIDs("id")))
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	for _, want := range []string{"id-1", "id-2"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		session, err := m.New(r, "checkout")
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if err := m.Save(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if session.ID != want {
+			t.Errorf("Save got ID %q, want %q", session.ID, want)
+		}
+	}
+
+	s, err := New(ctx, newOfflineClient(t), WithIDGenerator(SequentialIDs("id")))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	id, err := s.newID(ctx, "checkout")
+	if err != nil {
+		t.Fatalf("newID: %v", err)
+	}
+	if got, want := s.DocPath(ctx, "checkout", id), "projects/test-project/databases/(default)/documents/checkout/id-1"; got != want {
+		t.Errorf("DocPath got %q, want %q", got, want)
+	}
+
+	// Without a generator, IDs are still random.
+	s, err = New(ctx, newOfflineClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	first, _ := s.newID(ctx, "checkout")
+	second, _ := s.newID(ctx, "checkout")
+	if first == second || len(first) < 20 {
+		t.Errorf("newID got %q and %q, want distinct random IDs", first, second)
+	}
+}
+
+func TestWithIDLength(t *testing.T) {
+	ctx := context.Background()
+	client := newOfflineClient(t)
+
+	if _, err := New(ctx, client, WithIDLength(8)); err == nil {
+		t.Errorf("New(WithIDLength(8)) got nil error, want error")
+	}
+
+	for _, n := range []int{16, 32} {
+		s, err := New(ctx, client, WithIDLength(n))
+		if err != nil {
+			t.Fatalf("New(WithIDLength(%d)): %v", n, err)
+		}
+		id, err := s.newID(context.Background(), "checkout")
+		if err != nil {
+			t.Fatalf("newID: %v", err)
+		}
+		b, err := base64.RawURLEncoding.DecodeString(id)
+		if err != nil {
+			t.Fatalf("newID got %q, want unpadded base64url: %v", id, err)
+		}
+		if len(b) != n {
+			t.Errorf("newID got %d random bytes, want %d", len(b), n)
+		}
+	}
+}
+
+func TestWithOptions(t *testing.T) {
+	ctx := context.Background()
+
+	defaults := &sessions.Options{Path: "/", MaxAge: 3600, HttpOnly: true}
+	s, err := New(ctx, nil, WithOptions(defaults))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// Changing the caller's Options after New must not change the defaults.
+	defaults.Path = "/changed"
+
+	r := httptest.NewRequest("GET", "/", nil)
+	first, err := s.New(r, "checkout")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	want := sessions.Options{Path: "/", MaxAge: 3600, HttpOnly: true}
+	if diff := cmp.Diff(want, *first.Options); diff != "" {
+		t.Errorf("New got Options diff (-want, +got):\n%s", diff)
+	}
+
+	first.Options.MaxAge = -1
+	second, err := s.New(r, "checkout")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if diff := cmp.Diff(want, *second.Options); diff != "" {
+		t.Errorf("New after mutating another session got Options diff (-want, +got):\n%s", diff)
+	}
+}
+
+func TestWithSessionLifetime(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := New(ctx, nil, WithSessionLifetime(-time.Hour)); err == nil {
+		t.Errorf("New(WithSessionLifetime(-1h)) got nil error, want error")
+	}
+
+	s, err := New(ctx, nil, WithSessionLifetime(time.Hour))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Date(2021, 1, 19, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := s.New(r, "checkout")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got, want := session.Options.MaxAge, 3600; got != want {
+		t.Errorf("New got MaxAge=%d, want %d", got, want)
+	}
+	if got, want := s.expireAt(session), now.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("expireAt got %v, want %v", got, want)
+	}
+
+	// An explicit MaxAge wins over the lifetime.
+	session.Options.MaxAge = 60
+	if got, want := s.expireAt(session), now.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("expireAt with MaxAge=60 got %v, want %v", got, want)
+	}
+
+	// Sessions without Options still expire after the lifetime.
+	session.Options = nil
+	if got, want := s.expireAt(session), now.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("expireAt without Options got %v, want %v", got, want)
+	}
+}
+
+func TestWithTTLByName(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := New(ctx, nil, WithTTLByName(map[string]time.Duration{"checkout": -time.Hour})); err == nil {
+		t.Errorf("New(WithTTLByName(checkout: -1h)) got nil error, want error")
+	}
+
+	s, err := New(ctx, nil, WithSessionLifetime(time.Hour), WithTTLByName(map[string]time.Duration{
+		"checkout":    15 * time.Minute,
+		"preferences": 30 * 24 * time.Hour,
+		"permanent":   0,
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Date(2021, 1, 19, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	tests := []struct {
+		name         string
+		wantMaxAge   int
+		wantExpireAt time.Time
+	}{
+		{name: "checkout", wantMaxAge: 15 * 60, wantExpireAt: now.Add(15 * time.Minute)},
+		{name: "preferences", wantMaxAge: 30 * 24 * 3600, wantExpireAt: now.Add(30 * 24 * time.Hour)},
+		{name: "permanent", wantMaxAge: 0, wantExpireAt: time.Time{}},
+		{name: "other", wantMaxAge: 3600, wantExpireAt: now.Add(time.Hour)},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		session, err := s.New(r, test.name)
+		if err != nil {
+			t.Fatalf("%s: New: %v", test.name, err)
+		}
+		if got := session.Options.MaxAge; got != test.wantMaxAge {
+			t.Errorf("%s: New got MaxAge=%d, want %d", test.name, got, test.wantMaxAge)
+		}
+		// The lifetime is looked up by name on every save, even for
+		// sessions without Options.
+		session.Options = nil
+		if got := s.expireAt(session); !got.Equal(test.wantExpireAt) {
+			t.Errorf("%s: expireAt got %v, want %v", test.name, got, test.wantExpireAt)
+		}
+	}
+}
+
+func TestWithSlidingExpirationRequiresLifetime(t *testing.T) {
+	ctx := context.Background()
+	if _, err := New(ctx, nil, WithSlidingExpiration()); err == nil {
+		t.Errorf("New(WithSlidingExpiration()) got nil error, want error")
+	}
+	if _, err := New(ctx, nil, WithSlidingExpiration(), WithSessionLifetime(time.Hour)); err != nil {
+		t.Errorf("New(WithSlidingExpiration(), WithSessionLifetime(1h)) got err %v, want nil", err)
+	}
+	if _, err := New(ctx, nil, WithSlidingExpiration(), WithTTLByName(map[string]time.Duration{"checkout": time.Hour})); err != nil {
+		t.Errorf("New(WithSlidingExpiration(), WithTTLByName(checkout: 1h)) got err %v, want nil", err)
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2021, 1, 19, 12, 0, 0, 0, time.UTC)
+	s, err := New(ctx, nil, WithClock(func() time.Time { return now }), WithSessionLifetime(time.Hour))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	session := sessions.NewSession(s, "checkout")
+	doc := &sessionDoc{ExpireAt: s.expireAt(session)}
+	if s.expired(doc) {
+		t.Errorf("expired got true for a session saved at the frozen time, want false")
+	}
+
+	now = now.Add(time.Hour)
+	if !s.expired(doc) {
+		t.Errorf("expired got false after the lifetime passed, want true")
+	}
+}
+
+func TestWithCompressionThresholdNegative(t *testing.T) {
+	if _, err := New(context.Background(), nil, WithCompressionThreshold(-1)); err == nil {
+		t.Errorf("New(WithCompressionThreshold(-1)) got nil error, want error")
+	}
+}
+
+func TestWithMaxLength(t *testing.T) {
+	ctx := context.Background()
+	for _, n := range []int{0, -1} {
+		if _, err := New(ctx, nil, WithMaxLength(n)); err == nil {
+			t.Errorf("New(WithMaxLength(%d)) got nil error, want error", n)
+		}
+	}
+
+	s, err := New(ctx, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if s.maxLength != maxLength {
+		t.Errorf("New got maxLength=%d, want the default %d", s.maxLength, maxLength)
+	}
+}
+
+func TestWithCacheTTL(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := New(ctx, nil, WithCacheTTL(-time.Minute)); err == nil {
+		t.Errorf("New(WithCacheTTL(-1m)) got nil error, want error")
+	}
+
+	s, err := New(ctx, nil, WithCacheTTL(0))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if s.cache != nil {
+		t.Errorf("New(WithCacheTTL(0)) got a cache, want none")
+	}
+
+	s, err = New(ctx, nil, WithCacheTTL(time.Minute))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if s.cache == nil {
+		t.Errorf("New(WithCacheTTL(1m)) got no cache, want one")
+	}
+}
+
+func TestWithCacheSize(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := New(ctx, nil, WithCacheTTL(time.Minute), WithCacheSize(0)); err == nil {
+		t.Errorf("New(WithCacheSize(0)) got nil error, want error")
+	}
+	if _, err := New(ctx, nil, WithCacheSize(10)); err == nil {
+		t.Errorf("New(WithCacheSize(10)) without WithCacheTTL got nil error, want error")
+	}
+	s, err := New(ctx, nil, WithCacheTTL(time.Minute), WithCacheSize(10))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got, want := s.cache.size, 10; got != want {
+		t.Errorf("New got cache size %d, want %d", got, want)
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := New(ctx, nil, WithLogger(nil)); err == nil {
+		t.Errorf("New(WithLogger(nil)) got nil error, want error")
+	}
+
+	s, err := New(ctx, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if s.logger.Enabled(ctx, slog.LevelError) {
+		t.Errorf("New got a logger that logs errors, want them discarded by default")
+	}
+
+	buf := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(buf, nil))
+	if s, err = New(ctx, nil, WithLogger(logger)); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	s.logger.Warn("test message")
+	if !strings.Contains(buf.String(), "test message") {
+		t.Errorf("WithLogger logged %q, want it to contain %q", buf.String(), "test message")
+	}
+}
+
+func TestWithTokenExtractor(t *testing.T) {
+	ctx := context.Background()
+	if _, err := New(ctx, nil, WithTokenExtractor(nil)); err == nil {
+		t.Errorf("New(WithTokenExtractor(nil)) got nil error, want error")
+	}
+	bearer := func(r *http.Request) (string, bool) {
+		return strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	s, err := New(ctx, newOfflineClient(t), WithTokenExtractor(bearer))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	var fetched string
+	s.fetch = func(ctx context.Context, name, id string) (*sessionDoc, error) {
+		fetched = s.collectionRef(ctx, name).Doc(id).Path
+		return &sessionDoc{Name: name, EncodedSession: `{"Values":{"testkey":"testvalue"}}`}, nil
+	}
+
+	tests := []struct {
+		desc    string
+		headers map[string]string
+		wantID  string
+	}{
+		{desc: "token", headers: map[string]string{"Authorization": "Bearer token-id", "checkout": "header-id"}, wantID: "token-id"},
+		{desc: "fallback", headers: map[string]string{"Authorization": "Basic xyz", "checkout": "header-id"}, wantID: "header-id"},
+		{desc: "empty token", headers: map[string]string{"Authorization": "Bearer ", "checkout": "header-id"}, wantID: "header-id"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		fetched = ""
+		session, err := s.New(r, "checkout")
+		if err != nil {
+			t.Fatalf("%s: New: %v", test.desc, err)
+		}
+		if session.ID != test.wantID || session.Values["testkey"] != "testvalue" {
+			t.Errorf("%s: New got session %q with Values %v, want %q", test.desc, session.ID, session.Values, test.wantID)
+		}
+		if want := s.DocPath(ctx, "checkout", test.wantID); fetched != want {
+			t.Errorf("%s: New read %q, want %q", test.desc, fetched, want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/api/iterator"
+)
+
+// pingName is the session name whose collection Ping queries. The collection
+// doesn't need to exist.
+const pingName = "ping"
+
+// Ping checks that Firestore can be reached, such as for readiness probes, by
+// running a query for at most one document ID, which reads no document if the
+// collection is empty. It returns the error of the query, if any, and fails
+// once the deadline of ctx passes.
+func (s *Store) Ping(ctx context.Context) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	iter := s.collectionRef(ctx, pingName).Select().Limit(1).Documents(ctx)
+	defer iter.Stop()
+	if _, err := iter.Next(); err != nil && err != iterator.Done {
+		return fmt.Errorf("Ping: %w", err)
+	}
+	return nil
+}
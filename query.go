@@ -0,0 +1,326 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"github.com/gorilla/sessions"
+	"google.golang.org/api/iterator"
+)
+
+// maxArrayContainsAny is the maximum number of values in a Firestore
+// array-contains-any filter.
+const maxArrayContainsAny = 30
+
+// Count returns the number of sessions with the given name that haven't
+// expired. It uses Firestore count aggregations, so the sessions aren't read.
+//
+// With WithChunking and WithCollection, the query needs a composite index on
+// the name and chunkOf fields.
+func (s *Store) Count(ctx context.Context, name string) (int, error) {
+	if err := s.checkTenant(ctx); err != nil {
+		return 0, err
+	}
+	all, err := count(ctx, s.query(ctx, name))
+	if err != nil {
+		return 0, err
+	}
+	// Sessions that never expire have no expireAt, and sessions have no
+	// chunkOf, so the sessions to count can't be matched by a filter. Count
+	// the documents to leave out instead: expired sessions, and chunks of
+	// sessions, counting expired chunks once.
+	var skipped firestore.EntityFilter = firestore.PropertyFilter{Path: expireAtField, Operator: "<=", Value: s.now()}
+	if s.chunking {
+		skipped = firestore.OrFilter{Filters: []firestore.EntityFilter{
+			skipped,
+			firestore.PropertyFilter{Path: chunkOfField, Operator: ">", Value: ""},
+		}}
+	}
+	n, err := count(ctx, s.query(ctx, name).WhereEntity(skipped))
+	if err != nil {
+		return 0, err
+	}
+	return all - n, nil
+}
+
+// count returns the number of documents matching q.
+func count(ctx context.Context, q firestore.Query) (int, error) {
+	res, err := q.NewAggregationQuery().WithCount("count").Get(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("Count: %w", err)
+	}
+	v, ok := res["count"].(*firestorepb.Value)
+	if !ok {
+		return 0, fmt.Errorf("Count: unexpected result %v", res["count"])
+	}
+	return int(v.GetIntegerValue()), nil
+}
+
+// ListByUser returns the IDs of the sessions with the given name that belong
+// to the user with the given ID and haven't expired. See WithUserIDKey.
+//
+// When WithCollection is used, the query needs a composite index on the name
+// and userId fields.
+func (s *Store) ListByUser(ctx context.Context, name, userID string) ([]string, error) {
+	if err := s.checkTenant(ctx); err != nil {
+		return nil, err
+	}
+	docs, err := s.query(ctx, name).Where(userIDField, "==", userID).Select(expireAtField).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("GetAll: %w", err)
+	}
+	return s.liveIDs(docs)
+}
+
+// liveIDs returns the IDs of the session documents in docs that haven't
+// expired, which are only deleted once garbage collected. The documents must
+// include the expireAt field.
+func (s *Store) liveIDs(docs []*firestore.DocumentSnapshot) ([]string, error) {
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		encoded := sessionDoc{}
+		if err := doc.DataTo(&encoded); err != nil {
+			return nil, fmt.Errorf("DataTo: %w", err)
+		}
+		if !s.expired(&encoded) {
+			ids = append(ids, doc.Ref.ID)
+		}
+	}
+	return ids, nil
+}
+
+// DeleteByUser deletes every session with the given name that belongs to the
+// user with the given ID, such as to sign the user out everywhere. See
+// WithUserIDKey.
+func (s *Store) DeleteByUser(ctx context.Context, name, userID string) error {
+	if err := s.checkTenant(ctx); err != nil {
+		return err
+	}
+	docs, err := s.query(ctx, name).Where(userIDField, "==", userID).Select("chunks").Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("GetAll: %w", err)
+	}
+	coll := s.collectionRef(ctx, name)
+	var refs []*firestore.DocumentRef
+	for _, doc := range docs {
+		encoded := sessionDoc{}
+		if err := doc.DataTo(&encoded); err != nil {
+			return fmt.Errorf("DataTo: %w", err)
+		}
+		refs = append(refs, doc.Ref)
+		for i := 1; i < encoded.Chunks; i++ {
+			refs = append(refs, coll.Doc(chunkID(doc.Ref.ID, i)))
+		}
+		s.cache.remove(s.cacheKey(ctx, name, doc.Ref.ID))
+	}
+	_, err = s.deleteDocs(ctx, refs)
+	return err
+}
+
+// SessionsWithBookingID returns the IDs of the sessions with the given name
+// whose bookingIds value includes the given booking ID, and that haven't
+// expired.
+//
+// Encrypted sessions are only found with WithPlaintextIndexes, since their
+// booking IDs aren't otherwise written in plaintext.
+//
+// When WithCollection is used, the query needs a composite index on the name
+// and bookingIds fields.
+func (s *Store) SessionsWithBookingID(ctx context.Context, name, bookingID string) ([]string, error) {
+	if err := s.checkTenant(ctx); err != nil {
+		return nil, err
+	}
+	docs, err := s.query(ctx, name).Where(bookingIDsField, "array-contains", bookingID).Select(expireAtField).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("GetAll: %w", err)
+	}
+	return s.liveIDs(docs)
+}
+
+// SessionsWithAnyBookingID returns the IDs of the sessions with the given name
+// whose bookingIds value includes any of the given booking IDs, keyed by
+// booking ID. Booking IDs no session refers to are left out. As with
+// SessionsWithBookingID, expired sessions are left out, and encrypted sessions
+// are only found with WithPlaintextIndexes.
+//
+// Firestore limits the number of values in an array-contains-any query, so
+// the booking IDs are queried in batches.
+func (s *Store) SessionsWithAnyBookingID(ctx context.Context, name string, bookingIDs []string) (map[string][]string, error) {
+	if err := s.checkTenant(ctx); err != nil {
+		return nil, err
+	}
+	found := map[string][]string{}
+	for _, batch := range batchIDs(bookingIDs, maxArrayContainsAny) {
+		docs, err := s.query(ctx, name).Where(bookingIDsField, "array-contains-any", batch).Select(bookingIDsField, expireAtField).Documents(ctx).GetAll()
+		if err != nil {
+			return nil, fmt.Errorf("GetAll: %w", err)
+		}
+		want := map[string]bool{}
+		for _, id := range batch {
+			want[id] = true
+		}
+		for _, doc := range docs {
+			encoded := sessionDoc{}
+			if err := doc.DataTo(&encoded); err != nil {
+				return nil, fmt.Errorf("DataTo: %w", err)
+			}
+			if s.expired(&encoded) {
+				continue
+			}
+			for _, id := range encoded.BookingIDs {
+				if want[id] {
+					found[id] = append(found[id], doc.Ref.ID)
+				}
+			}
+		}
+	}
+	return found, nil
+}
+
+// batchIDs splits the unique IDs in ids into batches of at most n.
+func batchIDs(ids []string, n int) [][]string {
+	seen := map[string]bool{}
+	var batches [][]string
+	var batch []string
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		batch = append(batch, id)
+		if len(batch) == n {
+			batches = append(batches, batch)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// GetAll loads the sessions with the given name and IDs in a single batch
+// read, keyed by ID. Sessions that don't exist or have expired are left out.
+// Unlike New, GetAll doesn't cache the sessions or extend their expiry.
+//
+// A session that can't be decoded fails GetAll with an error wrapping
+// ErrCorruptSession, unless WithCorruptSessionPolicy says to treat it as new,
+// in which case it is left out.
+func (s *Store) GetAll(ctx context.Context, name string, ids []string) (map[string]*sessions.Session, error) {
+	if err := s.checkTenant(ctx); err != nil {
+		return nil, err
+	}
+	coll := s.collectionRef(ctx, name)
+	seen := map[string]bool{}
+	var refs []*firestore.DocumentRef
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			refs = append(refs, coll.Doc(id))
+		}
+	}
+	snaps, err := s.client.GetAll(ctx, refs)
+	if err != nil {
+		return nil, fmt.Errorf("GetAll: %w", err)
+	}
+	found := map[string]*sessions.Session{}
+	for _, snap := range snaps {
+		if !snap.Exists() {
+			continue
+		}
+		session, err := s.decodeSession(ctx, name, snap)
+		if errors.Is(err, ErrCorruptSession) && s.corruptPolicy != CorruptSessionError {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if session != nil {
+			found[session.ID] = session
+		}
+	}
+	return found, nil
+}
+
+// decodeSession decodes the session with the given name stored in snap. It
+// returns a nil session if the document holds a session with another name, is
+// a chunk of a session, or has expired. If the session can't be decoded, the
+// error wraps ErrCorruptSession.
+func (s *Store) decodeSession(ctx context.Context, name string, snap *firestore.DocumentSnapshot) (*sessions.Session, error) {
+	encoded := &sessionDoc{}
+	if err := snap.DataTo(encoded); err != nil {
+		return nil, fmt.Errorf("DataTo: %w", err)
+	}
+	if (s.shared() && encoded.Name != name) || s.expired(encoded) {
+		return nil, nil
+	}
+	// Chunks after the first are loaded with their session.
+	if encoded.ChunkOf != "" {
+		return nil, nil
+	}
+	if err := s.loadChunks(ctx, name, snap.Ref.ID, encoded); err != nil {
+		return nil, err
+	}
+	values, err := s.deserialize(ctx, encoded)
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrCorruptSession, err)
+		s.metrics.observeCorrupt(s.corruptPolicy)
+		s.logger.Warn("corrupt session", "document", snap.Ref.Path, "policy", s.corruptPolicy.String(), "error", err)
+		return nil, err
+	}
+	session := s.newSession(s, name)
+	session.ID = snap.Ref.ID
+	session.Values = values
+	return session, nil
+}
+
+// Iterate calls fn with each session with the given name that hasn't expired,
+// reading the sessions a page at a time rather than all at once. It stops at
+// the first error fn returns and returns it. Sessions that can't be decoded
+// are logged and skipped, whatever the corrupt session policy.
+func (s *Store) Iterate(ctx context.Context, name string, fn func(id string, session *sessions.Session) error) error {
+	if err := s.checkTenant(ctx); err != nil {
+		return err
+	}
+	iter := s.query(ctx, name).Documents(ctx)
+	defer iter.Stop()
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Next: %w", err)
+		}
+		session, err := s.decodeSession(ctx, name, snap)
+		if errors.Is(err, ErrCorruptSession) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if session == nil {
+			continue
+		}
+		if err := fn(session.ID, session); err != nil {
+			return err
+		}
+	}
+}
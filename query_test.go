@@ -0,0 +1,355 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/gorilla/sessions"
+)
+
+func TestCount(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithCollection("TestCount"), WithChunking())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	const name = "checkout"
+	defer s.cleanup(name)
+	docs := map[string]sessionDoc{
+		"expired": {Name: name, ExpireAt: now.Add(-time.Hour)},
+		"live1":   {Name: name, ExpireAt: now.Add(time.Hour)},
+		"live2":   {Name: name, ExpireAt: now.Add(time.Minute)},
+		"forever": {Name: name},
+		"other":   {Name: "basket"},
+		// Chunks of sessions aren't counted, whether or not they have
+		// expired.
+		"live1_1":   {Name: name, ExpireAt: now.Add(time.Hour), ChunkOf: "live1"},
+		"expired_1": {Name: name, ExpireAt: now.Add(-time.Hour), ChunkOf: "expired"},
+	}
+	for id, doc := range docs {
+		if _, err := s.collectionRef(ctx, name).Doc(id).Set(ctx, doc); err != nil {
+			t.Fatalf("Set(%q): %v", id, err)
+		}
+	}
+	defer s.collectionRef(ctx, name).Doc("other").Delete(ctx)
+
+	got, err := s.Count(ctx, name)
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	if want := 3; got != want {
+		t.Errorf("Count got %d, want %d", got, want)
+	}
+}
+
+func TestGetAll(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const name = "TestGetAll"
+	defer s.cleanup(name)
+	want := map[string]interface{}{}
+	var ids []string
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		session, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		session.Values["n"] = fmt.Sprint(i)
+		if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		want[session.ID] = session.Values["n"]
+		ids = append(ids, session.ID)
+	}
+
+	got, err := s.GetAll(ctx, name, append(ids, "missing", ids[0]))
+	if err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	values := map[string]interface{}{}
+	for id, session := range got {
+		if session.ID != id || session.IsNew {
+			t.Errorf("GetAll session %q got ID %q, IsNew %v", id, session.ID, session.IsNew)
+		}
+		values[id] = session.Values["n"]
+	}
+	if diff := cmp.Diff(want, values); diff != "" {
+		t.Errorf("GetAll got diff (-want, +got):\n%s", diff)
+	}
+}
+
+func TestIterate(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const name = "TestIterate"
+	defer s.cleanup(name)
+	var want []string
+	for i := 0; i < 5; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		session, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		session.Values["n"] = fmt.Sprint(i)
+		if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		want = append(want, session.ID)
+	}
+	// A truncated JSON session is skipped.
+	corrupt := sessionDoc{Name: name, Codec: codecJSON, EncodedSession: `{"Values":{"testk`}
+	if _, err := s.collectionRef(ctx, name).Doc("corrupt").Set(ctx, corrupt); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	var got []string
+	err = s.Iterate(ctx, name, func(id string, session *sessions.Session) error {
+		if session.ID != id || session.Values["n"] == nil {
+			t.Errorf("Iterate got session %q with ID %q, values %v", id, session.ID, session.Values)
+		}
+		got = append(got, id)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Iterate: %v", err)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Iterate got diff (-want, +got):\n%s", diff)
+	}
+
+	visited := 0
+	err = s.Iterate(ctx, name, func(id string, session *sessions.Session) error {
+		visited++
+		if visited == 2 {
+			return errSentinel
+		}
+		return nil
+	})
+	if !errors.Is(err, errSentinel) {
+		t.Errorf("Iterate got err %v, want %v", err, errSentinel)
+	}
+	if visited != 2 {
+		t.Errorf("Iterate called fn %d times, want it to stop after 2", visited)
+	}
+}
+
+func TestListAndDeleteByUser(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithUserIDKey("uid"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const name = "TestListAndDeleteByUser"
+	defer s.cleanup(name)
+	users := []string{"alice", "alice", "bob"}
+	var ids []string
+	for _, user := range users {
+		r := httptest.NewRequest("GET", "/", nil)
+		session, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		session.Values["uid"] = user
+		if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		ids = append(ids, session.ID)
+	}
+	// Expired sessions that haven't been garbage collected aren't listed.
+	expired := sessionDoc{Name: name, ExpireAt: time.Now().Add(-time.Hour), UserID: "alice"}
+	if _, err := s.collectionRef(ctx, name).Doc("expired").Set(ctx, expired); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	got, err := s.ListByUser(ctx, name, "alice")
+	if err != nil {
+		t.Fatalf("ListByUser: %v", err)
+	}
+	want := ids[:2]
+	sort.Strings(got)
+	sort.Strings(want)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ListByUser got diff (-want, +got):\n%s", diff)
+	}
+
+	if err := s.DeleteByUser(ctx, name, "alice"); err != nil {
+		t.Fatalf("DeleteByUser: %v", err)
+	}
+	for i, id := range ids {
+		exists, err := s.Exists(ctx, name, id)
+		if err != nil {
+			t.Fatalf("Exists: %v", err)
+		}
+		if want := users[i] != "alice"; exists != want {
+			t.Errorf("after DeleteByUser, Exists(%s session) got %v, want %v", users[i], exists, want)
+		}
+	}
+}
+
+func TestSessionsWithBookingID(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const name = "TestSessionsWithBookingID"
+	defer s.cleanup(name)
+	bookings := [][]string{
+		{"LH1", "LH2"},
+		{"LH2", "LH3"},
+	}
+	var ids []string
+	for _, b := range bookings {
+		r := httptest.NewRequest("GET", "/", nil)
+		session, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		session.Values[bookingIDsKey] = b
+		if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		ids = append(ids, session.ID)
+	}
+	// Expired sessions that haven't been garbage collected aren't found.
+	expired := sessionDoc{Name: name, ExpireAt: time.Now().Add(-time.Hour), BookingIDs: []string{"LH1"}}
+	if _, err := s.collectionRef(ctx, name).Doc("expired").Set(ctx, expired); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	tests := []struct {
+		bookingID string
+		want      []string
+	}{
+		{"LH1", ids[:1]},
+		{"LH2", ids},
+		{"LH4", nil},
+	}
+	for _, test := range tests {
+		got, err := s.SessionsWithBookingID(ctx, name, test.bookingID)
+		if err != nil {
+			t.Fatalf("SessionsWithBookingID(%q): %v", test.bookingID, err)
+		}
+		sort.Strings(got)
+		want := append([]string(nil), test.want...)
+		sort.Strings(want)
+		if diff := cmp.Diff(want, got, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("SessionsWithBookingID(%q) got diff (-want, +got):\n%s", test.bookingID, diff)
+		}
+	}
+}
+
+func TestBatchIDs(t *testing.T) {
+	tests := []struct {
+		desc string
+		ids  []string
+		want [][]string
+	}{
+		{desc: "empty", ids: nil, want: nil},
+		{desc: "one batch", ids: []string{"a", "b"}, want: [][]string{{"a", "b"}}},
+		{desc: "exactly full", ids: []string{"a", "b", "c"}, want: [][]string{{"a", "b", "c"}}},
+		{desc: "overflow", ids: []string{"a", "b", "c", "d"}, want: [][]string{{"a", "b", "c"}, {"d"}}},
+		{desc: "duplicates", ids: []string{"a", "a", "b", "c", "b", "d"}, want: [][]string{{"a", "b", "c"}, {"d"}}},
+	}
+	for _, test := range tests {
+		if diff := cmp.Diff(test.want, batchIDs(test.ids, 3)); diff != "" {
+			t.Errorf("%s: batchIDs got diff (-want, +got):\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestSessionsWithAnyBookingID(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const name = "TestSessionsWithAnyBookingID"
+	defer s.cleanup(name)
+	// The last booking ID is in a second array-contains-any batch.
+	var query []string
+	for i := 0; i <= maxArrayContainsAny; i++ {
+		query = append(query, fmt.Sprintf("LH%d", i))
+	}
+	last := query[maxArrayContainsAny]
+	bookings := [][]string{
+		{"LH0", last},
+		{"LH1", "other"},
+	}
+	var ids []string
+	for _, b := range bookings {
+		r := httptest.NewRequest("GET", "/", nil)
+		session, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		session.Values[bookingIDsKey] = b
+		if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		ids = append(ids, session.ID)
+	}
+
+	got, err := s.SessionsWithAnyBookingID(ctx, name, query)
+	if err != nil {
+		t.Fatalf("SessionsWithAnyBookingID: %v", err)
+	}
+	want := map[string][]string{
+		"LH0": {ids[0]},
+		"LH1": {ids[1]},
+		last:  {ids[0]},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("SessionsWithAnyBookingID got diff (-want, +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// RegenerateID moves the session to a new ID, such as when the user signs in,
+// so an ID issued before, which an attacker may have planted, stops working.
+// It saves the session values under a new ID, deletes the document of the old
+// ID, and sets session.ID. If w is set, the new ID is sent in the response
+// header named after the session, for the client to send from then on, encoded
+// with WithSecureCookie if it is used.
+//
+// If saving the session fails, it keeps its old ID. The tenant of the session,
+// if any, is the tenant in ctx. See WithTenant.
+func (s *Store) RegenerateID(ctx context.Context, w http.ResponseWriter, session *sessions.Session) (err error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "RegenerateID", session.Name())
+	defer func() {
+		endSpan(span, err)
+		s.metrics.observe(opSave, start, err)
+	}()
+
+	if err := s.checkTenant(ctx); err != nil {
+		return err
+	}
+	if session.Options != nil && session.Options.MaxAge < 0 {
+		return fmt.Errorf("RegenerateID: session %q is deleted", session.Name())
+	}
+	oldID, values, isNew := session.ID, session.Values, session.IsNew
+	// The values only kept in memory, such as the version, describe the
+	// session stored under the old ID. The session is saved as a new one,
+	// with a new ID that doesn't collide with another session.
+	session.ID, session.Values, session.IsNew = "", storedValues(values), true
+	err = s.save(ctx, session, "")
+	session.IsNew = isNew
+	if err != nil {
+		session.ID, session.Values = oldID, values
+		return err
+	}
+	if w != nil {
+		if err := s.writeID(w, session.Name(), session.ID); err != nil {
+			return err
+		}
+	}
+	if oldID == "" {
+		return nil
+	}
+	if _, err := s.deleteDoc(ctx, session.Name(), oldID); err != nil {
+		return fmt.Errorf("deleting old session: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/sessions"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRegenerateID(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const name = "TestRegenerateID"
+	defer s.cleanup(name)
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session.Values["testkey"] = "testvalue"
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	oldID := session.ID
+
+	w := httptest.NewRecorder()
+	if err := s.RegenerateID(ctx, w, session); err != nil {
+		t.Fatalf("RegenerateID: %v", err)
+	}
+	if session.ID == oldID {
+		t.Fatalf("RegenerateID kept the ID %q", oldID)
+	}
+	if got := w.Header().Get(name); got != session.ID {
+		t.Errorf("RegenerateID sent ID %q, want %q", got, session.ID)
+	}
+
+	// The old ID is invalid at once.
+	if _, err := s.collectionRef(ctx, name).Doc(oldID).Get(ctx); status.Code(err) != codes.NotFound {
+		t.Errorf("Get(old ID) got err %v, want NotFound", err)
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(name, oldID)
+	if got, err := s.New(r, name); err != nil || !got.IsNew {
+		t.Errorf("New(old ID) got IsNew=%v, err %v, want a new session", got.IsNew, err)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(name, session.ID)
+	got, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got.IsNew {
+		t.Errorf("New(new ID) got a new session, want the regenerated one")
+	}
+	if diff := cmp.Diff(session.Values, got.Values); diff != "" {
+		t.Errorf("New(new ID) got diff Values (-want, +got):\n%s", diff)
+	}
+}
+
+func TestRegenerateIDDeleted(t *testing.T) {
+	s, err := New(context.Background(), newOfflineClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session := sessions.NewSession(s, "checkout")
+	session.ID = "id"
+	session.Options.MaxAge = -1
+	if err := s.RegenerateID(context.Background(), nil, session); err == nil {
+		t.Errorf("RegenerateID of a deleted session got nil error, want error")
+	}
+	if session.ID != "id" {
+		t.Errorf("RegenerateID of a deleted session changed the ID to %q", session.ID)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retryable reports whether err is a transient Firestore error, which may
+// succeed if the operation is retried.
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// retry calls f until it succeeds, fails with an error that isn't retryable,
+// or has been called retryAttempts times, waiting an exponentially increasing,
+// jittered, delay between calls. It returns the last error from f, or the
+// error of ctx if it is done while waiting.
+func (s *Store) retry(ctx context.Context, f func() error) error {
+	delay := s.retryBase
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= s.retryAttempts || !retryable(err) {
+			return err
+		}
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		delay *= 2
+	}
+}
+
+// retrySave is retry for f, which saves the session with the given name in the
+// document ref. If create is set, f creates ref instead, and fails if it
+// exists. An attempt that fails after the write is committed, such as by
+// timing out, then makes the retries fail that way too, so when a retry finds
+// ref exists, ref is read, and the save succeeded if it holds the document
+// returned by written.
+func (s *Store) retrySave(ctx context.Context, create bool, name string, ref *firestore.DocumentRef, written func() *sessionDoc, f func() error) error {
+	if !create {
+		return s.retry(ctx, f)
+	}
+	attempt := 0
+	return s.retry(ctx, func() error {
+		attempt++
+		err := f()
+		if attempt > 1 && status.Code(err) == codes.AlreadyExists && s.holds(ctx, name, ref.ID, written()) {
+			return nil
+		}
+		return err
+	})
+}
+
+// holds reports whether the document of the session with the given name and ID
+// holds encoded, as last written by this Store. Errors reading it are reported
+// as false.
+func (s *Store) holds(ctx context.Context, name, id string, encoded *sessionDoc) bool {
+	if encoded == nil {
+		return false
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	stored, err := s.fetch(ctx, name, id)
+	if err != nil {
+		return false
+	}
+	// Firestore stores timestamps to the microsecond.
+	return stored.UpdatedAt.Truncate(time.Microsecond).Equal(encoded.UpdatedAt.Truncate(time.Microsecond)) &&
+		stored.Version == encoded.Version &&
+		bytes.Equal(stored.payload(), encoded.payload())
+}
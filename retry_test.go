@@ -0,0 +1,131 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWithRetry(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := New(ctx, nil, WithRetry(0, time.Millisecond)); err == nil {
+		t.Errorf("New(WithRetry(0, 1ms)) got nil error, want error")
+	}
+
+	s, err := New(ctx, newOfflineClient(t), WithRetry(3, time.Millisecond))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	tests := []struct {
+		desc        string
+		errs        []error
+		wantFetches int
+		wantErr     bool
+	}{
+		{
+			desc:        "fails twice then succeeds",
+			errs:        []error{status.Error(codes.Unavailable, "unavailable"), status.Error(codes.Aborted, "aborted")},
+			wantFetches: 3,
+		},
+		{
+			desc:        "not retryable",
+			errs:        []error{status.Error(codes.PermissionDenied, "denied")},
+			wantFetches: 1,
+			wantErr:     true,
+		},
+		{
+			desc: "out of attempts",
+			errs: []error{
+				status.Error(codes.Unavailable, "unavailable"),
+				status.Error(codes.Unavailable, "unavailable"),
+				status.Error(codes.Unavailable, "unavailable"),
+			},
+			wantFetches: 3,
+			wantErr:     true,
+		},
+	}
+	for _, test := range tests {
+		fetches := 0
+		s.fetch = func(ctx context.Context, name, id string) (*sessionDoc, error) {
+			fetches++
+			if fetches <= len(test.errs) {
+				return nil, test.errs[fetches-1]
+			}
+			return &sessionDoc{Name: name, EncodedSession: `{"Values":{}}`}, nil
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("checkout", "id")
+		_, err := s.New(r, "checkout")
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("%s: New got err %v, want error=%v", test.desc, err, test.wantErr)
+		}
+		if fetches != test.wantFetches {
+			t.Errorf("%s: New read the session %d times, want %d", test.desc, fetches, test.wantFetches)
+		}
+	}
+}
+
+func TestRetryContextDone(t *testing.T) {
+	s, err := New(context.Background(), nil, WithRetry(10, time.Hour))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	err = s.retry(ctx, func() error {
+		calls++
+		return status.Error(codes.Unavailable, "unavailable")
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("retry got err %v, want context.DeadlineExceeded", err)
+	}
+	if calls != 1 {
+		t.Errorf("retry called f %d times, want 1", calls)
+	}
+}
+
+func TestWithOperationTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := New(ctx, nil, WithOperationTimeout(-time.Second)); err == nil {
+		t.Errorf("New(WithOperationTimeout(-1s)) got nil error, want error")
+	}
+
+	s, err := New(ctx, newOfflineClient(t), WithOperationTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// The fake read blocks until its context is done.
+	s.fetch = func(ctx context.Context, name, id string) (*sessionDoc, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("checkout", "id")
+	if _, err := s.New(r, "checkout"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("New got err %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+)
+
+// WithSecureCookie signs, and optionally encrypts, session IDs with
+// gorilla/securecookie before they are sent to clients, so a client can't
+// send an ID it wasn't given. Save sends the encoded ID in the response header
+// named after the session, and New and Get decode the ID in the request
+// header. A request with an ID that fails to decode, such as one that was
+// tampered with or whose signature has expired, gets a new session.
+//
+// IDs are encoded with the first codec, and decoded with whichever codec
+// works, as with securecookie.CodecsFromPairs, so keys can be rotated.
+func WithSecureCookie(codecs ...securecookie.Codec) Option {
+	return func(s *Store) error {
+		if len(codecs) == 0 {
+			return fmt.Errorf("WithSecureCookie: no codecs")
+		}
+		s.idCodecs = codecs
+		return nil
+	}
+}
+
+// encodeID returns the ID of the session with the given name as it is sent to
+// clients: encoded with WithSecureCookie, if it is used.
+func (s *Store) encodeID(name, id string) (string, error) {
+	if len(s.idCodecs) == 0 {
+		return id, nil
+	}
+	token, err := securecookie.EncodeMulti(name, id, s.idCodecs...)
+	if err != nil {
+		return "", fmt.Errorf("securecookie.EncodeMulti: %w", err)
+	}
+	return token, nil
+}
+
+// decodeID returns the ID of the session with the given name from token, as
+// sent by a client.
+func (s *Store) decodeID(name, token string) (string, error) {
+	if len(s.idCodecs) == 0 {
+		return token, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, token, &id, s.idCodecs...); err != nil {
+		return "", fmt.Errorf("securecookie.DecodeMulti: %w", err)
+	}
+	return id, nil
+}
+
+// writeID sends the ID of the session with the given name in the response
+// header named after it.
+func (s *Store) writeID(w http.ResponseWriter, name, id string) error {
+	token, err := s.encodeID(name, id)
+	if err != nil {
+		return err
+	}
+	w.Header().Set(name, token)
+	return nil
+}
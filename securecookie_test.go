@@ -0,0 +1,109 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestWithSecureCookie(t *testing.T) {
+	if _, err := NewMemoryStore(WithSecureCookie()); err == nil {
+		t.Errorf("NewMemoryStore(WithSecureCookie()) got nil error, want error")
+	}
+	codec := securecookie.New(bytes.Repeat([]byte("h"), 32), bytes.Repeat([]byte("e"), 32))
+	m, err := NewMemoryStore(WithSecureCookie(codec))
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	const name = "checkout"
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := m.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session.Values["key"] = "value"
+	w := httptest.NewRecorder()
+	if err := m.Save(r, w, session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	token := w.Header().Get(name)
+	if token == "" || token == session.ID {
+		t.Fatalf("Save sent ID %q, want it encoded", token)
+	}
+
+	tests := []struct {
+		desc      string
+		token     string
+		wantIsNew bool
+	}{
+		{desc: "encoded", token: token},
+		{desc: "plain ID", token: session.ID, wantIsNew: true},
+		{desc: "tampered", token: token[:len(token)-2] + "AA", wantIsNew: true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(name, test.token)
+		got, err := m.New(r, name)
+		if err != nil {
+			t.Fatalf("%s: New: %v", test.desc, err)
+		}
+		if got.IsNew != test.wantIsNew {
+			t.Errorf("%s: New got IsNew=%v, want %v", test.desc, got.IsNew, test.wantIsNew)
+		}
+		if !got.IsNew && got.Values["key"] != "value" {
+			t.Errorf("%s: New got Values %v, want the saved session", test.desc, got.Values)
+		}
+	}
+}
+
+func TestSecureCookieTampered(t *testing.T) {
+	ctx := context.Background()
+	codec := securecookie.New(bytes.Repeat([]byte("h"), 32), nil)
+	s, err := New(ctx, newOfflineClient(t), WithSecureCookie(codec))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// A session whose document exists can't be loaded with a forged token,
+	// so the offline client is never read.
+	s.fetch = func(ctx context.Context, name, id string) (*sessionDoc, error) {
+		t.Errorf("fetch(%q, %q) called for a tampered token", name, id)
+		return &sessionDoc{Name: name, EncodedSession: `{"Values":{}}`}, nil
+	}
+	token, err := s.encodeID("checkout", "id")
+	if err != nil {
+		t.Fatalf("encodeID: %v", err)
+	}
+	forged, err := securecookie.New(bytes.Repeat([]byte("x"), 32), nil).Encode("checkout", "id")
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	for _, tampered := range []string{"id", token + "x", forged} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("checkout", tampered)
+		session, err := s.New(r, "checkout")
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if !session.IsNew || session.ID != "" {
+			t.Errorf("New(%q) got IsNew=%v, ID %q, want a new session", tampered, session.IsNew, session.ID)
+		}
+	}
+}
@@ -15,66 +15,523 @@
 // Package firestoregorilla is a Firestore-backed sessions store, which can be
 // used with gorilla/sessions.
 //
-// Encoded sessions are stored in Firestore
+// Encoded sessions are stored in Firestore.
 //
-// Sessions never expire and are never deleted or cleaned up.
+// Sessions saved with a positive MaxAge record when they expire in the
+// expireAt field of their document. Expired sessions are treated as new
+// sessions and deleted when they are next loaded. Expired sessions that are
+// never loaded again are only deleted if Firestore has a TTL policy on that
+// field (see Store.EnsureTTLPolicy) or Store.StartGC is running.
+//
+// Errors returned by a Store wrap the Firestore, codec, or encryption errors
+// that caused them, so they can be inspected with errors.Is, errors.As, and
+// status.Code.
 package firestoregorilla
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
-	"encoding/json"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"cloud.google.com/go/firestore"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-// maxLength is the maximum length of an encoded session that can be stored
-// in a Store. See https://firebase.google.com/docs/firestore/quotas.
+// maxLength is the default maximum length of an encoded, and possibly
+// compressed, session that can be stored in a Store. See
+// https://firebase.google.com/docs/firestore/quotas.
 const maxLength = 2 << 20
 
-// Store is a Firestore-backed sessions store.
+// minIDLength is the minimum number of random bytes in a generated session ID.
+const minIDLength = 16
+
+// maxIDAttempts is the maximum number of IDs generated for a new session when
+// the generated IDs are already in use.
+const maxIDAttempts = 3
+
+// SessionStore is a sessions.Store that can also delete sessions. It is
+// implemented by Store and MemoryStore, so callers can depend on SessionStore
+// and substitute a fake in tests.
+type SessionStore interface {
+	sessions.Store
+	// Delete deletes the session and sets its MaxAge to -1.
+	Delete(r *http.Request, w http.ResponseWriter, session *sessions.Session) error
+}
+
+// Store is a Firestore-backed sessions store. A Store is safe for concurrent
+// use by multiple goroutines.
 type Store struct {
 	client *firestore.Client
+
+	// collection, if set, is the single collection every session is stored
+	// in, regardless of the session name. Sessions are told apart by their
+	// name field.
+	collection string
+	// coll, if set, is the collection every session is stored in, with
+	// NewWithCollection. Like collection, sessions are told apart by their
+	// name field.
+	coll *firestore.CollectionRef
+	// collectionPrefix is prepended to every collection name.
+	collectionPrefix string
+	// idGenerator, if set, generates the IDs of new sessions.
+	idGenerator func() (string, error)
+	// options, if set, are copied into every new session.
+	options *sessions.Options
+	// lifetime is how long sessions last when their MaxAge isn't set. Zero
+	// means sessions never expire.
+	lifetime time.Duration
+	// lifetimes, if set, override lifetime for the sessions with the given
+	// names.
+	lifetimes map[string]time.Duration
+	// sliding is whether loading a session extends its expiry by lifetime.
+	sliding bool
+	// now returns the current time.
+	now func() time.Time
+	// maxLength is the maximum length of an encoded session, or of each
+	// chunk of it if chunking is set.
+	maxLength int
+	// maxValueKeys, if set, is the maximum number of keys in the values of
+	// a session.
+	maxValueKeys int
+	// chunking is whether sessions longer than maxLength are split across
+	// several documents.
+	chunking bool
+	// codec is the name of the codec sessions are encoded with.
+	codec string
+	// codecs are the codecs sessions can be decoded with, by name.
+	codecs map[string]Codec
+	// compress is whether encoded sessions are gzipped.
+	compress bool
+	// compressThreshold is the length an encoded session must exceed to be
+	// gzipped.
+	compressThreshold int
+	// aeads, if set, decrypt encoded sessions. The first also encrypts them.
+	aeads []cipher.AEAD
+	// encryptedKeys, if set, are the keys of the session values that are
+	// encrypted with aeads, with WithNativeFields.
+	encryptedKeys map[string]bool
+	// encrypter and decrypter, if set, wrap and unwrap data keys for
+	// envelope encryption.
+	encrypter Encrypter
+	decrypter Decrypter
+	// idCodecs, if set, encode session IDs sent to clients, and decode the
+	// IDs they send.
+	idCodecs []securecookie.Codec
+	// extractToken, if set, returns the session ID sent with a request,
+	// before falling back to the header named after the session.
+	extractToken func(*http.Request) (string, bool)
+	// cacheTTL is how long loaded and saved sessions are cached. Zero means
+	// sessions aren't cached.
+	cacheTTL time.Duration
+	// cacheSize is the maximum number of cached sessions. Zero means
+	// unbounded.
+	cacheSize int
+	// cacheMode is whether Save writes sessions to Firestore before
+	// returning, or in the background.
+	cacheMode CacheMode
+	// cache, if set, caches sessions for cacheTTL.
+	cache *sessionCache
+	// writeBack, if set, holds the sessions saved with WriteBack until they
+	// are flushed to Firestore.
+	writeBack *writeBackQueue
+	// asyncSave is whether Save writes sessions to Firestore in the
+	// background. async, if set, writes them.
+	asyncSave bool
+	async     *asyncSaver
+	// reads are the reads of sessions in progress, shared by concurrent
+	// loads of the same session, keyed by tenant, name, and ID.
+	readsMu sync.Mutex
+	reads   map[string]*sharedRead
+	// validateBookingID, if set, validates every booking ID a session refers
+	// to before it is saved.
+	validateBookingID func(id string) error
+	// reservedKeys check the type of the session values with their keys
+	// before the session is saved.
+	reservedKeys map[string]func(values map[interface{}]interface{}) error
+	// userIDKey is the key of the session value saved in the userId field of
+	// each document. Empty means no user IDs are saved.
+	userIDKey string
+	// plaintextIndexes is whether the index fields, such as userId, are
+	// written even though the values they copy are encrypted.
+	plaintextIndexes bool
+	// maxSessionsPerUser, if set, is the maximum number of sessions with the
+	// same name a user can have. Saving a session evicts the user's oldest
+	// sessions beyond it.
+	maxSessionsPerUser int
+	// tracer traces operations on sessions.
+	tracer trace.Tracer
+	// metrics, if set, record operations on sessions.
+	metrics *metrics
+	// logger logs errors that aren't returned.
+	logger *slog.Logger
+	// retryAttempts is the maximum number of attempts at loading or saving a
+	// session when Firestore fails with a transient error.
+	retryAttempts int
+	// retryBase is the delay before the first retry. It doubles before each
+	// later retry.
+	retryBase time.Duration
+	// transactional is whether sessions are saved in transactions that merge
+	// concurrent changes.
+	transactional bool
+	// locking is whether saving a session fails if it was saved concurrently.
+	locking bool
+	// timeout, if set, is the deadline for each Firestore read or write made
+	// while loading or saving a session.
+	timeout time.Duration
+	// tenantResolver, if set, returns the tenant ID of a request. Each
+	// tenant's sessions are stored under its own tenant document.
+	tenantResolver func(*http.Request) string
+	// merge is whether saving an existing session only updates its payload,
+	// leaving its expiry alone.
+	merge bool
+	// trackAccess is whether loading a session records when it was
+	// accessed.
+	trackAccess bool
+	// recordClient is whether saving a session records the User-Agent of
+	// the client, and recordIP whether it records its IP address too.
+	recordClient bool
+	recordIP     bool
+	// checksum is whether a checksum of every encoded session is saved.
+	checksum bool
+	// skipUnchanged is whether saving a session whose values haven't changed
+	// since it was loaded or saved is skipped.
+	skipUnchanged bool
+	// beforeSave are called before a session is saved, and can abort the
+	// save. afterSave are called after a session is saved.
+	beforeSave []func(*sessions.Session) error
+	afterSave  []func(*sessions.Session)
+	// onDelete, if set, is called when a session is deleted or found
+	// expired.
+	onDelete func(name, id string, bookingIDs []string)
+	// corruptPolicy is what loading a session that can't be decoded does.
+	corruptPolicy CorruptSessionPolicy
+	// cleanupConcurrency, if set, is the number of documents deleted at a
+	// time by DeleteAll, DeleteExpired, GC sweeps and DeleteByUser, instead
+	// of using a BulkWriter.
+	cleanupConcurrency int
+	// closed is canceled by Close, which stops the GC goroutines. gcMu
+	// guards starting a GC goroutine against closing the Store, and gcs
+	// counts the running GC goroutines.
+	closed context.Context
+	close  context.CancelFunc
+	gcMu   sync.Mutex
+	gcs    sync.WaitGroup
+	// fetch reads the document of a session. It is readDoc, unless replaced
+	// in tests.
+	fetch func(ctx context.Context, name, id string) (*sessionDoc, error)
+	// deleteRef deletes a document with cleanupConcurrency. It deletes ref,
+	// unless replaced in tests.
+	deleteRef func(ctx context.Context, ref *firestore.DocumentRef) error
+	// createRef creates the document of a session saved with a new ID. It
+	// creates ref, unless replaced in tests.
+	createRef func(ctx context.Context, ref *firestore.DocumentRef, encoded *sessionDoc) error
+	// writeRef writes a session saved with WithAsyncSave. It sets ref,
+	// unless replaced in tests.
+	writeRef func(ctx context.Context, ref *firestore.DocumentRef, encoded *sessionDoc) error
 }
 
-var _ sessions.Store = &Store{}
+var _ SessionStore = &Store{}
+
+// expireAtField is the document field holding when a session expires.
+const expireAtField = "expireAt"
+
+// userIDField is the document field holding the ID of the user a session
+// belongs to.
+const userIDField = "userId"
+
+// defaultUserIDKey is the default session value key holding the ID of the user
+// a session belongs to.
+const defaultUserIDKey = "userId"
+
+// chunkOfField is the document field holding the ID of the session a chunk
+// belongs to. See WithChunking.
+const chunkOfField = "chunkOf"
+
+// bookingIDsField is the document field holding the booking IDs of a session.
+const bookingIDsField = "bookingIds"
+
+// bookingIDsKey is the session value key holding the IDs of the bookings a
+// session refers to.
+const bookingIDsKey = "bookingIds"
 
 // sessionDoc wraps an encoded session so it can be saved as a Firestore
 // document.
 type sessionDoc struct {
+	// EncodedSession is the encoded session, if it is valid UTF-8.
 	EncodedSession string
+	// EncodedBytes is the encoded session, if it isn't valid UTF-8.
+	EncodedBytes []byte `firestore:"encodedBytes,omitempty"`
+	// Name is the name of the session, so sessions with different names can
+	// share a collection.
+	Name string `firestore:"name"`
+	// ExpireAt is when the session expires. It is zero for sessions that
+	// never expire.
+	ExpireAt time.Time `firestore:"expireAt,omitempty"`
+	// Codec is the name of the codec the session was encoded with.
+	Codec string `firestore:"codec,omitempty"`
+	// Checksum is the SHA-256 hash of the encoded session, with
+	// WithChecksum.
+	Checksum []byte `firestore:"checksum,omitempty"`
+	// Format is the format of the encoded session. It is zero for sessions
+	// saved before the format was recorded, whose payload has no header.
+	Format int `firestore:"format,omitempty"`
+	// Compressed is whether the encoded session is gzipped.
+	Compressed bool `firestore:"compressed,omitempty"`
+	// Encrypted is whether the encoded session is encrypted.
+	Encrypted bool `firestore:"encrypted,omitempty"`
+	// WrappedKey is the encrypted data key the session was encrypted with,
+	// if it uses envelope encryption.
+	WrappedKey []byte `firestore:"wrappedKey,omitempty"`
+	// Chunks is the number of documents the encoded session is split
+	// across, if it is more than one. See WithChunking.
+	Chunks int `firestore:"chunks,omitempty"`
+	// ChunkOf is the ID of the session whose encoded session this document
+	// holds part of, if it is a chunk after the first. Such documents aren't
+	// sessions themselves.
+	ChunkOf string `firestore:"chunkOf,omitempty"`
+	// Values are the session values, if they are stored as native Firestore
+	// fields rather than encoded. See WithNativeFields.
+	Values map[string]interface{} `firestore:"values,omitempty"`
+	// EncryptedKeys are the keys of Values that are encrypted. See
+	// WithEncryptedKeys.
+	EncryptedKeys []string `firestore:"encryptedKeys,omitempty"`
+	// UserID is the ID of the user the session belongs to, if any. See
+	// WithUserIDKey.
+	UserID string `firestore:"userId,omitempty"`
+	// BookingIDs are the IDs of the bookings the session refers to, if any.
+	BookingIDs []string `firestore:"bookingIds,omitempty"`
+	// Version is incremented every time the session is saved, with
+	// WithOptimisticLocking.
+	Version int64 `firestore:"version,omitempty"`
+	// CreatedAt is when the session was first saved. It is only set when a
+	// new session is saved, and is otherwise left as stored. See setMerge.
+	CreatedAt time.Time `firestore:"createdAt,omitempty"`
+	// UpdatedAt is when the session was last saved.
+	UpdatedAt time.Time `firestore:"updatedAt,omitempty"`
+	// LastAccessedAt is when the session was last loaded or saved, with
+	// WithAccessTracking.
+	LastAccessedAt time.Time `firestore:"lastAccessedAt,omitempty"`
+	// ClientIP and UserAgent are the IP address and User-Agent of the
+	// client the session was last saved for, with WithClientMetadata. They
+	// are only set when a session is saved for a request.
+	ClientIP  string `firestore:"clientIp,omitempty"`
+	UserAgent string `firestore:"userAgent,omitempty"`
+	// CreatedIP and CreatedUserAgent are the IP address and User-Agent of
+	// the client the session was first saved for, with WithClientMetadata.
+	CreatedIP        string `firestore:"createdIp,omitempty"`
+	CreatedUserAgent string `firestore:"createdUserAgent,omitempty"`
+}
+
+// setPayload sets the encoded session. Firestore strings must be valid UTF-8,
+// so other encodings are stored as bytes.
+func (d *sessionDoc) setPayload(b []byte) {
+	if utf8.Valid(b) {
+		d.EncodedSession = string(b)
+		return
+	}
+	d.EncodedBytes = b
+}
+
+// payload returns the encoded session.
+func (d *sessionDoc) payload() []byte {
+	if d.EncodedBytes != nil {
+		return d.EncodedBytes
+	}
+	return []byte(d.EncodedSession)
 }
 
-// New creates a new Store.
+// New creates a new Store. Calling New without any Options gives a Store
+// with the default behavior described in the package documentation.
+//
+// With the default JSONCodec, only string key values are supported for
+// sessions.
 //
-// Only string key values are supported for sessions.
-func New(ctx context.Context, client *firestore.Client) (*Store, error) {
-	return &Store{
-		client: client,
-	}, nil
+// Sessions are stored in the database of client, so a client created with
+// firestore.NewClientWithDatabase keeps them in that named database rather
+// than in the (default) one.
+func New(ctx context.Context, client *firestore.Client, opts ...Option) (*Store, error) {
+	s := &Store{
+		client:        client,
+		now:           time.Now,
+		maxLength:     maxLength,
+		userIDKey:     defaultUserIDKey,
+		tracer:        noopTracer,
+		logger:        slog.New(discardHandler{}),
+		retryAttempts: 1,
+		codec:         codecJSON,
+		codecs: map[string]Codec{
+			codecJSON:    JSONCodec{},
+			codecMsgpack: MsgpackCodec{},
+			codecGob:     GobCodec{},
+		},
+		reads: map[string]*sharedRead{},
+	}
+	s.reservedKeys = map[string]func(map[interface{}]interface{}) error{
+		bookingIDsKey: func(values map[interface{}]interface{}) error {
+			_, err := extractBookingIDs(values)
+			return err
+		},
+	}
+	s.closed, s.close = context.WithCancel(context.Background())
+	s.fetch = s.readDoc
+	s.deleteRef = func(ctx context.Context, ref *firestore.DocumentRef) error {
+		_, err := ref.Delete(ctx)
+		return err
+	}
+	s.createRef = func(ctx context.Context, ref *firestore.DocumentRef, encoded *sessionDoc) error {
+		_, err := ref.Create(ctx, encoded)
+		return err
+	}
+	s.writeRef = func(ctx context.Context, ref *firestore.DocumentRef, encoded *sessionDoc) error {
+		data, merge := setMerge(encoded)
+		_, err := ref.Set(ctx, data, merge)
+		return err
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	if s.sliding && s.lifetime == 0 && len(s.lifetimes) == 0 {
+		return nil, fmt.Errorf("WithSlidingExpiration requires WithSessionLifetime or WithTTLByName")
+	}
+	if s.codec == codecNative && (s.compress || (len(s.aeads) > 0 && len(s.encryptedKeys) == 0) || s.encrypter != nil || s.chunking) {
+		return nil, fmt.Errorf("WithNativeFields can't be used with compression, encryption, or chunking")
+	}
+	if len(s.encryptedKeys) > 0 && (s.codec != codecNative || len(s.aeads) == 0) {
+		return nil, fmt.Errorf("WithEncryptedKeys requires WithNativeFields and WithEncryptionKey")
+	}
+	if s.transactional && s.chunking {
+		return nil, fmt.Errorf("WithTransactionalSave can't be used with WithChunking")
+	}
+	if s.locking && (s.transactional || s.chunking) {
+		return nil, fmt.Errorf("WithOptimisticLocking can't be used with WithTransactionalSave or WithChunking")
+	}
+	if s.merge && (s.transactional || s.locking || s.chunking) {
+		return nil, fmt.Errorf("WithMergeSave can't be used with WithTransactionalSave, WithOptimisticLocking, or WithChunking")
+	}
+	if s.maxSessionsPerUser > 0 && s.userIDKey == "" {
+		return nil, fmt.Errorf("WithMaxSessionsPerUser requires a user ID key")
+	}
+	if s.maxSessionsPerUser > 0 && !s.indexed(s.userIDKey) {
+		return nil, fmt.Errorf("WithMaxSessionsPerUser requires WithPlaintextIndexes when sessions are encrypted")
+	}
+	if s.coll != nil && (s.collection != "" || s.collectionPrefix != "" || s.tenantResolver != nil) {
+		return nil, fmt.Errorf("NewWithCollection can't be used with WithCollection, WithCollectionPrefix, or WithTenantResolver")
+	}
+	if s.cacheSize > 0 && s.cacheTTL == 0 {
+		return nil, fmt.Errorf("WithCacheSize requires WithCacheTTL")
+	}
+	if s.cacheMode == WriteBack && s.cacheTTL == 0 {
+		return nil, fmt.Errorf("WithCacheMode(WriteBack) requires WithCacheTTL")
+	}
+	if s.cacheMode == WriteBack && (s.transactional || s.locking || s.chunking || s.merge) {
+		return nil, fmt.Errorf("WithCacheMode(WriteBack) can't be used with WithTransactionalSave, WithOptimisticLocking, WithChunking, or WithMergeSave")
+	}
+	if s.asyncSave && s.cacheTTL == 0 {
+		return nil, fmt.Errorf("WithAsyncSave requires WithCacheTTL")
+	}
+	if s.asyncSave && (s.cacheMode == WriteBack || s.transactional || s.locking || s.chunking || s.merge) {
+		return nil, fmt.Errorf("WithAsyncSave can't be used with WithCacheMode(WriteBack), WithTransactionalSave, WithOptimisticLocking, WithChunking, or WithMergeSave")
+	}
+	if s.cacheTTL > 0 {
+		s.cache = newSessionCache(s.cacheTTL, s.cacheSize, func() time.Time { return s.now() })
+	}
+	if s.cacheMode == WriteBack {
+		s.writeBack = newWriteBackQueue()
+		go s.flushLoop()
+	}
+	if s.asyncSave {
+		s.startAsyncSaver()
+	}
+	return s, nil
+}
+
+// NewWithCollection creates a new Store that keeps every session in coll,
+// whatever its name, rather than in a collection named after it, such as to
+// store sessions in a nested collection or a named database. client must be
+// the client coll belongs to, which is used for transactions and batched
+// writes. As with WithCollection, sessions with different names are told
+// apart by their name field.
+//
+// NewWithCollection can't be used with WithCollection, WithCollectionPrefix,
+// or WithTenantResolver.
+func NewWithCollection(ctx context.Context, client *firestore.Client, coll *firestore.CollectionRef, opts ...Option) (*Store, error) {
+	if coll == nil {
+		return nil, fmt.Errorf("NewWithCollection: nil collection")
+	}
+	setColl := func(s *Store) error {
+		s.coll = coll
+		return nil
+	}
+	return New(ctx, client, append(opts[:len(opts):len(opts)], setColl)...)
+}
+
+// NewWithClock creates a new Store that gets the current time from now, such
+// as a frozen clock in tests, like New with WithClock. Every expiry, timestamp,
+// and cache TTL uses now; only latency metrics and trace spans use the real
+// time.
+func NewWithClock(ctx context.Context, client *firestore.Client, now func() time.Time, opts ...Option) (*Store, error) {
+	return New(ctx, client, append([]Option{WithClock(now)}, opts...)...)
 }
 
 // Get returns a cached session, if it exists. Otherwise, Get returns a new
 // session.
 //
-// The name is used as the Firestore collection name, so
-// different apps in the same Google Cloud project should use different names.
+// Sessions are cached for the lifetime of the request, in the
+// gorilla/sessions registry. The first Get for a request calls New, which
+// reads the session from Firestore, unless WithCacheTTL is used.
+//
+// Unless WithCollection is used, the name is used as the Firestore collection
+// name, so different apps in the same Google Cloud project should use
+// different names.
 func (s *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
 	return sessions.GetRegistry(r).Get(s, name)
 }
 
 // New creates and returns a new session.
 //
-// If the session already exists, it will be returned.
+// If the session already exists, it will be returned. If the request has no
+// session ID, or the session doesn't exist or has expired, New returns a new
+// session, with IsNew set, and a nil error. If the session can't be read, such
+// as when Firestore is unavailable, New returns the error with a new session,
+// as gorilla/sessions stores do, so a failure is never mistaken for a new
+// user.
 //
-// The name is used as the Firestore collection name, so
-// different apps in the same Google Cloud project should use different names.
-func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
-	session := sessions.NewSession(s, name)
+// Unless WithCollection is used, the name is used as the Firestore collection
+// name, so different apps in the same Google Cloud project should use
+// different names.
+func (s *Store) New(r *http.Request, name string) (_ *sessions.Session, err error) {
+	start := time.Now()
+	ctx, span := s.startSpan(r.Context(), "New", name)
+	defer func() {
+		endSpan(span, err)
+		s.metrics.observe(opGet, start, err)
+	}()
+
+	session := s.newSession(s, name)
+	if ctx, err = s.tenantContext(ctx, r); err != nil {
+		return session, err
+	}
 
 	// Ignore errors in case the header is not present.
 	id, _ := s.readIDFromHeader(r, name)
@@ -83,112 +540,1030 @@ func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
 		session.IsNew = true
 		return session, nil
 	}
+	session, err = s.loadByID(ctx, session, id)
+	if errors.Is(err, ErrSessionNotFound) {
+		// A missing session means the session is new.
+		session.IsNew = true
+		return session, nil
+	}
+	return session, err
+}
+
+// loadByID loads the session with the ID into session, from the cache or
+// Firestore. It returns an error wrapping ErrSessionNotFound if the session
+// doesn't exist.
+func (s *Store) loadByID(ctx context.Context, session *sessions.Session, id string) (*sessions.Session, error) {
+	name := session.Name()
+	ref := s.collectionRef(ctx, name).Doc(id)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String(attrDocument, ref.Path))
+	if encoded, ok := s.writeBack.get(s.cacheKey(ctx, name, id)); ok && !s.expired(encoded) {
+		return s.load(ctx, session, ref, encoded)
+	}
+	if encoded, ok := s.cache.get(s.cacheKey(ctx, name, id)); ok && !s.expired(encoded) {
+		return s.load(ctx, session, ref, encoded)
+	}
 
 	// ID found, check if the session already exists.
-	ds, err := s.client.Collection(name).Doc(id).Get(r.Context())
+	encoded, err := s.sharedFetch(ctx, name, id)
+	if err != nil {
+		return session, err
+	}
+	return s.load(ctx, session, ref, encoded)
+}
+
+// sharedRead is a read of a session shared by concurrent loads of it.
+type sharedRead struct {
+	// waiters is the number of loads waiting for the read, guarded by
+	// Store.readsMu.
+	waiters int
+	cancel  context.CancelFunc
+	// done is closed once doc and err are set.
+	done chan struct{}
+	doc  *sessionDoc
+	err  error
+}
+
+// sharedFetch fetches the document of the session with the given name and ID,
+// sharing the read with concurrent loads of the same session. The read isn't
+// canceled with the context of whichever load started it, so it doesn't fail
+// the others, but once every load waiting for it has given up, it is canceled.
+func (s *Store) sharedFetch(ctx context.Context, name, id string) (*sessionDoc, error) {
+	key := tenantFromContext(ctx) + "/" + name + "/" + id
+	s.readsMu.Lock()
+	rd, ok := s.reads[key]
+	if !ok {
+		readCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		rd = &sharedRead{cancel: cancel, done: make(chan struct{})}
+		s.reads[key] = rd
+		go func() {
+			defer cancel()
+			err := s.retry(readCtx, func() (err error) {
+				ctx, cancel := s.withTimeout(readCtx)
+				defer cancel()
+				rd.doc, err = s.fetch(ctx, name, id)
+				return err
+			})
+			s.readsMu.Lock()
+			if s.reads[key] == rd {
+				delete(s.reads, key)
+			}
+			s.readsMu.Unlock()
+			rd.err = err
+			close(rd.done)
+		}()
+	}
+	rd.waiters++
+	s.readsMu.Unlock()
+
+	select {
+	case <-rd.done:
+		return rd.doc, rd.err
+	case <-ctx.Done():
+		s.readsMu.Lock()
+		rd.waiters--
+		if rd.waiters == 0 {
+			rd.cancel()
+			// Later loads start a new read, rather than join this one.
+			if s.reads[key] == rd {
+				delete(s.reads, key)
+			}
+		}
+		s.readsMu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops the garbage collection goroutines started by StartGC, waiting for
+// them to exit, flushes any sessions saved with WriteBack, waits for the
+// sessions saved with WithAsyncSave to be written, and empties the cache. It
+// returns the error of the flush, if any. The Store must not be used after
+// Close.
+//
+// Close doesn't close the Firestore client passed to New, which belongs to the
+// caller and may be shared with other code. Close the client after closing
+// every Store that uses it.
+func (s *Store) Close() error {
+	s.gcMu.Lock()
+	s.close()
+	s.gcMu.Unlock()
+	s.gcs.Wait()
+	var err error
+	if s.writeBack != nil {
+		<-s.writeBack.done
+		s.writeBack.close()
+		err = s.Flush(context.Background())
+	}
+	s.async.close()
+	s.cache.clear()
+	return err
+}
+
+// newSession returns a new session with the given name for store, with the
+// default options of s.
+func (s *Store) newSession(store sessions.Store, name string) *sessions.Session {
+	session := sessions.NewSession(store, name)
+	if s.options != nil {
+		opts := *s.options
+		session.Options = &opts
+	}
+	if lifetime := s.lifetimeFor(name); lifetime > 0 && session.Options.MaxAge == 0 {
+		session.Options.MaxAge = int(lifetime / time.Second)
+	}
+	return session
+}
+
+// readDoc reads the document of the session with the given name and ID,
+// including any chunks. It returns an error wrapping ErrSessionNotFound if the
+// session doesn't exist, belongs to a session with a different name, is a chunk
+// of another session, or has expired, in which case it is deleted.
+func (s *Store) readDoc(ctx context.Context, name, id string) (*sessionDoc, error) {
+	ds, err := s.collectionRef(ctx, name).Doc(id).Get(ctx)
 	if status.Code(err) == codes.NotFound {
-		// A NotFound error means the session is new.
-		session.IsNew = true
-		return session, nil
+		return nil, fmt.Errorf("Get: %w", ErrSessionNotFound)
 	}
 	if err != nil {
-		return session, fmt.Errorf("Get: %v", err)
+		return nil, fmt.Errorf("Get: %w", err)
 	}
 
 	// The session was found, get it.
-	encoded := sessionDoc{}
-	if err := ds.DataTo(&encoded); err != nil {
-		return session, fmt.Errorf("DataTo: %v", err)
+	encoded := &sessionDoc{}
+	if err := ds.DataTo(encoded); err != nil {
+		return nil, fmt.Errorf("DataTo: %w", err)
+	}
+	if encoded.ChunkOf != "" {
+		// The ID is that of a chunk of another session, not a session.
+		return nil, fmt.Errorf("Get: %w", ErrSessionNotFound)
 	}
-	cachedSession, err := s.deserialize(encoded.EncodedSession)
+	if s.shared() && encoded.Name != name {
+		// The ID belongs to a session with a different name in the shared
+		// collection, so this session is new.
+		return nil, ErrSessionNotFound
+	}
+	if s.expired(encoded) {
+		// An expired session is treated as missing. Only delete it if it
+		// hasn't been updated since it was read. Only log errors, an expired
+		// document is deleted again the next time it is loaded.
+		_, err := ds.Ref.Delete(ctx, firestore.LastUpdateTime(ds.UpdateTime))
+		switch {
+		case status.Code(err) == codes.FailedPrecondition:
+			// The session was saved again since it was read.
+		case err != nil:
+			s.logger.Warn("deleting expired session", "document", ds.Ref.Path, "error", err)
+		default:
+			if err := s.deleteChunks(ctx, name, id, encoded.Chunks); err != nil {
+				s.logger.Warn("deleting chunks of expired session", "document", ds.Ref.Path, "error", err)
+			}
+			s.notifyDelete(name, id, encoded.BookingIDs)
+		}
+		s.cache.remove(s.cacheKey(ctx, name, id))
+		return nil, ErrSessionNotFound
+	}
+	if err := s.loadChunks(ctx, name, id, encoded); err != nil {
+		return nil, err
+	}
+	return encoded, nil
+}
+
+// load decodes the session stored in encoded, in the document ref, into
+// session and caches it.
+func (s *Store) load(ctx context.Context, session *sessions.Session, ref *firestore.DocumentRef, encoded *sessionDoc) (*sessions.Session, error) {
+	values, err := s.deserialize(ctx, encoded)
 	if err != nil {
-		return session, err
+		return s.loadCorrupt(ctx, session, ref, encoded, err)
 	}
-	session.ID = cachedSession.ID
-	session.Values = cachedSession.Values
+	session.ID = ref.ID
+	session.Values = values
 	session.IsNew = false
+	if s.transactional {
+		if err := s.setBaseValues(ctx, session, encoded); err != nil {
+			return session, err
+		}
+	}
+	if s.locking {
+		session.Values[versionKey] = encoded.Version
+	}
+	if s.skipUnchanged {
+		s.setFingerprint(session)
+	}
+
+	if s.sliding && s.lifetimeFor(session.Name()) > 0 {
+		ctx, cancel := s.withTimeout(ctx)
+		defer cancel()
+		expireAt, err := s.extend(ctx, session.Name(), ref.ID, encoded.Chunks)
+		if err != nil {
+			return session, err
+		}
+		d := *encoded
+		d.ExpireAt = expireAt
+		encoded = &d
+	} else if s.trackAccess {
+		// Only log errors, the access is recorded again the next time the
+		// session is loaded.
+		if err := s.recordAccess(ctx, ref); err != nil {
+			s.logger.Warn("recording session access", "document", ref.Path, "error", err)
+		}
+	}
+	s.cache.put(s.cacheKey(ctx, session.Name(), ref.ID), encoded)
 
 	return session, nil
 }
 
 // Save persists the session to Firestore.
-func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+//
+// session.Options.MaxAge sets when the session expires. If it is positive, the
+// session expires MaxAge seconds after it is saved. If it is zero, the session
+// never expires, unless WithSessionLifetime is used. If it is negative, Save
+// deletes the session instead, like Delete.
+//
+// A session saved with a newly generated ID never overwrites another session:
+// if the ID is already in use, Save generates another, and fails with an
+// AlreadyExists error after a few attempts. With write-back or asynchronous
+// saves, this means the first save of a new session is written before Save
+// returns.
+//
+// Save never sets a cookie, since the session ID is sent in the header named
+// after the session, so MaxAge only sets when the stored session expires.
+// With WithSecureCookie, Save sends the encoded session ID in that response
+// header.
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) (err error) {
+	start := time.Now()
+	ctx, span := s.startSpan(r.Context(), "Save", session.Name())
+	defer func() {
+		endSpan(span, err)
+		s.metrics.observe(opSave, start, err)
+	}()
+
+	if session.Options != nil && session.Options.MaxAge < 0 {
+		return s.Delete(r, w, session)
+	}
+	if ctx, err = s.tenantContext(ctx, r); err != nil {
+		return err
+	}
+	ctx = s.clientContext(ctx, r)
+	// Ignore errors in case the session is not set yet
+	headerID, _ := s.readIDFromHeader(r, session.Name())
+	if err := s.save(ctx, session, headerID); err != nil {
+		return err
+	}
+	if len(s.idCodecs) > 0 && w != nil {
+		return s.writeID(w, session.Name(), session.ID)
+	}
+	return nil
+}
+
+// save saves the session. Sessions without an ID are saved with headerID, the
+// ID in the request, if any, or a new ID.
+func (s *Store) save(ctx context.Context, session *sessions.Session, headerID string) (err error) {
+	if err := s.runBeforeSave(session); err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			s.runAfterSave(session)
+		}
+	}()
+	if s.skipUnchanged {
+		if session.ID != "" && s.unchanged(session) {
+			return nil
+		}
+		defer func() {
+			if err == nil {
+				s.setFingerprint(session)
+			}
+		}()
+	}
+
+	if s.maxSessionsPerUser > 0 {
+		defer func() {
+			// Only log errors, the next save of one of the user's
+			// sessions evicts them again.
+			if err == nil {
+				if err := s.evictUserSessions(ctx, session); err != nil {
+					s.logger.Warn("evicting user sessions", "collection", s.collectionRef(ctx, session.Name()).Path, "error", err)
+				}
+			}
+		}()
+	}
+
 	id := session.ID
 	if id == "" {
-		// Ignore errors in case the session is not set yet
-		id, _ = s.readIDFromHeader(r, session.Name())
+		id = headerID
 	}
+	// generated is whether the ID is new, so the session must not overwrite
+	// a document with the same ID.
+	generated := false
 	if id == "" {
-		id = s.client.Collection(session.Name()).NewDoc().ID
+		var err error
+		if id, err = s.newID(ctx, session.Name()); err != nil {
+			return err
+		}
+		generated = true
 	}
 
 	session.ID = id
-	sessionString, err := s.serialize(session)
+	if generated {
+		return s.saveNew(ctx, session)
+	}
+	return s.saveDoc(ctx, session, s.collectionRef(ctx, session.Name()).Doc(id), false)
+}
+
+// saveDoc saves the session in the document ref. If create is set, the session
+// has a newly generated ID, so the document is created rather than
+// overwritten, and the save fails with codes.AlreadyExists if it exists.
+func (s *Store) saveDoc(ctx context.Context, session *sessions.Session, ref *firestore.DocumentRef, create bool) error {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String(attrDocument, ref.Path))
+	if s.transactional {
+		return s.saveTransaction(ctx, session, ref, create)
+	}
+	encoded, err := s.encode(ctx, session)
+	if err != nil {
+		return err
+	}
+	if s.locking {
+		return s.saveVersioned(ctx, session, ref, encoded, create)
+	}
+
+	k := s.cacheKey(ctx, session.Name(), ref.ID)
+	written := func() *sessionDoc { return encoded }
+	if s.chunking {
+		chunks := splitChunks(encoded, s.maxLength)
+		if err := s.retrySave(ctx, create, session.Name(), ref, written, func() error {
+			ctx, cancel := s.withTimeout(ctx)
+			defer cancel()
+			return s.saveChunks(ctx, session.Name(), ref.ID, chunks, create)
+		}); err != nil {
+			s.cache.remove(k)
+			return err
+		}
+		s.cache.put(k, encoded)
+		return nil
+	}
+	if s.merge && !create && !session.IsNew {
+		return s.saveMerge(ctx, session, ref, encoded)
+	}
+	// New sessions are written straight away, rather than queued, so an ID
+	// collision is found while the session can still get another ID. So are
+	// sessions saved after Close, since nothing would flush them.
+	if s.writeBack != nil && !create && s.writeBack.put(k, pendingWrite{ref: ref, doc: encoded}) {
+		s.cache.put(k, encoded)
+		return nil
+	}
+	if s.async != nil && !create {
+		// Cache the session first, so loads don't read the stored session
+		// while the save is queued.
+		s.cache.put(k, encoded)
+		if s.enqueueSave(k, ref, encoded) {
+			return nil
+		}
+	}
+	if err := s.retrySave(ctx, create, session.Name(), ref, written, func() error {
+		ctx, cancel := s.withTimeout(ctx)
+		defer cancel()
+		if create {
+			return s.createRef(ctx, ref, encoded)
+		}
+		data, merge := setMerge(encoded)
+		_, err := ref.Set(ctx, data, merge)
+		return err
+	}); err != nil {
+		s.cache.remove(k)
+		return fmt.Errorf("Create: %w", err)
+	}
+	s.cache.put(k, encoded)
+
+	return nil
+}
+
+// saveNew saves the session with a newly generated ID, without overwriting an
+// existing document. If a document with the ID already exists, the session is
+// saved with another new ID instead, up to maxIDAttempts times.
+func (s *Store) saveNew(ctx context.Context, session *sessions.Session) error {
+	for attempt := 1; ; attempt++ {
+		ref := s.collectionRef(ctx, session.Name()).Doc(session.ID)
+		err := s.saveDoc(ctx, session, ref, true)
+		if status.Code(err) != codes.AlreadyExists || attempt == maxIDAttempts {
+			return err
+		}
+		s.logger.Warn("session ID collision, retrying with a new ID", "document", ref.Path)
+		id, err := s.newID(ctx, session.Name())
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+}
+
+// encode serializes the session into a sessionDoc, with its metadata set.
+func (s *Store) encode(ctx context.Context, session *sessions.Session) (*sessionDoc, error) {
+	if err := s.checkReservedKeys(session.Values); err != nil {
+		return nil, err
+	}
+	encoded, err := s.serialize(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	encoded.Name = session.Name()
+	encoded.ExpireAt = s.expireAt(session)
+	now := s.now()
+	encoded.UpdatedAt = now
+	if session.IsNew {
+		encoded.CreatedAt = now
+	}
+	if s.trackAccess {
+		encoded.LastAccessedAt = now
+	}
+	if c := clientFromContext(ctx); c != (client{}) {
+		encoded.ClientIP, encoded.UserAgent = c.ip, c.userAgent
+		if session.IsNew {
+			encoded.CreatedIP, encoded.CreatedUserAgent = c.ip, c.userAgent
+		}
+	}
+	if s.userIDKey != "" && s.indexed(s.userIDKey) {
+		// Only string user IDs are saved.
+		encoded.UserID, _ = session.Values[s.userIDKey].(string)
+	}
+	bookingIDs, err := extractBookingIDs(session.Values)
+	if s.validateBookingID != nil {
+		if err != nil {
+			return nil, err
+		}
+		for _, bookingID := range bookingIDs {
+			if err := s.validateBookingID(bookingID); err != nil {
+				return nil, fmt.Errorf("invalid booking ID %q: %w", bookingID, err)
+			}
+		}
+	}
+	// If WithReservedKey allows booking IDs of another type, they aren't
+	// indexed, but are still saved.
+	if s.indexed(bookingIDsKey) {
+		encoded.BookingIDs = bookingIDs
+	}
+	return encoded, nil
+}
+
+// checkReservedKeys returns an error wrapping ErrReservedKey if a reserved key
+// of values has the wrong type. Keys are checked in order, so the error is
+// always about the same key.
+func (s *Store) checkReservedKeys(values map[interface{}]interface{}) error {
+	keys := make([]string, 0, len(s.reservedKeys))
+	for k := range s.reservedKeys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := s.reservedKeys[k](values); err != nil {
+			return fmt.Errorf("%w: %w", ErrReservedKey, err)
+		}
+	}
+	return nil
+}
+
+// Delete deletes the session from Firestore and sets its MaxAge to -1.
+// Deleting a session that was never saved is not an error.
+func (s *Store) Delete(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	ctx, err := s.tenantContext(r.Context(), r)
 	if err != nil {
 		return err
 	}
-	encoded := sessionDoc{EncodedSession: sessionString}
+	// Ignore errors in case the session is not set yet
+	headerID, _ := s.readIDFromHeader(r, session.Name())
+	return s.delete(ctx, session, headerID)
+}
+
+// delete deletes the session. Sessions without an ID are deleted by headerID,
+// the ID in the request, if any.
+func (s *Store) delete(ctx context.Context, session *sessions.Session, headerID string) error {
+	id := session.ID
+	if id == "" {
+		id = headerID
+	}
+	if session.Options == nil {
+		session.Options = &sessions.Options{}
+	}
+	session.Options.MaxAge = -1
+	if id == "" {
+		return nil
+	}
+	// Booking IDs of the wrong type are left out.
+	bookingIDs, _ := extractBookingIDs(session.Values)
+	deleted, err := s.deleteDoc(ctx, session.Name(), id)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		s.notifyDelete(session.Name(), id, bookingIDs)
+	}
+	return nil
+}
+
+// deleteDoc deletes the document of the session with the given name and ID,
+// and any chunks, and removes it from the cache. With WithOnDelete, it reports
+// whether the session existed. Otherwise, it always reports true.
+func (s *Store) deleteDoc(ctx context.Context, name, id string) (bool, error) {
+	s.cache.remove(s.cacheKey(ctx, name, id))
+	if s.writeBack != nil {
+		// Hold off flushes, so a pending save can't recreate the session
+		// after it is deleted.
+		s.writeBack.flushMu.Lock()
+		defer s.writeBack.flushMu.Unlock()
+		s.writeBack.remove(s.cacheKey(ctx, name, id))
+	}
+	// Let pending asynchronous saves finish, so they can't recreate the
+	// session after it is deleted.
+	if err := s.waitAsyncSaves(ctx, s.cacheKey(ctx, name, id)); err != nil {
+		return false, err
+	}
 
-	if _, err := s.client.Collection(session.Name()).Doc(id).Set(r.Context(), encoded); err != nil {
-		return fmt.Errorf("Create: %v", err)
+	ref := s.collectionRef(ctx, name).Doc(id)
+	chunks := 0
+	if s.chunking {
+		ds, err := ref.Get(ctx)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return false, fmt.Errorf("Get: %w", err)
+		}
+		if err == nil {
+			encoded := sessionDoc{}
+			if err := ds.DataTo(&encoded); err != nil {
+				return false, fmt.Errorf("DataTo: %w", err)
+			}
+			chunks = encoded.Chunks
+		}
+	}
+	// With WithOnDelete, only delete sessions that exist, so the callback
+	// is called once per session.
+	var preconds []firestore.Precondition
+	if s.onDelete != nil {
+		preconds = append(preconds, firestore.Exists)
+	}
+	_, err := ref.Delete(ctx, preconds...)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Delete: %w", err)
 	}
+	if err := s.deleteChunks(ctx, name, id, chunks); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetByID loads the session with the given name and ID, such as in a
+// background job with no request. Unlike New, it returns an error wrapping
+// ErrSessionNotFound if the session doesn't exist, rather than a new session.
+// The tenant of the session, if any, is the tenant in ctx. See WithTenant.
+func (s *Store) GetByID(ctx context.Context, name, id string) (_ *sessions.Session, err error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "GetByID", name)
+	defer func() {
+		endSpan(span, err)
+		s.metrics.observe(opGet, start, err)
+	}()
 
+	if err := s.checkTenant(ctx); err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, fmt.Errorf("GetByID: %w: empty ID", ErrSessionNotFound)
+	}
+	session, err := s.loadByID(ctx, s.newSession(s, name), id)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// SaveByID saves the session, which must have the given name, like Save, but
+// without a request or response. Sessions without an ID are saved with a new
+// ID. The tenant of the session, if any, is the tenant in ctx. See WithTenant.
+func (s *Store) SaveByID(ctx context.Context, name string, session *sessions.Session) (err error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "SaveByID", name)
+	defer func() {
+		endSpan(span, err)
+		s.metrics.observe(opSave, start, err)
+	}()
+
+	if err := s.checkTenant(ctx); err != nil {
+		return err
+	}
+	if session.Name() != name {
+		return fmt.Errorf("SaveByID: session is named %q, not %q", session.Name(), name)
+	}
+	if session.Options != nil && session.Options.MaxAge < 0 {
+		return s.delete(ctx, session, "")
+	}
+	return s.save(ctx, session, "")
+}
+
+// Touch extends the expiry of the session with the given name and ID to the
+// session lifetime from now, without loading or saving the session. It
+// requires WithSessionLifetime or a lifetime for the name set by
+// WithTTLByName, and returns an error wrapping ErrSessionNotFound if the
+// session doesn't exist.
+func (s *Store) Touch(ctx context.Context, name, id string) error {
+	if err := s.checkTenant(ctx); err != nil {
+		return err
+	}
+	if s.lifetimeFor(name) == 0 {
+		return fmt.Errorf("Touch requires WithSessionLifetime or WithTTLByName")
+	}
+	chunks := 0
+	if s.chunking {
+		ds, err := s.collectionRef(ctx, name).Doc(id).Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			return fmt.Errorf("Get: %w: %w", ErrSessionNotFound, err)
+		}
+		if err != nil {
+			return fmt.Errorf("Get: %w", err)
+		}
+		encoded := sessionDoc{}
+		if err := ds.DataTo(&encoded); err != nil {
+			return fmt.Errorf("DataTo: %w", err)
+		}
+		if encoded.ChunkOf != "" {
+			return fmt.Errorf("Get: %w", ErrSessionNotFound)
+		}
+		chunks = encoded.Chunks
+	}
+	s.cache.remove(s.cacheKey(ctx, name, id))
+	_, err := s.extend(ctx, name, id, chunks)
+	return err
+}
+
+// extend sets the expiry of the session with the given name and ID, stored in
+// the given number of chunks, to the session lifetime from now. Only expireAt,
+// and lastAccessedAt with WithAccessTracking, are updated, so concurrent
+// changes to the session aren't overwritten.
+func (s *Store) extend(ctx context.Context, name, id string, chunks int) (time.Time, error) {
+	now := s.now()
+	expireAt := now.Add(s.lifetimeFor(name))
+	updates := []firestore.Update{{Path: expireAtField, Value: expireAt}}
+	if s.trackAccess {
+		updates = append(updates, firestore.Update{Path: lastAccessedAtField, Value: now})
+	}
+	_, err := s.collectionRef(ctx, name).Doc(id).Update(ctx, updates)
+	if status.Code(err) == codes.NotFound {
+		return time.Time{}, fmt.Errorf("Update: %w: %w", ErrSessionNotFound, err)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Update: %w", err)
+	}
+	if err := s.extendChunks(ctx, name, id, chunks, expireAt); err != nil {
+		return time.Time{}, err
+	}
+	return expireAt, nil
+}
+
+// Exists reports whether the session with the given name and ID exists and
+// hasn't expired. Unlike New, it only reads the expireAt field of the session's
+// document, so the session isn't decoded. No session has an empty ID.
+func (s *Store) Exists(ctx context.Context, name, id string) (bool, error) {
+	if err := s.checkTenant(ctx); err != nil {
+		return false, err
+	}
+	if id == "" {
+		return false, nil
+	}
+	if encoded, ok := s.cache.get(s.cacheKey(ctx, name, id)); ok && !s.expired(encoded) {
+		return true, nil
+	}
+	ref := s.collectionRef(ctx, name).Doc(id)
+	docs, err := s.query(ctx, name).Where(firestore.DocumentID, "==", ref).Select(expireAtField, chunkOfField).Documents(ctx).GetAll()
+	if err != nil {
+		return false, fmt.Errorf("GetAll: %w", err)
+	}
+	if len(docs) == 0 {
+		return false, nil
+	}
+	encoded := sessionDoc{}
+	if err := docs[0].DataTo(&encoded); err != nil {
+		return false, fmt.Errorf("DataTo: %w", err)
+	}
+	return encoded.ChunkOf == "" && !s.expired(&encoded), nil
+}
+
+// extractBookingIDs returns the booking IDs in the bookingIds value of a
+// session. They are usually a []string, but sessions decoded by most codecs
+// hold a []interface{} instead. It returns an error if the value has any other
+// type.
+func extractBookingIDs(values map[interface{}]interface{}) ([]string, error) {
+	ids, _, err := value[[]string](values, bookingIDsKey)
+	return ids, err
+}
+
+// AddBookingID adds the booking ID to the bookingIds value of the session,
+// unless it is already there. It returns an error if the value has the wrong
+// type, rather than overwriting it.
+func AddBookingID(session *sessions.Session, id string) error {
+	ids, err := extractBookingIDs(session.Values)
+	if err != nil {
+		return err
+	}
+	for _, existing := range ids {
+		if existing == id {
+			return nil
+		}
+	}
+	session.Values[bookingIDsKey] = append(append([]string(nil), ids...), id)
 	return nil
 }
 
-// readIDFromHeader get the ID from a header
+// RemoveBookingID removes the booking ID from the bookingIds value of the
+// session, and reports whether it was there. It returns an error if the value
+// has the wrong type.
+func RemoveBookingID(session *sessions.Session, id string) (bool, error) {
+	ids, err := extractBookingIDs(session.Values)
+	if err != nil {
+		return false, err
+	}
+	kept := make([]string, 0, len(ids))
+	for _, existing := range ids {
+		if existing != id {
+			kept = append(kept, existing)
+		}
+	}
+	if len(kept) == len(ids) {
+		return false, nil
+	}
+	session.Values[bookingIDsKey] = kept
+	return true, nil
+}
+
+// expireAt returns when the session expires, based on its MaxAge or the
+// lifetime of sessions with its name, or the zero time if it never expires.
+func (s *Store) expireAt(session *sessions.Session) time.Time {
+	if session.Options != nil && session.Options.MaxAge > 0 {
+		return s.now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	}
+	if lifetime := s.lifetimeFor(session.Name()); lifetime > 0 {
+		return s.now().Add(lifetime)
+	}
+	return time.Time{}
+}
+
+// lifetimeFor returns the lifetime of the sessions with the given name: the
+// one set by WithTTLByName, if any, or else the session lifetime.
+func (s *Store) lifetimeFor(name string) time.Duration {
+	if lifetime, ok := s.lifetimes[name]; ok {
+		return lifetime
+	}
+	return s.lifetime
+}
+
+// expired reports whether the session stored in d has expired. Sessions
+// without an expiry never expire.
+func (s *Store) expired(d *sessionDoc) bool {
+	return !d.ExpireAt.IsZero() && !d.ExpireAt.After(s.now())
+}
+
+// collectionRef returns the collection sessions with the given name are stored
+// in. With WithTenantResolver, it is under the document of the tenant in ctx.
+func (s *Store) collectionRef(ctx context.Context, name string) *firestore.CollectionRef {
+	if s.coll != nil {
+		return s.coll
+	}
+	if s.collection != "" {
+		name = s.collection
+	}
+	if tenant := tenantFromContext(ctx); s.tenantResolver != nil && tenant != "" {
+		return s.client.Collection(tenantsCollection).Doc(tenant).Collection(s.collectionPrefix + name)
+	}
+	return s.client.Collection(s.collectionPrefix + name)
+}
+
+// DocRef returns the document the session with the given name and ID is stored
+// in, whether or not it exists, taking WithCollection, WithCollectionPrefix,
+// NewWithCollection, and the tenant in ctx into account. With WithChunking,
+// the chunks of a long session are stored in other documents.
+func (s *Store) DocRef(ctx context.Context, name, id string) *firestore.DocumentRef {
+	return s.collectionRef(ctx, name).Doc(id)
+}
+
+// DocPath returns the full path of the document of the session with the given
+// name and ID, such as
+// "projects/P/databases/(default)/documents/checkout/ID", for logs and
+// finding the session in the Firestore console. See DocRef.
+func (s *Store) DocPath(ctx context.Context, name, id string) string {
+	return s.DocRef(ctx, name, id).Path
+}
+
+// newID returns the ID for a new session with the given name.
+func (s *Store) newID(ctx context.Context, name string) (string, error) {
+	if s.idGenerator == nil {
+		return s.collectionRef(ctx, name).NewDoc().ID, nil
+	}
+	id, err := s.idGenerator()
+	if err != nil {
+		return "", fmt.Errorf("idGenerator: %w", err)
+	}
+	if id == "" {
+		return "", fmt.Errorf("idGenerator returned an empty ID")
+	}
+	return id, nil
+}
+
+// randomIDGenerator returns an ID generator that encodes n random bytes with
+// unpadded base64url, which is safe in URLs and Firestore document IDs.
+func randomIDGenerator(n int) func() (string, error) {
+	return func() (string, error) {
+		b := make([]byte, n)
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("rand.Read: %w", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	}
+}
+
+// SequentialIDs returns an ID generator for WithIDGenerator that generates the
+// IDs prefix-1, prefix-2, and so on, so tests can predict the IDs, and the
+// paths returned by DocPath, of the sessions they create. It is safe for
+// concurrent use. Sequential IDs can be guessed, so never use them in
+// production, where IDs are random by default.
+func SequentialIDs(prefix string) func() (string, error) {
+	var n atomic.Int64
+	return func() (string, error) {
+		return fmt.Sprintf("%s-%d", prefix, n.Add(1)), nil
+	}
+}
+
+// shared reports whether sessions with different names share a collection.
+func (s *Store) shared() bool {
+	return s.collection != "" || s.coll != nil
+}
+
+// query returns a query matching every session with the given name.
+func (s *Store) query(ctx context.Context, name string) firestore.Query {
+	q := s.collectionRef(ctx, name).Query
+	if s.shared() {
+		q = q.Where("name", "==", name)
+	}
+	return q
+}
+
+// readIDFromHeader get the ID from the token extractor or a header, decoded
+// with WithSecureCookie if it is used.
 func (s *Store) readIDFromHeader(r *http.Request, name string) (string, error) {
+	if s.extractToken != nil {
+		if token, ok := s.extractToken(r); ok && token != "" {
+			return s.decodeID(name, token)
+		}
+	}
 	c := r.Header.Get(name)
 	if c == "" {
 		return "", fmt.Errorf("Header not present: %s", name)
 	}
-	return c, nil
+	return s.decodeID(name, c)
 }
 
-// jsonSession is an encoding/json compatible version of sessions.Session.
-type jsonSession struct {
-	Values map[string]interface{}
-	ID     string
+// serialize encodes the session values with the codec of the Store into a
+// sessionDoc, compressing them if WithCompression or WithCompressionThreshold
+// is used and then encrypting them if WithEncryptionKey or
+// WithEnvelopeEncryption is used.
+func (s *Store) serialize(ctx context.Context, session *sessions.Session) (_ *sessionDoc, err error) {
+	ctx, span := s.startSpan(ctx, "serialize", session.Name())
+	defer func() { endSpan(span, err) }()
+
+	values := storedValues(session.Values)
+	if s.maxValueKeys > 0 && len(values) > s.maxValueKeys {
+		return nil, &MaxValueKeysError{Keys: len(values), Limit: s.maxValueKeys}
+	}
+	if s.codec == codecNative {
+		values, err := toNativeValues(values)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := s.encryptNativeValues(values)
+		if err != nil {
+			return nil, err
+		}
+		return &sessionDoc{Codec: codecNative, Values: values, EncryptedKeys: keys}, nil
+	}
+	b, err := s.Encode(values)
+	if err != nil {
+		return nil, err
+	}
+	doc := &sessionDoc{Codec: s.codec}
+	if s.compress && len(b) > s.compressThreshold {
+		if b, err = gzipBytes(b); err != nil {
+			return nil, err
+		}
+		doc.Compressed = true
+	}
+	switch {
+	case s.encrypter != nil:
+		if b, doc.WrappedKey, err = envelopeEncrypt(ctx, s.encrypter, b); err != nil {
+			return nil, err
+		}
+		doc.Encrypted = true
+	case len(s.aeads) > 0:
+		if b, err = encrypt(s.aeads[0], b); err != nil {
+			return nil, err
+		}
+		doc.Encrypted = true
+	}
+	f := payloadFormat{codec: doc.Codec, compressed: doc.Compressed, encrypted: doc.Encrypted}
+	b = append([]byte{f.header()}, b...)
+	doc.Format = formatV1
+	span.SetAttributes(attribute.Int(attrBytes, len(b)))
+	s.metrics.observeSerialize(len(b))
+	if len(b) > s.maxLength && !s.chunking {
+		return nil, &MaxLengthError{Size: len(b), Limit: s.maxLength}
+	}
+	doc.setPayload(b)
+	if s.checksum {
+		sum := sha256.Sum256(b)
+		doc.Checksum = sum[:]
+	}
+	return doc, nil
 }
 
-// serialize serializes the session into a JSON string. Only string key values
-// are supported. encoding/gob could be used to support non-string keys, but it
-// is slower and leads to larger sessions.
-func (s *Store) serialize(session *sessions.Session) (string, error) {
-	values := map[string]interface{}{}
-	for k, v := range session.Values {
-		ks, ok := k.(string)
-		if !ok {
-			return "", fmt.Errorf("only string keys supported: %v", k)
+// deserialize decodes the session values stored in doc, in any payload format.
+func (s *Store) deserialize(ctx context.Context, doc *sessionDoc) (_ map[interface{}]interface{}, err error) {
+	ctx, span := s.startSpan(ctx, "deserialize", doc.Name)
+	defer func() { endSpan(span, err) }()
+
+	if doc.Codec == codecNative {
+		values := fromNativeValues(doc.Values)
+		if err := s.decryptNativeValues(values, doc.EncryptedKeys); err != nil {
+			return nil, err
 		}
-		values[ks] = v
+		return values, nil
 	}
-	jSession := jsonSession{
-		Values: values,
-		ID:     session.ID,
+	span.SetAttributes(attribute.Int(attrBytes, len(doc.payload())))
+	if doc.Checksum != nil {
+		if sum := sha256.Sum256(doc.payload()); !bytes.Equal(sum[:], doc.Checksum) {
+			return nil, fmt.Errorf("checksum mismatch")
+		}
 	}
-	b, err := json.Marshal(jSession)
+	f, b, err := readFormat(doc)
 	if err != nil {
-		return "", fmt.Errorf("json.Marshal: %v", err)
+		return nil, err
+	}
+	if _, ok := s.codecs[f.codec]; !ok {
+		return nil, fmt.Errorf("unsupported codec %q", f.codec)
+	}
+	switch {
+	case f.encrypted && doc.WrappedKey != nil:
+		if s.decrypter == nil {
+			return nil, fmt.Errorf("session uses envelope encryption, but no Decrypter is set")
+		}
+		if b, err = envelopeDecrypt(ctx, s.decrypter, doc.WrappedKey, b); err != nil {
+			return nil, err
+		}
+	case f.encrypted:
+		if b, err = decryptAny(s.aeads, b); err != nil {
+			return nil, err
+		}
+	}
+	if f.compressed {
+		if b, err = gunzipBytes(b); err != nil {
+			return nil, err
+		}
 	}
-	if len(b) > maxLength {
-		return "", fmt.Errorf("max length of session exceeded: %d > %d", len(b), maxLength)
+	return s.decodeValues(f.codec, b)
+}
+
+// gzipBytes compresses b with gzip.
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, fmt.Errorf("gzip: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("gzip: %w", err)
 	}
-	return string(b), nil
+	return buf.Bytes(), nil
 }
 
-// deserialize decodes a session.
-func (*Store) deserialize(s string) (*sessions.Session, error) {
-	jSession := jsonSession{}
-	if err := json.Unmarshal([]byte(s), &jSession); err != nil {
-		return nil, fmt.Errorf("json.Unmarshal: %v", err)
+// gunzipBytes decompresses b, which was compressed by gzipBytes.
+func gunzipBytes(b []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("gzip.NewReader: %w", err)
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("gunzip: %w", err)
 	}
-	values := map[interface{}]interface{}{}
-	for k, v := range jSession.Values {
-		values[k] = v
+	return out, nil
+}
+
+// withTimeout returns a copy of ctx that is canceled after the operation
+// timeout of the Store, if it has one.
+func (s *Store) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout == 0 {
+		return ctx, func() {}
 	}
-	return &sessions.Session{
-		Values: values,
-		ID:     jSession.ID,
-	}, nil
+	return context.WithTimeout(ctx, s.timeout)
 }
+
+// discardHandler is a slog.Handler that discards every record.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
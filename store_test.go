@@ -16,21 +16,36 @@ package firestoregorilla
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/firestore"
 	"github.com/google/go-cmp/cmp"
-	"google.golang.org/api/iterator"
+	"github.com/gorilla/sessions"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 func TestStore(t *testing.T) {
 	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
 	if projectID == "" {
-		t.Skip("GOOGLE_CLOUD_PROJECT not set")
+		if os.Getenv(emulatorHostEnv) == "" {
+			t.Skip("GOOGLE_CLOUD_PROJECT and " + emulatorHostEnv + " not set")
+		}
+		projectID = "test-project"
 	}
 	ctx := context.Background()
 
@@ -41,6 +56,9 @@ func TestStore(t *testing.T) {
 	defer client.Close()
 
 	s, err := New(ctx, client)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
 
 	r := httptest.NewRequest("GET", "/", nil)
 	const name = "testname"
@@ -83,7 +101,10 @@ func TestStore(t *testing.T) {
 func TestMaxLength(t *testing.T) {
 	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
 	if projectID == "" {
-		t.Skip("GOOGLE_CLOUD_PROJECT not set")
+		if os.Getenv(emulatorHostEnv) == "" {
+			t.Skip("GOOGLE_CLOUD_PROJECT and " + emulatorHostEnv + " not set")
+		}
+		projectID = "test-project"
 	}
 	ctx := context.Background()
 
@@ -93,54 +114,1313 @@ func TestMaxLength(t *testing.T) {
 	}
 	defer client.Close()
 
-	s, err := New(ctx, client)
+	tests := []struct {
+		opts  []Option
+		limit int
+	}{
+		{opts: nil, limit: maxLength},
+		{opts: []Option{WithMaxLength(1 << 10)}, limit: 1 << 10},
+	}
+	for _, test := range tests {
+		s, err := New(ctx, client, test.opts...)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+
+		r := &http.Request{}
+
+		const name = "TestMaxLength"
+		session, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		defer s.cleanup(name)
+
+		if _, err := s.serialize(ctx, session); err != nil {
+			t.Errorf("serialize(%+v) want nil error, got %v", session, err)
+		}
+
+		bigSession, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		// Ensure bigSession is over the limit.
+		bigSession.Values["store"] = strings.Repeat("firestore", test.limit/len("firestore")+1)
+
+		encoded, err := s.serialize(ctx, bigSession)
+		if err == nil {
+			t.Fatalf("serialize(bigSession) want max length error, got nil error\n\tgot=%d bytes, maxLenth=%d bytes", len(encoded.payload()), test.limit)
+		}
+		// Confirm the error was about the max length, not something else like gob
+		// encoding.
+		if want := "max length"; !strings.Contains(err.Error(), want) {
+			t.Errorf("serialize(bigSession) got err %q, want to contain %q", err.Error(), want)
+		}
+		var mlErr *MaxLengthError
+		if !errors.As(err, &mlErr) || mlErr.Limit != test.limit || mlErr.Size <= test.limit {
+			t.Errorf("serialize(bigSession) got err %v, want a MaxLengthError with Limit=%d", err, test.limit)
+		}
+	}
+}
+
+func TestStoreWithCollection(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	const collection = "TestStoreWithCollection"
+	s, err := New(ctx, client, WithCollection(collection))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	const name = "_app_session"
+	session, err := s.New(r, name)
 	if err != nil {
 		t.Fatalf("New: %v", err)
 	}
+	defer s.cleanup(name)
+
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	ds, err := client.Collection(collection).Doc(session.ID).Get(ctx)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", session.ID, err)
+	}
+	if got, err := ds.DataAt("name"); err != nil || got != name {
+		t.Errorf("DataAt(name) got %v, %v, want %q", got, err, name)
+	}
+
+	// A session with a different name must not load the document, even
+	// though it shares the collection.
+	const otherName = "_other_session"
+	r.Header.Set(otherName, session.ID)
+	other, err := s.New(r, otherName)
+	if err != nil {
+		t.Fatalf("New(%q): %v", otherName, err)
+	}
+	if !other.IsNew {
+		t.Errorf("New(%q) got IsNew=false, want true", otherName)
+	}
+}
+
+func TestNewWithCollectionOptions(t *testing.T) {
+	ctx := context.Background()
+	client := newOfflineClient(t)
+	coll := client.Collection("apps").Doc("app").Collection("sessions")
+
+	if _, err := NewWithCollection(ctx, client, nil); err == nil {
+		t.Errorf("NewWithCollection(nil) got nil error, want error")
+	}
+	for _, opt := range []Option{WithCollection("other"), WithCollectionPrefix("staging_")} {
+		if _, err := NewWithCollection(ctx, client, coll, opt); err == nil {
+			t.Errorf("NewWithCollection with a collection option got nil error, want error")
+		}
+	}
+	s, err := NewWithCollection(ctx, client, coll)
+	if err != nil {
+		t.Fatalf("NewWithCollection: %v", err)
+	}
+	if got := s.collectionRef(ctx, "checkout").Path; got != coll.Path {
+		t.Errorf("collectionRef got %q, want %q", got, coll.Path)
+	}
+}
+
+func TestNewWithCollection(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
 
-	r := &http.Request{}
+	coll := client.Collection("apps").Doc("TestNewWithCollection").Collection("sessions")
+	s, err := NewWithCollection(ctx, client, coll)
+	if err != nil {
+		t.Fatalf("NewWithCollection: %v", err)
+	}
 
-	const name = "TestMaxLength"
+	r := httptest.NewRequest("GET", "/", nil)
+	const name = "_app_session"
 	session, err := s.New(r, name)
 	if err != nil {
 		t.Fatalf("New: %v", err)
 	}
 	defer s.cleanup(name)
+	session.Values["testkey"] = "testvalue"
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// The session is stored in coll, not a collection named after it.
+	if _, err := coll.Doc(session.ID).Get(ctx); err != nil {
+		t.Fatalf("Get(%q): %v", session.ID, err)
+	}
+	r.Header.Set(name, session.ID)
+	got, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got.IsNew || got.Values["testkey"] != "testvalue" {
+		t.Errorf("New got IsNew=%v, values %v, want the saved session", got.IsNew, got.Values)
+	}
+
+	const otherName = "_other_session"
+	r.Header.Set(otherName, session.ID)
+	other, err := s.New(r, otherName)
+	if err != nil {
+		t.Fatalf("New(%q): %v", otherName, err)
+	}
+	if !other.IsNew {
+		t.Errorf("New(%q) got IsNew=false, want true", otherName)
+	}
+}
+
+func TestDocPath(t *testing.T) {
+	ctx := context.Background()
+	client := newOfflineClient(t)
+	const root = "projects/test-project/databases/(default)/documents/"
+	tests := []struct {
+		desc string
+		opts []Option
+		ctx  context.Context
+		want string
+	}{
+		{desc: "default", want: "checkout/id"},
+		{desc: "prefix", opts: []Option{WithCollectionPrefix("staging_")}, want: "staging_checkout/id"},
+		{desc: "collection", opts: []Option{WithCollection("sessions")}, want: "sessions/id"},
+		{
+			desc: "tenant",
+			opts: []Option{WithTenantResolver(func(*http.Request) string { return "" })},
+			ctx:  WithTenant(ctx, "acme"),
+			want: "tenants/acme/checkout/id",
+		},
+	}
+	for _, test := range tests {
+		s, err := New(ctx, client, test.opts...)
+		if err != nil {
+			t.Fatalf("%s: New: %v", test.desc, err)
+		}
+		ctx := ctx
+		if test.ctx != nil {
+			ctx = test.ctx
+		}
+		if got := s.DocPath(ctx, "checkout", "id"); got != root+test.want {
+			t.Errorf("%s: DocPath got %q, want %q", test.desc, got, root+test.want)
+		}
+	}
+
+	s, err := NewWithCollection(ctx, client, client.Collection("apps").Doc("app").Collection("sessions"))
+	if err != nil {
+		t.Fatalf("NewWithCollection: %v", err)
+	}
+	if got, want := s.DocPath(ctx, "checkout", "id"), root+"apps/app/sessions/id"; got != want {
+		t.Errorf("NewWithCollection: DocPath got %q, want %q", got, want)
+	}
+}
+
+func TestNewWithClock(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 1, 19, 12, 0, 0, 0, time.UTC)
+	s, err := NewWithClock(ctx, newOfflineClient(t), func() time.Time { return now }, WithSessionLifetime(time.Hour))
+	if err != nil {
+		t.Fatalf("NewWithClock: %v", err)
+	}
+	if _, err := NewWithClock(ctx, nil, nil); err == nil {
+		t.Errorf("NewWithClock with a nil clock got nil error, want error")
+	}
+
+	session := sessions.NewSession(s, "checkout")
+	encoded, err := s.encode(ctx, session)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if !encoded.ExpireAt.Equal(now.Add(time.Hour)) || !encoded.UpdatedAt.Equal(now) {
+		t.Errorf("encode got expireAt %v, updatedAt %v, want times from the clock", encoded.ExpireAt, encoded.UpdatedAt)
+	}
+	now = now.Add(59 * time.Minute)
+	if s.expired(encoded) {
+		t.Errorf("expired got true before the lifetime passed, want false")
+	}
+	now = now.Add(time.Minute)
+	if !s.expired(encoded) {
+		t.Errorf("expired got false once the lifetime passed, want true")
+	}
+}
+
+func ExampleNewWithClock() {
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "my-project")
+	if err != nil {
+		log.Fatal(err)
+	}
+	now := time.Date(2021, 1, 19, 12, 0, 0, 0, time.UTC)
+	store, err := NewWithClock(ctx, client, func() time.Time { return now }, WithSessionLifetime(time.Hour))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if _, err := s.serialize(session); err != nil {
-		t.Errorf("serialize(%+v) want nil error, got %v", session, err)
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := store.Get(r, "checkout")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := store.Save(r, httptest.NewRecorder(), session); err != nil {
+		log.Fatal(err)
+	}
+
+	// Once the clock passes the session lifetime, the session has expired.
+	now = now.Add(2 * time.Hour)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("checkout", session.ID)
+	session, err = store.Get(r, "checkout")
+	if err != nil {
+		log.Fatal(err)
 	}
+	fmt.Println(session.IsNew)
+}
+
+func TestSaveMaxAge(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
 
-	bigSession, err := s.New(r, name)
+	s, err := New(ctx, client)
 	if err != nil {
 		t.Fatalf("New: %v", err)
 	}
-	// Ensure bigSession is over maxLength.
-	bigSession.Values["store"] = strings.Repeat("firestore", 1<<20)
+	now := time.Now().Truncate(time.Microsecond)
+	s.now = func() time.Time { return now }
 
-	sessionStr, err := s.serialize(bigSession)
-	if err == nil {
-		t.Fatalf("serialize(bigSession) want max length error, got nil error\n\tgot=%d bytes, maxLenth=%d bytes", len([]byte(sessionStr)), maxLength)
+	const name = "TestSaveMaxAge"
+	defer s.cleanup(name)
+	tests := []struct {
+		desc         string
+		maxAge       int
+		wantExpireAt time.Time
+		wantDeleted  bool
+	}{
+		{desc: "positive", maxAge: 3600, wantExpireAt: now.Add(time.Hour)},
+		{desc: "zero", maxAge: 0, wantExpireAt: time.Time{}},
+		{desc: "negative", maxAge: -1, wantDeleted: true},
 	}
-	// Confirm the error was about the max length, not something else like gob
-	// encoding.
-	if want := "max length"; !strings.Contains(err.Error(), want) {
-		t.Errorf("serialize(bigSession) got err %q, want to contain %q", err.Error(), want)
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		session, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("%s: New: %v", test.desc, err)
+		}
+		if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("%s: Save: %v", test.desc, err)
+		}
+
+		session.Options.MaxAge = test.maxAge
+		w := httptest.NewRecorder()
+		if err := s.Save(r, w, session); err != nil {
+			t.Fatalf("%s: Save: %v", test.desc, err)
+		}
+		// The session ID travels in a header, so no cookie is set.
+		if got := w.Header().Get("Set-Cookie"); got != "" {
+			t.Errorf("%s: Save set cookie %q, want none", test.desc, got)
+		}
+		encoded, err := s.readDoc(ctx, name, session.ID)
+		if deleted := errors.Is(err, ErrSessionNotFound); deleted != test.wantDeleted {
+			t.Errorf("%s: Save got session deleted %v (err %v), want %v", test.desc, deleted, err, test.wantDeleted)
+			continue
+		}
+		if err == nil && !encoded.ExpireAt.Equal(test.wantExpireAt) {
+			t.Errorf("%s: Save got expireAt %v, want %v", test.desc, encoded.ExpireAt, test.wantExpireAt)
+		}
 	}
 }
 
-// cleanup deletes every document in the name collection.
-func (s *Store) cleanup(name string) {
-	iter := s.client.Collection(name).DocumentRefs(context.Background())
-	for {
-		doc, err := iter.Next()
-		if err == iterator.Done {
-			break
+func TestSaveIDCollision(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newOfflineClient(t), WithIDGenerator(SequentialIDs("id")))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	var created []string
+	collisions := 1
+	s.createRef = func(ctx context.Context, ref *firestore.DocumentRef, encoded *sessionDoc) error {
+		created = append(created, ref.ID)
+		if len(created) <= collisions {
+			return status.Error(codes.AlreadyExists, "document already exists")
 		}
+		return nil
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := s.New(r, "checkout")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if diff := cmp.Diff([]string{"id-1", "id-2"}, created); diff != "" {
+		t.Errorf("Save created diff documents (-want, +got):\n%s", diff)
+	}
+	if session.ID != "id-2" {
+		t.Errorf("Save got ID %q, want id-2", session.ID)
+	}
+
+	// Saves give up after maxIDAttempts collisions.
+	created, collisions = nil, maxIDAttempts
+	session, err = s.New(r, "checkout")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Save(r, httptest.NewRecorder(), session); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("Save with only collisions got err %v, want AlreadyExists", err)
+	}
+	if len(created) != maxIDAttempts {
+		t.Errorf("Save with only collisions tried %d IDs, want %d", len(created), maxIDAttempts)
+	}
+}
+
+func TestSaveIDRetriedCreate(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newOfflineClient(t), WithIDGenerator(SequentialIDs("id")), WithRetry(2, time.Millisecond))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// The first attempt creates the document, but fails, so the retry finds
+	// it exists.
+	var stored *sessionDoc
+	var created []string
+	s.createRef = func(ctx context.Context, ref *firestore.DocumentRef, encoded *sessionDoc) error {
+		created = append(created, ref.ID)
+		if stored != nil {
+			return status.Error(codes.AlreadyExists, "document already exists")
+		}
+		d := *encoded
+		stored = &d
+		return status.Error(codes.Unavailable, "connection reset")
+	}
+	s.fetch = func(ctx context.Context, name, id string) (*sessionDoc, error) {
+		if stored == nil {
+			return nil, ErrSessionNotFound
+		}
+		return stored, nil
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := s.New(r, "checkout")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if diff := cmp.Diff([]string{"id-1", "id-1"}, created); diff != "" {
+		t.Errorf("Save created diff documents (-want, +got):\n%s", diff)
+	}
+	if session.ID != "id-1" {
+		t.Errorf("Save got ID %q, want id-1", session.ID)
+	}
+
+	// A document created by another session is still a collision.
+	stored, created = nil, nil
+	session, err = s.New(r, "checkout")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session.Values["testkey"] = "mine"
+	s.createRef = func(ctx context.Context, ref *firestore.DocumentRef, encoded *sessionDoc) error {
+		created = append(created, ref.ID)
+		if len(created) == 1 {
+			stored = &sessionDoc{EncodedSession: "theirs"}
+			return status.Error(codes.Unavailable, "connection reset")
+		}
+		if len(created) == 2 {
+			return status.Error(codes.AlreadyExists, "document already exists")
+		}
+		return nil
+	}
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if diff := cmp.Diff([]string{"id-2", "id-2", "id-3"}, created); diff != "" {
+		t.Errorf("Save created diff documents (-want, +got):\n%s", diff)
+	}
+}
+
+func TestNamedDatabase(t *testing.T) {
+	ctx := context.Background()
+	client, err := firestore.NewClientWithDatabase(ctx, "test-project", "sessions-db",
+		option.WithoutAuthentication(),
+		option.WithEndpoint("localhost:1"),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	if err != nil {
+		t.Fatalf("firestore.NewClientWithDatabase: %v", err)
+	}
+	defer client.Close()
+
+	s, err := New(ctx, client)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	want := "projects/test-project/databases/sessions-db/documents/checkout"
+	if got := s.collectionRef(ctx, "checkout").Path; got != want {
+		t.Errorf("collectionRef got %q, want %q", got, want)
+	}
+	want = "projects/test-project/databases/sessions-db/collectionGroups/checkout/fields/expireAt"
+	if got := s.ttlFieldName("checkout"); got != want {
+		t.Errorf("ttlFieldName got %q, want %q", got, want)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	client := newOfflineClient(t)
+
+	perName, err := New(ctx, client)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got, want := perName.query(context.Background(), "checkout"), perName.collectionRef(context.Background(), "checkout").Query; !reflect.DeepEqual(got, want) {
+		t.Errorf("query got a filtered query, want the whole collection")
+	}
+
+	shared, err := New(ctx, client, WithCollection("sessions"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	want := shared.collectionRef(context.Background(), "checkout").Where("name", "==", "checkout")
+	if got := shared.query(context.Background(), "checkout"); !reflect.DeepEqual(got, want) {
+		t.Errorf("query with WithCollection got %+v, want %+v", got, want)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const name = "TestDelete"
+	defer s.cleanup(name)
+
+	tests := []struct {
+		desc   string
+		delete func(*http.Request, http.ResponseWriter, *sessions.Session) error
+	}{
+		{
+			desc:   "Delete",
+			delete: s.Delete,
+		},
+		{
+			desc: "Save with negative MaxAge",
+			delete: func(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+				session.Options.MaxAge = -1
+				return s.Save(r, w, session)
+			},
+		},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		session, err := s.New(r, name)
 		if err != nil {
-			// Ignore.
+			t.Fatalf("%s: New: %v", test.desc, err)
 		}
-		// Ignore errors.
-		doc.Delete(context.Background())
+		session.Values["testkey"] = "testvalue"
+		if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("%s: Save: %v", test.desc, err)
+		}
+
+		if err := test.delete(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("%s: got err %v, want nil", test.desc, err)
+		}
+		if session.Options.MaxAge != -1 {
+			t.Errorf("%s: got MaxAge=%d, want -1", test.desc, session.Options.MaxAge)
+		}
+		_, err = s.collectionRef(ctx, name).Doc(session.ID).Get(ctx)
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("%s: Get(%q) got err %v, want NotFound", test.desc, session.ID, err)
+		}
+	}
+}
+
+func TestGetByIDSaveByID(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const name = "TestGetByIDSaveByID"
+	defer s.cleanup(name)
+
+	session := sessions.NewSession(s, name)
+	session.Values["testkey"] = "testvalue"
+	if err := s.SaveByID(ctx, "other", session); err == nil {
+		t.Errorf("SaveByID with another name got nil error, want error")
+	}
+	if err := s.SaveByID(ctx, name, session); err != nil {
+		t.Fatalf("SaveByID: %v", err)
+	}
+	if session.ID == "" {
+		t.Fatalf("SaveByID didn't set the session ID")
+	}
+
+	got, err := s.GetByID(ctx, name, session.ID)
+	if err != nil {
+		t.Fatalf("GetByID: %v", err)
+	}
+	if got.IsNew || got.ID != session.ID {
+		t.Errorf("GetByID got IsNew=%v, ID %q, want the saved session %q", got.IsNew, got.ID, session.ID)
+	}
+	if diff := cmp.Diff(session.Values, got.Values); diff != "" {
+		t.Errorf("GetByID got diff Values (-want, +got):\n%s", diff)
+	}
+
+	got.Values["testkey"] = "changed"
+	if err := s.SaveByID(ctx, name, got); err != nil {
+		t.Fatalf("SaveByID: %v", err)
+	}
+	if got, err := s.GetByID(ctx, name, session.ID); err != nil || got.Values["testkey"] != "changed" {
+		t.Errorf("GetByID after saving a change got %v, %v, want the change", got, err)
+	}
+
+	got.Options.MaxAge = -1
+	if err := s.SaveByID(ctx, name, got); err != nil {
+		t.Fatalf("SaveByID with negative MaxAge: %v", err)
+	}
+	if _, err := s.GetByID(ctx, name, session.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("GetByID after deleting got err %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithSessionLifetime(time.Hour))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	r := httptest.NewRequest("GET", "/", nil)
+	const name = "TestTouch"
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.cleanup(name)
+	session.Values["testkey"] = "testvalue"
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	now = now.Add(30 * time.Minute)
+	if err := s.Touch(ctx, name, session.ID); err != nil {
+		t.Fatalf("Touch: %v", err)
+	}
+	ds, err := s.collectionRef(ctx, name).Doc(session.ID).Get(ctx)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", session.ID, err)
+	}
+	doc := sessionDoc{}
+	if err := ds.DataTo(&doc); err != nil {
+		t.Fatalf("DataTo: %v", err)
+	}
+	if want := now.Add(time.Hour); !doc.ExpireAt.Equal(want) {
+		t.Errorf("after Touch, expireAt got %v, want %v", doc.ExpireAt, want)
+	}
+	if doc.EncodedSession == "" {
+		t.Errorf("after Touch, the encoded session is empty, want it unchanged")
+	}
+
+	if err := s.Touch(ctx, name, "missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Touch of a missing session got err %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestTouchRequiresLifetime(t *testing.T) {
+	s, err := New(context.Background(), newOfflineClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Touch(context.Background(), "checkout", "id"); err == nil {
+		t.Errorf("Touch without WithSessionLifetime got nil error, want error")
+	}
+}
+
+func TestExists(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithSessionLifetime(time.Hour))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	r := httptest.NewRequest("GET", "/", nil)
+	const name = "TestExists"
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.cleanup(name)
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	tests := []struct {
+		desc string
+		id   string
+		now  time.Time
+		want bool
+	}{
+		{desc: "saved", id: session.ID, now: now, want: true},
+		{desc: "missing", id: "missing", now: now, want: false},
+		{desc: "expired", id: session.ID, now: now.Add(time.Hour), want: false},
+	}
+	for _, test := range tests {
+		now = test.now
+		got, err := s.Exists(ctx, name, test.id)
+		if err != nil {
+			t.Errorf("%s: Exists: %v", test.desc, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: Exists got %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestExistsError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	s, err := New(ctx, newOfflineClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got, err := s.Exists(ctx, "checkout", "id"); err == nil {
+		t.Errorf("Exists with an unreachable Firestore got (%v, nil), want an error", got)
+	}
+}
+
+func TestExistsEmptyID(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newOfflineClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// Firestore isn't reachable, so the ID must not be looked up.
+	if got, err := s.Exists(ctx, "checkout", ""); got || err != nil {
+		t.Errorf("Exists with an empty ID got (%v, %v), want (false, nil)", got, err)
+	}
+}
+
+func TestExtractBookingIDs(t *testing.T) {
+	tests := []struct {
+		desc    string
+		values  map[interface{}]interface{}
+		want    []string
+		wantErr bool
+	}{
+		{desc: "missing", values: map[interface{}]interface{}{}, want: nil},
+		{desc: "strings", values: map[interface{}]interface{}{bookingIDsKey: []string{"LH1", "LH2"}}, want: []string{"LH1", "LH2"}},
+		{desc: "decoded", values: map[interface{}]interface{}{bookingIDsKey: []interface{}{"LH1", "LH2"}}, want: []string{"LH1", "LH2"}},
+		{desc: "wrong element type", values: map[interface{}]interface{}{bookingIDsKey: []interface{}{"LH1", 2}}, wantErr: true},
+		{desc: "wrong type", values: map[interface{}]interface{}{bookingIDsKey: "LH1"}, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := extractBookingIDs(test.values)
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("%s: extractBookingIDs got err %v, want error=%v", test.desc, err, test.wantErr)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%s: extractBookingIDs got diff (-want, +got):\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestAddRemoveBookingID(t *testing.T) {
+	session := sessions.NewSession(nil, "checkout")
+
+	for _, id := range []string{"LH1", "LH2", "LH1"} {
+		if err := AddBookingID(session, id); err != nil {
+			t.Fatalf("AddBookingID(%q): %v", id, err)
+		}
+	}
+	if diff := cmp.Diff([]string{"LH1", "LH2"}, session.Values[bookingIDsKey]); diff != "" {
+		t.Errorf("after AddBookingID, got diff (-want, +got):\n%s", diff)
+	}
+
+	if removed, err := RemoveBookingID(session, "LH1"); err != nil || !removed {
+		t.Errorf("RemoveBookingID(LH1) got (%v, %v), want (true, nil)", removed, err)
+	}
+	if removed, err := RemoveBookingID(session, "LH3"); err != nil || removed {
+		t.Errorf("RemoveBookingID(LH3) got (%v, %v), want (false, nil)", removed, err)
+	}
+	if diff := cmp.Diff([]string{"LH2"}, session.Values[bookingIDsKey]); diff != "" {
+		t.Errorf("after RemoveBookingID, got diff (-want, +got):\n%s", diff)
+	}
+
+	// Values decoded by a codec hold a []interface{}.
+	session.Values[bookingIDsKey] = []interface{}{"LH2"}
+	if err := AddBookingID(session, "LH3"); err != nil {
+		t.Fatalf("AddBookingID: %v", err)
+	}
+	if diff := cmp.Diff([]string{"LH2", "LH3"}, session.Values[bookingIDsKey]); diff != "" {
+		t.Errorf("after AddBookingID to decoded values, got diff (-want, +got):\n%s", diff)
+	}
+
+	session.Values[bookingIDsKey] = "LH1"
+	if err := AddBookingID(session, "LH2"); err == nil {
+		t.Errorf("AddBookingID with the wrong type got nil error, want error")
+	}
+	if _, err := RemoveBookingID(session, "LH1"); err == nil {
+		t.Errorf("RemoveBookingID with the wrong type got nil error, want error")
+	}
+	if got := session.Values[bookingIDsKey]; got != "LH1" {
+		t.Errorf("AddBookingID with the wrong type overwrote the value with %v", got)
+	}
+}
+
+func TestBookingIDValidator(t *testing.T) {
+	ctx := context.Background()
+	validate := func(id string) error {
+		if strings.TrimSpace(id) == "" {
+			return errors.New("empty booking ID")
+		}
+		return nil
+	}
+	s, err := New(ctx, newOfflineClient(t), WithBookingIDValidator(validate))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	tests := []struct {
+		desc       string
+		bookingIDs interface{}
+	}{
+		{desc: "empty", bookingIDs: []string{"LH1", ""}},
+		{desc: "whitespace", bookingIDs: []interface{}{" "}},
+		{desc: "wrong type", bookingIDs: 42},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		session := sessions.NewSession(s, "checkout")
+		session.Values[bookingIDsKey] = test.bookingIDs
+		// The offline client fails every write, so check the save failed
+		// validation first.
+		if err := s.Save(r, httptest.NewRecorder(), session); err == nil || !strings.Contains(err.Error(), "booking") {
+			t.Errorf("%s: Save got err %v, want a booking ID error", test.desc, err)
+		}
+	}
+}
+
+func TestReservedKeys(t *testing.T) {
+	ctx := context.Background()
+	if _, err := New(ctx, nil, WithReservedKey[string]("")); err == nil {
+		t.Errorf("New(WithReservedKey(\"\")) got nil error, want error")
+	}
+	s, err := New(ctx, newOfflineClient(t), WithReservedKey[string]("user"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	tests := []struct {
+		desc    string
+		values  map[interface{}]interface{}
+		wantErr bool
+	}{
+		{desc: "unset", values: map[interface{}]interface{}{}},
+		{desc: "booking IDs", values: map[interface{}]interface{}{bookingIDsKey: []string{"LH1"}}},
+		{desc: "decoded booking IDs", values: map[interface{}]interface{}{bookingIDsKey: []interface{}{"LH1"}}},
+		{desc: "int booking IDs", values: map[interface{}]interface{}{bookingIDsKey: 42}, wantErr: true},
+		{desc: "user", values: map[interface{}]interface{}{"user": "u1"}},
+		{desc: "int user", values: map[interface{}]interface{}{"user": 1}, wantErr: true},
+	}
+	for _, test := range tests {
+		session := sessions.NewSession(s, "checkout")
+		session.Values = test.values
+		_, err := s.encode(ctx, session)
+		if gotErr := errors.Is(err, ErrReservedKey); gotErr != test.wantErr {
+			t.Errorf("%s: encode got err %v, want ErrReservedKey %v", test.desc, err, test.wantErr)
+		}
+	}
+
+	// The offline client fails every write, so a reserved key error means
+	// the session was rejected before it was written.
+	r := httptest.NewRequest("GET", "/", nil)
+	session := sessions.NewSession(s, "checkout")
+	session.Values[bookingIDsKey] = 42
+	if err := s.Save(r, httptest.NewRecorder(), session); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("Save with int booking IDs got err %v, want ErrReservedKey", err)
+	}
+}
+
+func TestExpireAt(t *testing.T) {
+	s, err := New(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Date(2021, 1, 19, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	tests := []struct {
+		opts *sessions.Options
+		want time.Time
+	}{
+		{opts: nil, want: time.Time{}},
+		{opts: &sessions.Options{}, want: time.Time{}},
+		{opts: &sessions.Options{MaxAge: 3600}, want: now.Add(time.Hour)},
+	}
+	for _, test := range tests {
+		session := sessions.NewSession(s, "checkout")
+		session.Options = test.opts
+		if got := s.expireAt(session); !got.Equal(test.want) {
+			t.Errorf("expireAt(%+v) got %v, want %v", test.opts, got, test.want)
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	s, err := New(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Date(2021, 1, 19, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	tests := []struct {
+		expireAt time.Time
+		want     bool
+	}{
+		{expireAt: time.Time{}, want: false},
+		{expireAt: now.Add(time.Second), want: false},
+		{expireAt: now, want: true},
+		{expireAt: now.Add(-time.Second), want: true},
+	}
+	for _, test := range tests {
+		if got := s.expired(&sessionDoc{ExpireAt: test.expireAt}); got != test.want {
+			t.Errorf("expired(expireAt=%v) got %v, want %v", test.expireAt, got, test.want)
+		}
+	}
+}
+
+func TestNewDeletesExpired(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	r := httptest.NewRequest("GET", "/", nil)
+	const name = "TestNewDeletesExpired"
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.cleanup(name)
+	session.Options.MaxAge = 60
+	session.Values["testkey"] = "testvalue"
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	r.Header.Set(name, session.ID)
+	now = now.Add(time.Minute)
+	got, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New after expiry: %v", err)
+	}
+	if !got.IsNew {
+		t.Errorf("New after expiry got IsNew=false, want true")
+	}
+	if _, err := s.collectionRef(ctx, name).Doc(session.ID).Get(ctx); status.Code(err) != codes.NotFound {
+		t.Errorf("Get(%q) after expiry got err %v, want NotFound", session.ID, err)
+	}
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithSessionLifetime(time.Hour), WithSlidingExpiration())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	r := httptest.NewRequest("GET", "/", nil)
+	const name = "TestSlidingExpiration"
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.cleanup(name)
+	session.Values["testkey"] = "testvalue"
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	now = now.Add(30 * time.Minute)
+	r.Header.Set(name, session.ID)
+	got, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if !cmp.Equal(session.Values, got.Values) {
+		t.Errorf("New got a session with diff Values (-want, +got):\n%s", cmp.Diff(session.Values, got.Values))
+	}
+
+	ds, err := s.collectionRef(ctx, name).Doc(session.ID).Get(ctx)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", session.ID, err)
+	}
+	doc := sessionDoc{}
+	if err := ds.DataTo(&doc); err != nil {
+		t.Fatalf("DataTo: %v", err)
+	}
+	if want := now.Add(time.Hour); !doc.ExpireAt.Equal(want) {
+		t.Errorf("after load, expireAt got %v, want %v", doc.ExpireAt, want)
+	}
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, nil, WithJSONCodec())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	session := sessions.NewSession(s, "checkout")
+	session.ID = "id"
+	session.Values["string"] = "value"
+	session.Values["number"] = 1.5
+	session.Values["list"] = []interface{}{"a", "b"}
+	session.Values["map"] = map[string]interface{}{"key": "value"}
+
+	encoded, err := s.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	// Sessions saved before the payload format was recorded have no header,
+	// and those saved before the codec was recorded are JSON.
+	encoded.Format = formatV0
+	encoded.setPayload(encoded.payload()[1:])
+	for _, codec := range []string{"", codecJSON} {
+		encoded.Codec = codec
+		got, err := s.deserialize(ctx, encoded)
+		if err != nil {
+			t.Fatalf("deserialize(%q): %v", codec, err)
+		}
+		if diff := cmp.Diff(session.Values, got); diff != "" {
+			t.Errorf("deserialize(%q) got diff Values (-want, +got):\n%s", codec, diff)
+		}
+	}
+
+	encoded.Codec = "unknown"
+	if _, err := s.deserialize(ctx, encoded); err == nil {
+		t.Errorf("deserialize(unknown) got nil error, want error")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	ctx := context.Background()
+	plain, err := New(ctx, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	compressed, err := New(ctx, nil, WithCompression())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	session := sessions.NewSession(plain, "checkout")
+	// Repetitive values compress well, so this session is over maxLength
+	// uncompressed and well under it compressed.
+	session.Values["store"] = strings.Repeat("firestore", 1<<20)
+
+	if _, err := plain.serialize(ctx, session); err == nil {
+		t.Fatalf("serialize without compression got nil error, want max length error")
+	}
+	doc, err := compressed.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize with compression: %v", err)
+	}
+	if !doc.Compressed {
+		t.Errorf("serialize with compression got Compressed=false, want true")
+	}
+	got, err := compressed.deserialize(ctx, doc)
+	if err != nil {
+		t.Fatalf("deserialize: %v", err)
+	}
+	if diff := cmp.Diff(session.Values, got); diff != "" {
+		t.Errorf("deserialize got diff Values (-want, +got):\n%s", diff)
+	}
+
+	// Uncompressed sessions still load with compression on.
+	session.Values["store"] = "firestore"
+	doc, err = plain.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	if _, err := compressed.deserialize(ctx, doc); err != nil {
+		t.Errorf("deserialize uncompressed session with compression on: %v", err)
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, nil, WithCompressionThreshold(1<<10))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	tests := []struct {
+		value          string
+		wantCompressed bool
+	}{
+		{value: "tiny", wantCompressed: false},
+		{value: strings.Repeat("x", 50<<10), wantCompressed: true},
+	}
+	for _, test := range tests {
+		session := sessions.NewSession(s, "checkout")
+		session.Values["key"] = test.value
+		doc, err := s.serialize(ctx, session)
+		if err != nil {
+			t.Fatalf("serialize: %v", err)
+		}
+		if doc.Compressed != test.wantCompressed {
+			t.Errorf("serialize(%d byte value) got Compressed=%v, want %v", len(test.value), doc.Compressed, test.wantCompressed)
+		}
+		got, err := s.deserialize(ctx, doc)
+		if err != nil {
+			t.Fatalf("deserialize: %v", err)
+		}
+		if diff := cmp.Diff(session.Values, got); diff != "" {
+			t.Errorf("deserialize got diff Values (-want, +got):\n%s", diff)
+		}
+	}
+}
+
+// newTestClient returns a Firestore client for GOOGLE_CLOUD_PROJECT, or for the
+// emulator at FIRESTORE_EMULATOR_HOST. It skips the test if neither is set.
+func newTestClient(t testing.TB) *firestore.Client {
+	t.Helper()
+	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		if os.Getenv(emulatorHostEnv) == "" {
+			t.Skip("GOOGLE_CLOUD_PROJECT and " + emulatorHostEnv + " not set")
+		}
+		projectID = "test-project"
+	}
+	client, err := firestore.NewClient(context.Background(), projectID)
+	if err != nil {
+		t.Fatalf("firestore.NewClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestNewDeduplicatesReads(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newOfflineClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session := sessions.NewSession(s, "checkout")
+	session.Values["testkey"] = "testvalue"
+	encoded, err := s.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+
+	var fetches int32
+	release := make(chan struct{})
+	s.fetch = func(ctx context.Context, name, id string) (*sessionDoc, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return encoded, nil
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("checkout", "id")
+			got, err := s.New(r, "checkout")
+			if err != nil {
+				t.Errorf("New: %v", err)
+				return
+			}
+			if got, want := got.Values["testkey"], "testvalue"; got != want {
+				t.Errorf("New got testkey=%v, want %v", got, want)
+			}
+		}()
+	}
+	// Give every goroutine time to wait on the first read.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&fetches); got != 1 {
+		t.Errorf("%d concurrent loads read Firestore %d times, want 1", n, got)
+	}
+}
+
+func TestNewSharedReadOutlivesCaller(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newOfflineClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session := sessions.NewSession(s, "checkout")
+	session.Values["testkey"] = "testvalue"
+	encoded, err := s.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+
+	started := make(chan struct{})
+	var once sync.Once
+	release := make(chan struct{})
+	s.fetch = func(ctx context.Context, name, id string) (*sessionDoc, error) {
+		once.Do(func() { close(started) })
+		select {
+		case <-release:
+			return encoded, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// The first load starts the read.
+	first, cancel := context.WithCancel(ctx)
+	r := httptest.NewRequest("GET", "/", nil).WithContext(first)
+	r.Header.Set("checkout", "id")
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.New(r, "checkout")
+		errc <- err
+	}()
+	<-started
+
+	// A second load waits on the same read.
+	type result struct {
+		session *sessions.Session
+		err     error
+	}
+	second := make(chan result, 1)
+	go func() {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("checkout", "id")
+		session, err := s.New(r, "checkout")
+		second <- result{session, err}
+	}()
+	for waiters := 0; waiters < 2; {
+		time.Sleep(time.Millisecond)
+		s.readsMu.Lock()
+		for _, rd := range s.reads {
+			waiters = rd.waiters
+		}
+		s.readsMu.Unlock()
+	}
+
+	// The first load gives up, but the second still gets the session.
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("New got err %v, want context.Canceled", err)
+	}
+	close(release)
+	res := <-second
+	if res.err != nil {
+		t.Fatalf("New: %v", res.err)
+	}
+	if got, want := res.session.Values["testkey"], "testvalue"; got != want {
+		t.Errorf("New got testkey=%v, want %v", got, want)
+	}
+}
+
+func TestRequestContextCanceled(t *testing.T) {
+	s, err := New(context.Background(), newOfflineClient(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// The offline client blocks until the context is done, so New and Save
+	// only return if they use the request's context, and the read New shares
+	// with other loads of the session only stops if it is canceled once New
+	// gives up.
+	readErr := make(chan error, 1)
+	fetch := s.fetch
+	s.fetch = func(ctx context.Context, name, id string) (*sessionDoc, error) {
+		doc, err := fetch(ctx, name, id)
+		readErr <- err
+		return doc, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	r.Header.Set("checkout", "id")
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	canceled := func(err error) bool {
+		return errors.Is(err, context.Canceled) || status.Code(err) == codes.Canceled
+	}
+	if _, err := s.New(r, "checkout"); !canceled(err) {
+		t.Errorf("New got err %v, want it to be canceled", err)
+	}
+	select {
+	case err := <-readErr:
+		if !canceled(err) {
+			t.Errorf("read after New gave up got err %v, want it to be canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("read still running after New gave up, want it to be canceled")
+	}
+	session := sessions.NewSession(s, "checkout")
+	if err := s.Save(r, httptest.NewRecorder(), session); !canceled(err) {
+		t.Errorf("Save got err %v, want it to be canceled", err)
+	}
+}
+
+// newOfflineClient returns a Firestore client that never connects to a real
+// server. It can be used to build references, but every RPC fails.
+func newOfflineClient(t *testing.T) *firestore.Client {
+	t.Helper()
+	client, err := firestore.NewClient(context.Background(), "test-project",
+		option.WithoutAuthentication(),
+		option.WithEndpoint("localhost:1"),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	if err != nil {
+		t.Fatalf("firestore.NewClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// cleanup deletes every document for the name session.
+func (s *Store) cleanup(name string) {
+	s.cleanupContext(context.Background(), name)
+}
+
+// cleanupContext deletes every document for the name session, of the tenant in
+// ctx.
+func (s *Store) cleanupContext(ctx context.Context, name string) {
+	if _, err := s.DeleteAll(ctx, name); err != nil {
+		s.logger.Warn("cleaning up sessions", "collection", s.collectionRef(ctx, name).Path, "error", err)
 	}
 }
@@ -0,0 +1,71 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// tenantsCollection is the root collection of the tenant documents, under
+// which each tenant's sessions are stored. See WithTenantResolver.
+const tenantsCollection = "tenants"
+
+// tenantKey is the context key of the tenant ID.
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx with the given tenant ID. With
+// WithTenantResolver, methods that take a context rather than a request, such
+// as Touch, Exists, Count, and StartGC, use the tenant in their context.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFromContext returns the tenant ID in ctx, or "" if there is none.
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// tenantContext returns ctx, with the tenant ID of r if WithTenantResolver is
+// used. It returns an error wrapping ErrNoTenant if the tenant ID can't be
+// resolved.
+func (s *Store) tenantContext(ctx context.Context, r *http.Request) (context.Context, error) {
+	if s.tenantResolver == nil {
+		return ctx, nil
+	}
+	ctx = WithTenant(ctx, s.tenantResolver(r))
+	return ctx, s.checkTenant(ctx)
+}
+
+// checkTenant returns an error wrapping ErrNoTenant if the Store has a tenant
+// resolver but ctx has no valid tenant ID, so sessions of different tenants are
+// never mixed up.
+func (s *Store) checkTenant(ctx context.Context) error {
+	if s.tenantResolver == nil {
+		return nil
+	}
+	tenant := tenantFromContext(ctx)
+	if tenant == "" {
+		return ErrNoTenant
+	}
+	// The tenant ID is a Firestore document ID.
+	if strings.Contains(tenant, "/") || tenant == "." || tenant == ".." {
+		return fmt.Errorf("%w: invalid tenant ID %q", ErrNoTenant, tenant)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// tenantHeader is the request header with the tenant ID in tests.
+const tenantHeader = "X-Tenant"
+
+func resolveTenant(r *http.Request) string {
+	return r.Header.Get(tenantHeader)
+}
+
+func TestWithTenantResolver(t *testing.T) {
+	ctx := context.Background()
+	if _, err := New(ctx, nil, WithTenantResolver(nil)); err == nil {
+		t.Errorf("New(WithTenantResolver(nil)) got nil error, want error")
+	}
+	s, err := New(ctx, newOfflineClient(t), WithTenantResolver(resolveTenant), WithCollectionPrefix("staging_"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const want = "projects/test-project/databases/(default)/documents/tenants/acme/staging_checkout"
+	if got := s.collectionRef(WithTenant(ctx, "acme"), "checkout").Path; got != want {
+		t.Errorf("collectionRef got %q, want %q", got, want)
+	}
+
+	for _, tenant := range []string{"", "a/b", ".."} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(tenantHeader, tenant)
+		if _, err := s.New(r, "checkout"); !errors.Is(err, ErrNoTenant) {
+			t.Errorf("New(tenant %q) got err %v, want ErrNoTenant", tenant, err)
+		}
+		session := s.newSession(s, "checkout")
+		if err := s.Save(r, httptest.NewRecorder(), session); !errors.Is(err, ErrNoTenant) {
+			t.Errorf("Save(tenant %q) got err %v, want ErrNoTenant", tenant, err)
+		}
+	}
+	if _, err := s.Count(ctx, "checkout"); !errors.Is(err, ErrNoTenant) {
+		t.Errorf("Count without a tenant got err %v, want ErrNoTenant", err)
+	}
+}
+
+func TestTenantsStoredSeparately(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newTestClient(t), WithTenantResolver(resolveTenant))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	const name = "tenants"
+
+	paths := map[string]string{}
+	for _, tenant := range []string{"acme", "globex"} {
+		ctx := WithTenant(ctx, tenant)
+		defer s.cleanupContext(ctx, name)
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(tenantHeader, tenant)
+		session, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		session.Values["tenant"] = tenant
+		if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		ref := s.client.Collection("tenants").Doc(tenant).Collection(name).Doc(session.ID)
+		if _, err := ref.Get(ctx); err != nil {
+			t.Errorf("Get(%q): %v", ref.Path, err)
+		}
+		paths[ref.Path] = tenant
+
+		// The session can't be loaded by another tenant.
+		r.Header.Set(name, session.ID)
+		r.Header.Set(tenantHeader, "other")
+		got, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if !got.IsNew {
+			t.Errorf("New of tenant %q session by another tenant got IsNew=false, want true", tenant)
+		}
+	}
+	if len(paths) != 2 {
+		t.Errorf("sessions of different tenants got paths %v, want different paths", paths)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the name of the OpenTelemetry tracer of a Store.
+const tracerName = "github.com/loveholidays/firestore-gorilla-sessions"
+
+// Span attributes.
+const (
+	// attrSessionName is the name of the session.
+	attrSessionName = "session.name"
+	// attrDocument is the path of the session's Firestore document.
+	attrDocument = "firestore.document"
+	// attrBytes is the length of the encoded session.
+	attrBytes = "session.bytes"
+)
+
+// noopTracer is the tracer of a Store without WithTracerProvider.
+var noopTracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// startSpan starts a span for the operation on the session with the given
+// name.
+func (s *Store) startSpan(ctx context.Context, op, name string) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, "firestoregorilla."+op, trace.WithAttributes(attribute.String(attrSessionName, name)))
+}
+
+// endSpan ends the span, marking it as failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
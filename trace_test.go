@@ -0,0 +1,88 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestWithTracerProvider(t *testing.T) {
+	ctx := context.Background()
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+
+	if _, err := New(ctx, nil, WithTracerProvider(nil)); err == nil {
+		t.Errorf("New(WithTracerProvider(nil)) got nil error, want error")
+	}
+	s, err := New(ctx, newOfflineClient(t), WithTracerProvider(tp))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	s.fetch = func(ctx context.Context, name, id string) (*sessionDoc, error) {
+		return &sessionDoc{Name: name, EncodedSession: `{"Values":{"testkey":"testvalue"}}`}, nil
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("checkout", "id")
+	session, err := s.New(r, "checkout")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// The offline client can't save the session.
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := s.Save(r.WithContext(ctx), httptest.NewRecorder(), session); err == nil {
+		t.Fatalf("Save got nil error, want error")
+	}
+
+	type span struct {
+		Name     string
+		Document string
+		Bytes    int64
+		Error    bool
+	}
+	var got []span
+	for _, s := range rec.Ended() {
+		sp := span{Name: s.Name(), Error: s.Status().Code == codes.Error}
+		for _, a := range s.Attributes() {
+			switch a.Key {
+			case attribute.Key(attrDocument):
+				sp.Document = a.Value.AsString()
+			case attribute.Key(attrBytes):
+				sp.Bytes = a.Value.AsInt64()
+			}
+		}
+		got = append(got, sp)
+	}
+	const doc = "projects/test-project/databases/(default)/documents/checkout/id"
+	want := []span{
+		{Name: "firestoregorilla.deserialize", Bytes: 34},
+		{Name: "firestoregorilla.New", Document: doc},
+		{Name: "firestoregorilla.serialize", Bytes: 35},
+		{Name: "firestoregorilla.Save", Document: doc, Error: true},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("got diff spans (-want, +got):\n%s", diff)
+	}
+}
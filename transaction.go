@@ -0,0 +1,176 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/sessions"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// setBaseValues records the values stored in encoded as the base values of
+// the session. They are decoded again, so changes to the session values can't
+// change them.
+func (s *Store) setBaseValues(ctx context.Context, session *sessions.Session, encoded *sessionDoc) error {
+	base, err := s.deserialize(ctx, encoded)
+	if err != nil {
+		return err
+	}
+	session.Values[baseValuesKey] = base
+	return nil
+}
+
+// saveTransaction saves the session in a transaction, merging the changes made
+// to it since it was loaded with any changes saved concurrently. If create is
+// set, the document is created rather than overwritten, as in saveDoc.
+func (s *Store) saveTransaction(ctx context.Context, session *sessions.Session, ref *firestore.DocumentRef, create bool) error {
+	base, _ := session.Values[baseValuesKey].(map[interface{}]interface{})
+	mine := storedValues(session.Values)
+	var encoded *sessionDoc
+	var merged map[interface{}]interface{}
+	err := s.retrySave(ctx, create, session.Name(), ref, func() *sessionDoc { return encoded }, func() error {
+		ctx, cancel := s.withTimeout(ctx)
+		defer cancel()
+		return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			// A new session has no changes saved concurrently.
+			var theirs map[interface{}]interface{}
+			if !create {
+				var err error
+				if theirs, err = s.readStored(ctx, tx, session.Name(), ref); err != nil {
+					return err
+				}
+			}
+			merged = mergeValues(base, mine, theirs)
+			saved := *session
+			saved.Values = merged
+			var err error
+			if encoded, err = s.encode(ctx, &saved); err != nil {
+				return err
+			}
+			if create {
+				return tx.Create(ref, encoded)
+			}
+			data, merge := setMerge(encoded)
+			return tx.Set(ref, data, merge)
+		})
+	})
+	if err != nil {
+		s.cache.remove(s.cacheKey(ctx, session.Name(), ref.ID))
+		return fmt.Errorf("RunTransaction: %w", err)
+	}
+	session.Values = merged
+	if err := s.setBaseValues(ctx, session, encoded); err != nil {
+		return err
+	}
+	s.cache.put(s.cacheKey(ctx, session.Name(), ref.ID), encoded)
+	return nil
+}
+
+// readStored reads the values of the session stored in ref in the transaction.
+// Missing and expired sessions have no values.
+func (s *Store) readStored(ctx context.Context, tx *firestore.Transaction, name string, ref *firestore.DocumentRef) (map[interface{}]interface{}, error) {
+	ds, err := tx.Get(ref)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Get: %w", err)
+	}
+	encoded := sessionDoc{}
+	if err := ds.DataTo(&encoded); err != nil {
+		return nil, fmt.Errorf("DataTo: %w", err)
+	}
+	if (s.shared() && encoded.Name != name) || s.expired(&encoded) {
+		return nil, nil
+	}
+	return s.deserialize(ctx, &encoded)
+}
+
+// mergeValues merges the changes made to the base values in mine and theirs.
+// Values only changed in theirs are kept, and mine win when both changed the
+// same value, except for booking IDs, whose additions and removals are merged.
+func mergeValues(base, mine, theirs map[interface{}]interface{}) map[interface{}]interface{} {
+	merged := map[interface{}]interface{}{}
+	keys := map[interface{}]bool{}
+	for _, m := range []map[interface{}]interface{}{base, mine, theirs} {
+		for k := range m {
+			keys[k] = true
+		}
+	}
+	for k := range keys {
+		from := theirs
+		if changed(base, mine, k) {
+			from = mine
+			if k == bookingIDsKey && changed(base, theirs, k) {
+				if ids, ok := mergeBookingIDs(base, mine, theirs); ok {
+					merged[k] = ids
+					continue
+				}
+			}
+		}
+		if v, ok := from[k]; ok {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// changed reports whether the value with key k differs between base and m.
+func changed(base, m map[interface{}]interface{}, k interface{}) bool {
+	bv, bok := base[k]
+	v, ok := m[k]
+	return ok != bok || !reflect.DeepEqual(v, bv)
+}
+
+// mergeBookingIDs applies the booking IDs added and removed in mine to those in
+// theirs. It reports false if any of them has the wrong type.
+func mergeBookingIDs(base, mine, theirs map[interface{}]interface{}) ([]string, bool) {
+	baseIDs, err := extractBookingIDs(base)
+	if err != nil {
+		return nil, false
+	}
+	myIDs, err := extractBookingIDs(mine)
+	if err != nil {
+		return nil, false
+	}
+	theirIDs, err := extractBookingIDs(theirs)
+	if err != nil {
+		return nil, false
+	}
+	inBase := map[string]bool{}
+	for _, id := range baseIDs {
+		inBase[id] = true
+	}
+	inMine := map[string]bool{}
+	for _, id := range myIDs {
+		inMine[id] = true
+	}
+	seen := map[string]bool{}
+	ids := []string{}
+	for _, id := range append(append([]string(nil), theirIDs...), myIDs...) {
+		removed := inBase[id] && !inMine[id]
+		if seen[id] || removed {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids, true
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/sessions"
+)
+
+type values = map[interface{}]interface{}
+
+func TestMergeValues(t *testing.T) {
+	tests := []struct {
+		desc   string
+		base   values
+		mine   values
+		theirs values
+		want   values
+	}{
+		{
+			desc:   "new session",
+			mine:   values{"a": "mine"},
+			theirs: values{"b": "theirs"},
+			want:   values{"a": "mine", "b": "theirs"},
+		},
+		{
+			desc:   "different keys changed",
+			base:   values{"a": "base", "b": "base"},
+			mine:   values{"a": "mine", "b": "base"},
+			theirs: values{"a": "base", "b": "theirs"},
+			want:   values{"a": "mine", "b": "theirs"},
+		},
+		{
+			desc:   "same key changed",
+			base:   values{"a": "base"},
+			mine:   values{"a": "mine"},
+			theirs: values{"a": "theirs"},
+			want:   values{"a": "mine"},
+		},
+		{
+			desc:   "deleted by me",
+			base:   values{"a": "base", "b": "base"},
+			mine:   values{"b": "base"},
+			theirs: values{"a": "base", "b": "theirs"},
+			want:   values{"b": "theirs"},
+		},
+		{
+			desc:   "deleted by them",
+			base:   values{"a": "base"},
+			mine:   values{"a": "base"},
+			theirs: values{},
+			want:   values{},
+		},
+		{
+			desc:   "booking IDs changed by both",
+			base:   values{bookingIDsKey: []interface{}{"LH1", "LH2"}},
+			mine:   values{bookingIDsKey: []string{"LH2", "LH3"}},
+			theirs: values{bookingIDsKey: []interface{}{"LH1", "LH2", "LH4"}},
+			want:   values{bookingIDsKey: []string{"LH2", "LH4", "LH3"}},
+		},
+	}
+	for _, test := range tests {
+		got := mergeValues(test.base, test.mine, test.theirs)
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%s: mergeValues got diff (-want, +got):\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestTransactionalSaveBaseValues(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := New(ctx, nil, WithTransactionalSave(), WithChunking()); err == nil {
+		t.Errorf("New(WithTransactionalSave(), WithChunking()) got nil error, want error")
+	}
+
+	s, err := New(ctx, nil, WithTransactionalSave())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session := sessions.NewSession(s, "checkout")
+	session.Values["key"] = "value"
+	session.Values[baseValuesKey] = values{"key": "base"}
+
+	// The base values are never saved.
+	doc, err := s.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	got, err := s.deserialize(ctx, doc)
+	if err != nil {
+		t.Fatalf("deserialize: %v", err)
+	}
+	if diff := cmp.Diff(values{"key": "value"}, got); diff != "" {
+		t.Errorf("deserialize got diff (-want, +got):\n%s", diff)
+	}
+}
+
+func TestTransactionalSave(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithTransactionalSave())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const name = "TestTransactionalSave"
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.cleanup(name)
+	session.Values[bookingIDsKey] = []string{"LH1"}
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// Two tabs load the session, change it, and save it concurrently.
+	changes := []func(*sessions.Session){
+		func(session *sessions.Session) {
+			AddBookingID(session, "LH2")
+			session.Values["tab"] = "first"
+		},
+		func(session *sessions.Session) {
+			AddBookingID(session, "LH3")
+			session.Values["currency"] = "GBP"
+		},
+	}
+	var tabs []*sessions.Session
+	for range changes {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(name, session.ID)
+		tab, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		tabs = append(tabs, tab)
+	}
+	var wg sync.WaitGroup
+	for i, change := range changes {
+		wg.Add(1)
+		go func(tab *sessions.Session, change func(*sessions.Session)) {
+			defer wg.Done()
+			change(tab)
+			if err := s.Save(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder(), tab); err != nil {
+				t.Errorf("Save: %v", err)
+			}
+		}(tabs[i], change)
+	}
+	wg.Wait()
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(name, session.ID)
+	got, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ids, err := extractBookingIDs(got.Values)
+	if err != nil {
+		t.Fatalf("extractBookingIDs: %v", err)
+	}
+	if len(ids) != 3 {
+		t.Errorf("after concurrent saves, got booking IDs %v, want LH1, LH2, and LH3", ids)
+	}
+	if got.Values["tab"] != "first" || got.Values["currency"] != "GBP" {
+		t.Errorf("after concurrent saves, got values %v, want both changes", storedValues(got.Values))
+	}
+}
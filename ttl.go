@@ -0,0 +1,94 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	admin "cloud.google.com/go/firestore/apiv1/admin"
+	"cloud.google.com/go/firestore/apiv1/admin/adminpb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// EnsureTTLPolicy makes sure Firestore has a TTL policy on the expireAt field
+// of the collection sessions with the given name are stored in, so Firestore
+// deletes expired sessions itself. With the policy in place, there is no need
+// to delete expired sessions manually.
+//
+// EnsureTTLPolicy is idempotent: it does nothing if the policy already exists
+// or is being created. Otherwise, it requests the policy and returns without
+// waiting for Firestore to finish creating it, which can take a while.
+//
+// The opts are used to create a Firestore Admin API client. The credentials
+// need permission to manage Firestore indexes, such as the
+// roles/datastore.indexAdmin role.
+func (s *Store) EnsureTTLPolicy(ctx context.Context, name string, opts ...option.ClientOption) error {
+	client, err := admin.NewFirestoreAdminClient(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("admin.NewFirestoreAdminClient: %w", err)
+	}
+	defer client.Close()
+
+	fieldName := s.ttlFieldName(name)
+	field, err := client.GetField(ctx, &adminpb.GetFieldRequest{Name: fieldName})
+	if err != nil && status.Code(err) != codes.NotFound {
+		return ttlError("GetField", err)
+	}
+	if err == nil {
+		switch field.GetTtlConfig().GetState() {
+		case adminpb.Field_TtlConfig_CREATING, adminpb.Field_TtlConfig_ACTIVE:
+			return nil
+		}
+	}
+
+	_, err = client.UpdateField(ctx, &adminpb.UpdateFieldRequest{
+		Field: &adminpb.Field{
+			Name:      fieldName,
+			TtlConfig: &adminpb.Field_TtlConfig{},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"ttl_config"}},
+	})
+	if err != nil {
+		return ttlError("UpdateField", err)
+	}
+	return nil
+}
+
+// ttlFieldName returns the Firestore Admin API name of the expireAt field of
+// the collection sessions with the given name are stored in.
+func (s *Store) ttlFieldName(name string) string {
+	// The collection path looks like
+	// projects/{project}/databases/{database}/documents/{path}, where the
+	// path can go through parent documents. TTL policies apply to collection
+	// groups, which are named by the collection ID alone. Every tenant's
+	// collection has the same ID, so they are all in the same group.
+	coll := s.collectionRef(context.Background(), name)
+	database, _, _ := strings.Cut(coll.Path, "/documents/")
+	return database + "/collectionGroups/" + coll.ID + "/fields/" + expireAtField
+}
+
+// ttlError wraps an error from the Firestore Admin API, explaining permission
+// errors.
+func ttlError(method string, err error) error {
+	if status.Code(err) == codes.PermissionDenied {
+		return fmt.Errorf("%s: permission denied managing the TTL policy, the credentials need the roles/datastore.indexAdmin role or equivalent: %w", method, err)
+	}
+	return fmt.Errorf("%s: %w", method, err)
+}
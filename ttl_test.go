@@ -0,0 +1,49 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTTLFieldName(t *testing.T) {
+	ctx := context.Background()
+	client := newOfflineClient(t)
+
+	s, err := New(ctx, client, WithCollectionPrefix("staging_"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	want := "projects/test-project/databases/(default)/collectionGroups/staging_checkout/fields/expireAt"
+	if got := s.ttlFieldName("checkout"); got != want {
+		t.Errorf("ttlFieldName got %q, want %q", got, want)
+	}
+}
+
+func TestTTLFieldNameNested(t *testing.T) {
+	ctx := context.Background()
+	client := newOfflineClient(t)
+
+	coll := client.Collection("apps").Doc("web").Collection("sessions")
+	s, err := NewWithCollection(ctx, client, coll)
+	if err != nil {
+		t.Fatalf("NewWithCollection: %v", err)
+	}
+	want := "projects/test-project/databases/(default)/collectionGroups/sessions/fields/expireAt"
+	if got := s.ttlFieldName("checkout"); got != want {
+		t.Errorf("ttlFieldName got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/gorilla/sessions"
+)
+
+// Values returns the value of the session with the given key as a T, and
+// whether the key is set. It returns an error naming the key and T if the
+// value has another type.
+//
+// Most codecs decode slices as []interface{}, so if T is a slice type, such as
+// []string, a []interface{} value is converted to it element by element.
+func Values[T any](session *sessions.Session, key string) (T, bool, error) {
+	return value[T](session.Values, key)
+}
+
+// value is Values for the values of a session.
+func value[T any](values map[interface{}]interface{}, key string) (T, bool, error) {
+	var zero T
+	v, ok := values[key]
+	if !ok || v == nil {
+		return zero, false, nil
+	}
+	if t, ok := v.(T); ok {
+		return t, true, nil
+	}
+	want := reflect.TypeOf((*T)(nil)).Elem()
+	elems, ok := v.([]interface{})
+	if !ok || want.Kind() != reflect.Slice {
+		return zero, true, fmt.Errorf("incorrect type for %q: got %T, want %v", key, v, want)
+	}
+	out := reflect.MakeSlice(want, len(elems), len(elems))
+	for i, e := range elems {
+		if e == nil || !reflect.TypeOf(e).AssignableTo(want.Elem()) {
+			return zero, true, fmt.Errorf("incorrect type for %q: got %T element, want %v", key, e, want.Elem())
+		}
+		out.Index(i).Set(reflect.ValueOf(e))
+	}
+	return out.Interface().(T), true, nil
+}
+
+// memoryKey is the type of the keys of session values that are only kept in
+// memory, and never saved.
+type memoryKey int
+
+const (
+	// baseValuesKey is the key of the values of a session as they were
+	// loaded, with WithTransactionalSave.
+	baseValuesKey memoryKey = iota
+	// versionKey is the key of the version of a session as it was loaded,
+	// with WithOptimisticLocking.
+	versionKey
+	// fingerprintKey is the key of the fingerprint of the values of a
+	// session as they were loaded or last saved, with WithSkipUnchangedSaves.
+	fingerprintKey
+)
+
+// storedValues returns the values of a session without the values only kept
+// in memory.
+func storedValues(values map[interface{}]interface{}) map[interface{}]interface{} {
+	n := 0
+	for k := range values {
+		if _, ok := k.(memoryKey); ok {
+			n++
+		}
+	}
+	if n == 0 {
+		return values
+	}
+	stored := make(map[interface{}]interface{}, len(values)-n)
+	for k, v := range values {
+		if _, ok := k.(memoryKey); !ok {
+			stored[k] = v
+		}
+	}
+	return stored
+}
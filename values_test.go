@@ -0,0 +1,64 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/sessions"
+)
+
+func TestValues(t *testing.T) {
+	session := sessions.NewSession(nil, "checkout")
+	session.Values["name"] = "value"
+	session.Values["ints"] = []interface{}{1, 2}
+	session.Values["mixed"] = []interface{}{1, "two"}
+
+	if got, ok, err := Values[string](session, "name"); err != nil || !ok || got != "value" {
+		t.Errorf("Values[string](name) got (%q, %v, %v), want (value, true, nil)", got, ok, err)
+	}
+	if got, ok, err := Values[string](session, "missing"); err != nil || ok || got != "" {
+		t.Errorf("Values[string](missing) got (%q, %v, %v), want (\"\", false, nil)", got, ok, err)
+	}
+	got, ok, err := Values[[]int](session, "ints")
+	if err != nil || !ok {
+		t.Errorf("Values[[]int](ints) got (%v, %v), want (true, nil)", ok, err)
+	}
+	if diff := cmp.Diff([]int{1, 2}, got); diff != "" {
+		t.Errorf("Values[[]int](ints) got diff (-want, +got):\n%s", diff)
+	}
+
+	tests := []struct {
+		key     string
+		wantErr string
+	}{
+		{key: "name", wantErr: `incorrect type for "name": got string, want int`},
+		{key: "mixed", wantErr: `incorrect type for "mixed": got []interface {}, want int`},
+	}
+	for _, test := range tests {
+		_, ok, err := Values[int](session, test.key)
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("Values[int](%s) got err %v, want %q", test.key, err, test.wantErr)
+		}
+		if !ok {
+			t.Errorf("Values[int](%s) got ok=false, want true", test.key)
+		}
+	}
+	if _, _, err := Values[[]int](session, "mixed"); err == nil || !strings.Contains(err.Error(), "got string element, want int") {
+		t.Errorf("Values[[]int](mixed) got err %v, want an element type error", err)
+	}
+}
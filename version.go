@@ -0,0 +1,86 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/sessions"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Version returns the version of the session when it was loaded or last
+// saved, with WithOptimisticLocking. It is zero for new sessions.
+func Version(session *sessions.Session) int64 {
+	v, _ := session.Values[versionKey].(int64)
+	return v
+}
+
+// saveVersioned saves the session, stored in encoded, if the stored version of
+// the session is the version it was loaded with. Otherwise, it returns a
+// *ConflictError. If create is set, the document is created rather than
+// overwritten, as in saveDoc, so there is no stored version to check.
+func (s *Store) saveVersioned(ctx context.Context, session *sessions.Session, ref *firestore.DocumentRef, encoded *sessionDoc, create bool) error {
+	loaded := Version(session)
+	encoded.Version = loaded + 1
+	err := s.retrySave(ctx, create, session.Name(), ref, func() *sessionDoc { return encoded }, func() error {
+		ctx, cancel := s.withTimeout(ctx)
+		defer cancel()
+		return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			if create {
+				return tx.Create(ref, encoded)
+			}
+			stored, err := s.storedVersion(tx, session.Name(), ref)
+			if err != nil {
+				return err
+			}
+			if stored != loaded {
+				return &ConflictError{Loaded: loaded, Stored: stored}
+			}
+			data, merge := setMerge(encoded)
+			return tx.Set(ref, data, merge)
+		})
+	})
+	if err != nil {
+		s.cache.remove(s.cacheKey(ctx, session.Name(), ref.ID))
+		return fmt.Errorf("RunTransaction: %w", err)
+	}
+	session.Values[versionKey] = encoded.Version
+	s.cache.put(s.cacheKey(ctx, session.Name(), ref.ID), encoded)
+	return nil
+}
+
+// storedVersion reads the version of the session stored in ref in the
+// transaction. Missing and expired sessions have version zero.
+func (s *Store) storedVersion(tx *firestore.Transaction, name string, ref *firestore.DocumentRef) (int64, error) {
+	ds, err := tx.Get(ref)
+	if status.Code(err) == codes.NotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Get: %w", err)
+	}
+	encoded := sessionDoc{}
+	if err := ds.DataTo(&encoded); err != nil {
+		return 0, fmt.Errorf("DataTo: %w", err)
+	}
+	if (s.shared() && encoded.Name != name) || s.expired(&encoded) {
+		return 0, nil
+	}
+	return encoded.Version, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithOptimisticLocking(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := New(ctx, nil, WithOptimisticLocking(), WithTransactionalSave()); err == nil {
+		t.Errorf("New(WithOptimisticLocking(), WithTransactionalSave()) got nil error, want error")
+	}
+
+	s, err := New(ctx, newOfflineClient(t), WithOptimisticLocking())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	s.fetch = func(ctx context.Context, name, id string) (*sessionDoc, error) {
+		return &sessionDoc{Name: name, EncodedSession: `{"Values":{"key":"value"}}`, Version: 7}, nil
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("checkout", "id")
+	session, err := s.New(r, "checkout")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got, want := Version(session), int64(7); got != want {
+		t.Errorf("Version got %d, want %d", got, want)
+	}
+
+	// The version is never saved as a value.
+	doc, err := s.serialize(ctx, session)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	values, err := s.deserialize(ctx, doc)
+	if err != nil {
+		t.Fatalf("deserialize: %v", err)
+	}
+	if _, ok := values[versionKey]; ok || len(values) != 1 {
+		t.Errorf("deserialize got %v, want only the key value", values)
+	}
+}
+
+func TestStaleSaveRejected(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithOptimisticLocking())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const name = "TestStaleSaveRejected"
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.cleanup(name)
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if got, want := Version(session), int64(1); got != want {
+		t.Errorf("after Save, Version got %d, want %d", got, want)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(name, session.ID)
+	first, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	stale, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	first.Values["key"] = "first"
+	if err := s.Save(r, httptest.NewRecorder(), first); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	stale.Values["key"] = "stale"
+	err = s.Save(r, httptest.NewRecorder(), stale)
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("Save of a stale session got err %v, want ErrConflict", err)
+	}
+	var cErr *ConflictError
+	if !errors.As(err, &cErr) || cErr.Loaded != 1 || cErr.Stored != 2 {
+		t.Errorf("Save of a stale session got err %v, want ConflictError{Loaded: 1, Stored: 2}", err)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// CacheMode is how saving a session updates the cache and Firestore. See
+// WithCacheMode.
+type CacheMode int
+
+const (
+	// WriteThrough saves sessions to Firestore before Save returns, then
+	// caches them. It is the default.
+	WriteThrough CacheMode = iota
+	// WriteBack caches sessions and returns from Save at once. The sessions
+	// are saved to Firestore in the background, in batches, by Flush.
+	WriteBack
+)
+
+// String returns the name of the mode.
+func (m CacheMode) String() string {
+	switch m {
+	case WriteThrough:
+		return "write-through"
+	case WriteBack:
+		return "write-back"
+	}
+	return fmt.Sprintf("CacheMode(%d)", int(m))
+}
+
+// writeBackInterval is how often sessions saved with WriteBack are flushed to
+// Firestore.
+const writeBackInterval = time.Second
+
+// pendingWrite is a session saved with WriteBack that hasn't been written to
+// Firestore yet.
+type pendingWrite struct {
+	ref *firestore.DocumentRef
+	doc *sessionDoc
+}
+
+// writeBackQueue holds the sessions saved with WriteBack until they are
+// flushed. Only the latest save of each session is kept. A nil
+// *writeBackQueue holds nothing.
+type writeBackQueue struct {
+	// flushMu serializes flushes, and deletes of sessions, so the writes of
+	// each session reach Firestore in the order they were made.
+	flushMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[cacheKey]pendingWrite
+	// closed is set by Close, once nothing flushes the queue any more.
+	closed bool
+	// done is closed when the flushing goroutine exits.
+	done chan struct{}
+}
+
+// newWriteBackQueue returns an empty queue.
+func newWriteBackQueue() *writeBackQueue {
+	return &writeBackQueue{
+		pending: map[cacheKey]pendingWrite{},
+		done:    make(chan struct{}),
+	}
+}
+
+// put queues the document of the session, replacing any pending write of it.
+// It reports false, queuing nothing, once the queue is closed.
+func (q *writeBackQueue) put(k cacheKey, w pendingWrite) bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	q.pending[k] = w
+	return true
+}
+
+// close makes later puts fail. The writes already queued can still be taken.
+func (q *writeBackQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+}
+
+// get returns the pending document of the session, if any.
+func (q *writeBackQueue) get(k cacheKey) (*sessionDoc, bool) {
+	if q == nil {
+		return nil, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w, ok := q.pending[k]
+	return w.doc, ok
+}
+
+// remove drops any pending write of the session.
+func (q *writeBackQueue) remove(k cacheKey) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, k)
+}
+
+// take empties the queue and returns the pending writes.
+func (q *writeBackQueue) take() map[cacheKey]pendingWrite {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	writes := q.pending
+	q.pending = map[cacheKey]pendingWrite{}
+	return writes
+}
+
+// requeue queues a write that failed again, unless the session was saved again
+// since.
+func (q *writeBackQueue) requeue(k cacheKey, w pendingWrite) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.pending[k]; !ok {
+		q.pending[k] = w
+	}
+}
+
+// Flush writes the sessions saved with WriteBack that haven't been written yet
+// to Firestore, and waits for the writes to finish. Writes that fail are
+// retried by the next flush, and their errors are joined. Without WriteBack,
+// Flush does nothing.
+func (s *Store) Flush(ctx context.Context) error {
+	q := s.writeBack
+	if q == nil {
+		return nil
+	}
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+	writes := q.take()
+	if len(writes) == 0 {
+		return nil
+	}
+
+	bw := s.client.BulkWriter(ctx)
+	jobs := make(map[cacheKey]*firestore.BulkWriterJob, len(writes))
+	var errs []error
+	for k, w := range writes {
+		data, merge := setMerge(w.doc)
+		job, err := bw.Set(w.ref, data, merge)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("BulkWriter.Set: %w", err))
+			q.requeue(k, w)
+			continue
+		}
+		jobs[k] = job
+	}
+	// End flushes the pending writes and waits for them to finish.
+	bw.End()
+	for k, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			errs = append(errs, fmt.Errorf("Set: %w", err))
+			q.requeue(k, writes[k])
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flushLoop flushes the sessions saved with WriteBack every writeBackInterval,
+// until the Store is closed.
+func (s *Store) flushLoop() {
+	defer close(s.writeBack.done)
+	ticker := time.NewTicker(writeBackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed.Done():
+			return
+		case <-ticker.C:
+			// Only log errors, the next flush tries again.
+			if err := s.Flush(s.closed); err != nil && s.closed.Err() == nil {
+				s.logger.Error("flushing write-back sessions", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestoregorilla
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/sessions"
+)
+
+func TestWithCacheMode(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		desc string
+		opts []Option
+	}{
+		{desc: "unknown mode", opts: []Option{WithCacheTTL(time.Minute), WithCacheMode(CacheMode(42))}},
+		{desc: "no cache", opts: []Option{WithCacheMode(WriteBack)}},
+		{desc: "transactional", opts: []Option{WithCacheTTL(time.Minute), WithCacheMode(WriteBack), WithTransactionalSave()}},
+		{desc: "chunking", opts: []Option{WithCacheTTL(time.Minute), WithCacheMode(WriteBack), WithChunking()}},
+	}
+	for _, test := range tests {
+		if _, err := New(ctx, nil, test.opts...); err == nil {
+			t.Errorf("New with %s got nil error, want error", test.desc)
+		}
+	}
+}
+
+func TestWriteBackSaveIsCached(t *testing.T) {
+	ctx := context.Background()
+	// The offline client can't write, so Save succeeding means it didn't
+	// write to Firestore. Only new sessions are written straight away.
+	s, err := New(ctx, newOfflineClient(t), WithCacheTTL(time.Minute), WithCacheMode(WriteBack))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	created := 0
+	s.createRef = func(ctx context.Context, ref *firestore.DocumentRef, encoded *sessionDoc) error {
+		created++
+		return nil
+	}
+
+	const name = "TestWriteBackSaveIsCached"
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	session.Values["testk"] = "testv"
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if created != 1 {
+		t.Errorf("Save created %d documents, want 1", created)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(name, session.ID)
+	got, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got.IsNew || got.Values["testk"] != "testv" {
+		t.Errorf("New after Save got IsNew=%v, values %v, want the saved session", got.IsNew, got.Values)
+	}
+}
+
+func TestWriteBackSaveAfterClose(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, newOfflineClient(t), WithCacheTTL(time.Minute), WithCacheMode(WriteBack))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Nothing flushes sessions after Close, so Save writes to the offline
+	// client, which fails, rather than queuing the session.
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	const name = "TestWriteBackSaveAfterClose"
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	r.Header.Set(name, "id")
+	session := sessions.NewSession(s, name)
+	if err := s.Save(r, httptest.NewRecorder(), session); err == nil {
+		t.Errorf("Save after Close with an unreachable Firestore got nil, want an error")
+	}
+	if _, ok := s.writeBack.get(s.cacheKey(ctx, name, "id")); ok {
+		t.Errorf("Save after Close queued the session")
+	}
+}
+
+func TestWriteBackFlush(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	s, err := New(ctx, client, WithCacheTTL(time.Minute), WithCacheMode(WriteBack))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const name = "TestWriteBackFlush"
+	defer s.cleanup(name)
+	// save saves a new session, which is written straight away, then saves
+	// value in it, which is only written when flushed.
+	save := func(value string) string {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/", nil)
+		session, err := s.New(r, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		for _, v := range []string{"new", value} {
+			session.Values["testk"] = v
+			if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+		}
+		return session.ID
+	}
+	// stored returns the testk value of the stored session, if it exists.
+	stored := func(id string) (interface{}, bool) {
+		t.Helper()
+		encoded, err := s.readDoc(ctx, name, id)
+		if errors.Is(err, ErrSessionNotFound) {
+			return nil, false
+		}
+		if err != nil {
+			t.Fatalf("readDoc: %v", err)
+		}
+		values, err := s.deserialize(ctx, encoded)
+		if err != nil {
+			t.Fatalf("deserialize: %v", err)
+		}
+		return values["testk"], true
+	}
+
+	flushed := save("flushed")
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got, ok := stored(flushed); got != "flushed" {
+		t.Errorf("stored session after Flush got testk=%v (exists %v), want flushed", got, ok)
+	}
+
+	// Deleting a pending session means it is never written.
+	deleted := save("deleted")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(name, deleted)
+	session, err := s.New(r, name)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Delete(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	closed := save("closed")
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got, ok := stored(closed); got != "closed" {
+		t.Errorf("stored session after Close got testk=%v (exists %v), want closed", got, ok)
+	}
+	if _, ok := stored(deleted); ok {
+		t.Errorf("deleted session exists after Close")
+	}
+}